@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// tlvBlock gives a TLV chunk the fields of one item: type, length and value,
+// or the type alone.
+func tlvBlock(def blockDef, single bool) blockDef {
+	cfg := def.spec.TLV
+	typeSize, lengthSize := tlvSizes(cfg)
+
+	kind := Field{Name: "type", Size: typeSize, Type: uintType(typeSize)}
+	if single {
+		def.fields = []Field{kind}
+		return def
+	}
+	adjust := 0
+	if cfg.LengthIncludesHeader {
+		adjust = typeSize + lengthSize
+	}
+	value := Field{Name: "value", Follow: true, Type: "bytes", SizeFrom: "length"}
+	if def.spec.Repeat != nil && def.spec.Repeat.SplitPayload > 0 {
+		value.Value = "<<VPN_DATA>>"
+	}
+	def.fields = []Field{
+		kind,
+		{Name: "length", Follow: true, Size: lengthSize, Type: uintType(lengthSize),
+			Length: &LengthConfig{Of: []string{"field:value"}, Adjust: adjust}},
+		value,
+	}
+	return def
+}
+
+func tlvSizes(cfg *TLVConfig) (typeSize, lengthSize int) {
+	typeSize, lengthSize = cfg.TypeSize, cfg.LengthSize
+	if typeSize == 0 {
+		typeSize = 1
+	}
+	if lengthSize == 0 {
+		lengthSize = 1
+	}
+	return typeSize, lengthSize
+}
+
+// uintType is the big-endian unsigned type of a width in bytes, if any.
+func uintType(size int) string {
+	switch size {
+	case 1:
+		return "uint8"
+	case 2:
+		return "uint16_be"
+	case 4:
+		return "uint32_be"
+	case 8:
+		return "uint64_be"
+	}
+	return ""
+}
+
+// tlvSingle reports whether items of a type are a lone type.
+func tlvSingle(cfg *TLVConfig, kind interface{}) bool {
+	k, ok := toUint64(kind)
+	if !ok {
+		return false
+	}
+	for _, v := range cfg.NoLength {
+		if n, ok := toUint64(v); ok && n == k {
+			return true
+		}
+	}
+	return false
+}
+
+// tlvValue is the wire form of an item's value: text and bytes as they are,
+// numbers big-endian in the item's "size" bytes or as few as hold them.
+func tlvValue(value interface{}, size interface{}) []byte {
+	if data := fieldContent(value); data != nil {
+		if _, isInt := value.(int64); !isInt {
+			return data
+		}
+	}
+	n, ok := toUint64(value)
+	if !ok {
+		return nil
+	}
+	width := 1
+	for width < 8 && n>>(8*width) != 0 {
+		width++
+	}
+	if s, ok := toUint64(size); ok && s > 0 && s <= 8 {
+		width = int(s)
+	}
+	out := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		out[i] = byte(n)
+		n >>= 8
+	}
+	return out
+}
+
+// chunkInstances lists the instances the sender builds of a chunk, each with
+// the block to place and the values its item gives by field name.
+func (t *TunnelNode) chunkInstances(def blockDef, env *exprEnv) ([]blockDef, []map[string]interface{}) {
+	spec := def.spec
+	if spec.Repeat == nil {
+		return []blockDef{def}, []map[string]interface{}{nil}
+	}
+
+	items := spec.Repeat.Items
+	if n := spec.Repeat.SplitPayload; n > 0 {
+		items = splitPayload(t.processVPNData(env.connID, env.data), n, payloadField(spec))
+	} else if items == nil {
+		if n, ok := toUint64(t.resolveValue(spec.Repeat.Count, env)); ok && n <= maxExprBytes {
+			items = make([]map[string]interface{}, n)
+		}
+	}
+
+	defs := make([]blockDef, len(items))
+	values := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		d := def
+		d.instance = i + 1
+		if each := spec.Repeat.Each; each != nil {
+			merged := make(map[string]interface{}, len(each)+len(item))
+			for name, v := range each {
+				merged[name] = v
+			}
+			for name, v := range item {
+				merged[name] = v
+			}
+			item = merged
+		}
+		values[i] = item
+		if spec.TLV != nil {
+			kind := t.resolveValue(item["type"], env)
+			single := tlvSingle(spec.TLV, kind)
+			d = tlvBlock(d, single)
+			values[i] = map[string]interface{}{"type": kind}
+			if !single {
+				values[i]["value"] = tlvValue(t.resolveValue(item["value"], env), item["size"])
+			}
+		}
+		defs[i] = d
+	}
+	return defs, values
+}
+
+// splitPayload cuts the payload into items of at most max bytes, under the
+// name of the field that carries them. An empty payload still makes one item.
+func splitPayload(data []byte, max int, name string) []map[string]interface{} {
+	var items []map[string]interface{}
+	for len(items) == 0 || len(data) > 0 {
+		n := len(data)
+		if n > max {
+			n = max
+		}
+		items = append(items, map[string]interface{}{name: data[:n:n]})
+		data = data[n:]
+	}
+	return items
+}
+
+// payloadField names the field of a chunk that carries the payload.
+func payloadField(spec *Chunk) string {
+	if spec.TLV != nil {
+		return "value"
+	}
+	for _, field := range spec.Fields {
+		if field.Value == "<<VPN_DATA>>" {
+			return field.Name
+		}
+	}
+	return ""
+}
+
+// fillRepeatFields sets the fields a repeated chunk takes its count or
+// length from, once its instances, from block first on, are placed.
+func (l *packetLayout) fillRepeatFields(cfg *RepeatConfig, first int) {
+	set := func(name string, value int64) {
+		for b := first - 1; b >= 0; b-- {
+			if ref, ok := l.blocks[b].find(name); ok {
+				if ref.field.Length == nil && ref.field.Computation == nil {
+					l.blocks[b].values[ref.index] = value
+				}
+				return
+			}
+		}
+	}
+
+	if cfg.CountFrom != "" {
+		set(cfg.CountFrom, int64(len(l.blocks)-first))
+	}
+	if cfg.LengthFrom != "" {
+		total := 0
+		if first < len(l.blocks) {
+			total = l.end - l.blocks[first].span.start
+		}
+		set(cfg.LengthFrom, int64(total))
+	}
+}
+
+// repeatBounds tells the receiver how many instances of a chunk follow: a
+// count, or -1 and the offset where they end.
+func (t *TunnelNode) repeatBounds(cfg *RepeatConfig, l *packetLayout, env *exprEnv) (count, stop int, ok bool) {
+	remaining := len(l.frame) - l.end
+
+	from := cfg.CountFrom
+	if from == "" {
+		from = cfg.LengthFrom
+	}
+	if from == "" {
+		n, ok := toUint64(t.resolveValue(cfg.Count, env))
+		return int(n), 0, ok && n <= uint64(remaining)
+	}
+
+	ref, found := l.lookupField(nil, from)
+	if !found || ref.span.end > len(l.frame) {
+		return 0, 0, false
+	}
+	value, ok := decodeValue(ref.field, bytes.TrimSuffix(l.frame[ref.span.start:ref.span.end], []byte(ref.field.Terminator)))
+	if !ok {
+		return 0, 0, false
+	}
+	u, ok := toUint64(value)
+	if !ok {
+		return 0, 0, false
+	}
+	if cfg.CountFrom != "" {
+		return int(u), 0, u <= uint64(remaining)
+	}
+
+	size := int64(u)
+	if lc := ref.field.Length; lc != nil {
+		// The length field covers its scopes: undo its unit and adjustment,
+		// and leave out what of them is already placed
+		size -= int64(lc.Adjust)
+		if lc.Unit > 1 {
+			size *= int64(lc.Unit)
+		}
+		size -= l.length(ref.block, &LengthConfig{Of: lc.Of})
+	}
+	if size < 0 || size > int64(remaining) {
+		return 0, 0, false
+	}
+	return -1, l.end + int(size), true
+}
+
+// chunkPresent evaluates a chunk's condition over the fields placed before
+// it.
+func (t *TunnelNode) chunkPresent(spec *Chunk, l *packetLayout, env *exprEnv) bool {
+	if spec.Condition == "" {
+		return true
+	}
+	return truthy(t.resolveValue(spec.Condition, l.fieldEnv(env)))
+}
+
+// fieldEnv extends env with the values of the fields placed so far, by name;
+// a field shadows a variable of the same name. Lengths and computations
+// aren't known yet when building.
+func (l *packetLayout) fieldEnv(env *exprEnv) *exprEnv {
+	fenv := *env
+	fenv.vars = make(map[string]interface{}, len(env.vars))
+	for name, v := range env.vars {
+		fenv.vars[name] = v
+	}
+	for i := range l.blocks {
+		b := &l.blocks[i]
+		for j, field := range b.fields {
+			var value interface{}
+			if l.grow {
+				value = b.values[j]
+			} else if pos := (layoutField{b, field}).position(); pos.end <= len(l.frame) {
+				value, _ = decodeValue(field, bytes.TrimSuffix(l.frame[pos.start:pos.end], []byte(field.Terminator)))
+			}
+			if _, err := normalizeExprValue(value); err == nil {
+				fenv.vars[field.Name] = value
+			}
+		}
+	}
+	return &fenv
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case int64:
+		return x != 0
+	case string:
+		b, err := strconv.ParseBool(x)
+		return err == nil && b || err != nil && x != ""
+	case []byte:
+		return len(x) > 0
+	}
+	return v != nil
+}
+
+// checkChunk validates the repetition and TLV layout of a chunk whose
+// fields are about to be placed after the blocks of l.
+func checkChunk(l *packetLayout, spec *Chunk) error {
+	if cfg := spec.TLV; cfg != nil {
+		typeSize, lengthSize := tlvSizes(cfg)
+		if uintType(typeSize) == "" || uintType(lengthSize) == "" {
+			return fmt.Errorf("tlv type_size and length_size must be 1, 2, 4 or 8")
+		}
+		if spec.Repeat == nil {
+			return fmt.Errorf("tlv needs a repeat")
+		}
+	}
+
+	cfg := spec.Repeat
+	if cfg == nil {
+		return nil
+	}
+	if cfg.SplitPayload < 0 {
+		return fmt.Errorf("split_payload must be positive")
+	}
+	if cfg.SplitPayload > 0 {
+		name := payloadField(spec)
+		if name == "" {
+			return fmt.Errorf("split_payload needs a \"<<VPN_DATA>>\" field in the chunk")
+		}
+		if cfg.CountFrom == "" && cfg.LengthFrom == "" {
+			// The number of slices follows the payload, so a fixed count
+			// would have the receiver read the wrong number of instances
+			return fmt.Errorf("split_payload needs count_from or length_from for the receiver")
+		}
+		for _, field := range spec.Fields {
+			if field.Name == name && field.Size > 0 && field.SizeFrom == "" && field.Size-len(field.Terminator) < cfg.SplitPayload {
+				return fmt.Errorf("split_payload %d doesn't fit in the %d-byte field %s", cfg.SplitPayload, field.Size, name)
+			}
+		}
+	}
+	if cfg.Count == nil && cfg.CountFrom == "" && cfg.LengthFrom == "" {
+		return fmt.Errorf("repeat needs count, count_from or length_from for the receiver")
+	}
+	for _, name := range []string{cfg.CountFrom, cfg.LengthFrom} {
+		if name == "" {
+			continue
+		}
+		if _, ok := l.lookupField(nil, name); !ok {
+			return fmt.Errorf("repeat takes %q, which names no earlier field", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckChunk(t *testing.T) {
+	// The chunks follow a header with a count and a length field
+	l := &packetLayout{grow: true}
+	l.addBlock(blockDef{layer: "layer7", fields: []Field{
+		{Name: "count", Offset: 0, Size: 1, Type: "uint8"},
+		{Name: "total", Offset: 1, Size: 2, Type: "uint16_be"},
+	}}, nil)
+	data := []Field{{Name: "data", Size: 8, Type: "bytes", Value: "<<VPN_DATA>>"}}
+
+	tests := []struct {
+		spec Chunk
+		want string
+	}{
+		{Chunk{Fields: data, Repeat: &RepeatConfig{SplitPayload: 8, CountFrom: "count"}}, ""},
+		{Chunk{Fields: data, Repeat: &RepeatConfig{SplitPayload: 8, LengthFrom: "total"}}, ""},
+		{Chunk{Fields: data, Repeat: &RepeatConfig{Count: 2.0}}, ""},
+		{Chunk{Fields: data, Repeat: &RepeatConfig{SplitPayload: 8, Count: 2.0}}, "count_from or length_from"},
+		{Chunk{Fields: data, Repeat: &RepeatConfig{SplitPayload: 9, CountFrom: "count"}}, "doesn't fit"},
+		{Chunk{Fields: data, Repeat: &RepeatConfig{SplitPayload: -1, CountFrom: "count"}}, "positive"},
+		{Chunk{Repeat: &RepeatConfig{SplitPayload: 8, CountFrom: "count"}}, "<<VPN_DATA>>"},
+		{Chunk{Fields: data, Repeat: &RepeatConfig{}}, "needs count"},
+		{Chunk{Fields: data, Repeat: &RepeatConfig{CountFrom: "nosuch"}}, "names no earlier field"},
+		{Chunk{TLV: &TLVConfig{}, Repeat: &RepeatConfig{SplitPayload: 8, LengthFrom: "total"}}, ""},
+		{Chunk{TLV: &TLVConfig{}, Repeat: &RepeatConfig{SplitPayload: 8, Count: 1.0}}, "count_from or length_from"},
+		{Chunk{TLV: &TLVConfig{TypeSize: 3}, Repeat: &RepeatConfig{Count: 1.0}}, "type_size"},
+		{Chunk{TLV: &TLVConfig{}}, "needs a repeat"},
+	}
+	for i, tt := range tests {
+		err := checkChunk(l, &tt.spec)
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("chunk %d: error %v, want %q", i, err, tt.want)
+		}
+	}
+}
+
+func TestConditionalChunk(t *testing.T) {
+	proto := testLayerStack(t, `{"layer7": {"header_size": 1, "fields": [
+	  {"name": "flags", "offset": 0, "size": 1, "type": "uint8", "value": "${flags}"}],
+	  "chunks": [
+	   {"name": "ext", "condition": "${flags & 1}", "fields": [{"name": "x", "offset": 0, "size": 2, "type": "uint16_be", "value": 48879}]},
+	   {"name": "more", "condition": "${flags & 2}", "fields": [{"name": "y", "offset": 0, "size": 1, "type": "uint8", "value": 7}]}]}}`)
+
+	tests := []struct {
+		flags int64
+		want  string
+	}{
+		{0, "00"},
+		{1, "01" + "beef"},
+		{2, "02" + "07"},
+		{3, "03" + "beef" + "07"},
+	}
+	for _, tt := range tests {
+		frame, _ := layoutRoundTrip(t, proto, map[string]interface{}{"flags": tt.flags}, []byte("p"))
+		if want := mustHex(t, tt.want+"70"); !bytes.Equal(frame, want) {
+			t.Errorf("flags %d: frame %x, want %x", tt.flags, frame, want)
+		}
+		checkTruncated(t, proto, frame, len(frame)-1)
+	}
+}
+
+func TestRepeatedChunks(t *testing.T) {
+	tests := []struct {
+		name, stack string
+		want        string
+		headers     int // bytes before the payload
+	}{
+		{
+			"count_from",
+			`{"layer7": {"header_size": 1, "fields": [{"name": "n", "offset": 0, "size": 1, "type": "uint8"}],
+			  "chunks": [{"name": "item", "repeat": {"items": [{"v": 1}, {"v": 2}, {"v": 3}], "count_from": "n"},
+			   "fields": [{"name": "v", "offset": 0, "size": 1, "type": "uint8"}]}]}}`,
+			"03" + "010203", 4,
+		},
+		{
+			"length_from",
+			`{"layer7": {"header_size": 1, "fields": [{"name": "len", "offset": 0, "size": 1, "type": "uint8"}],
+			  "chunks": [{"name": "item", "repeat": {"items": [{"v": "ab"}, {"v": "c"}], "length_from": "len"},
+			   "fields": [{"name": "l", "offset": 0, "size": 1, "type": "uint8", "length": {"of": ["field:v"]}},
+			    {"name": "v", "follow": true, "type": "string", "size_from": "l"}]}]}}`,
+			"05" + "026162" + "0163", 6,
+		},
+		{
+			// A length field of its own, covering the header too
+			"length field",
+			`{"layer7": {"header_size": 2, "fields": [{"name": "hlen", "offset": 0, "size": 1, "type": "uint8", "length": {"of": ["layer"], "unit": 2}}],
+			  "chunks": [{"name": "item", "repeat": {"items": [{"v": 9}, {"v": 8}], "length_from": "hlen"},
+			   "fields": [{"name": "v", "offset": 0, "size": 2, "type": "uint16_be"}]}]}}`,
+			"0300" + "0009" + "0008", 6,
+		},
+		{
+			"count",
+			`{"layer7": {"chunks": [{"name": "pad", "repeat": {"count": 3, "each": {"v": 170}},
+			   "fields": [{"name": "v", "offset": 0, "size": 1, "type": "uint8"}]}]}}`,
+			"aaaaaa", 3,
+		},
+		{
+			"no items",
+			`{"layer7": {"header_size": 1, "fields": [{"name": "n", "offset": 0, "size": 1, "type": "uint8"}],
+			  "chunks": [{"name": "item", "repeat": {"count_from": "n"},
+			   "fields": [{"name": "v", "offset": 0, "size": 1, "type": "uint8"}]}]}}`,
+			"00", 1,
+		},
+	}
+	for _, tt := range tests {
+		proto := testLayerStack(t, tt.stack)
+		frame, _ := layoutRoundTrip(t, proto, nil, []byte("p"))
+		if want := mustHex(t, tt.want+"70"); !bytes.Equal(frame, want) {
+			t.Errorf("%s: frame %x, want %x", tt.name, frame, want)
+		}
+		checkTruncated(t, proto, frame, tt.headers)
+	}
+}
+
+func TestTLVChunk(t *testing.T) {
+	// TCP options: MSS, NOP, window scale; the option length counts the
+	// type and length
+	proto := testLayerStack(t, `{"layer4": {"header_size": 1, "fields": [
+	  {"name": "opts_len", "offset": 0, "size": 1, "type": "uint8", "length": {"of": ["chunk:opts"]}}],
+	  "chunks": [{"name": "opts", "tlv": {"length_includes_header": true, "no_length": [1]},
+	   "repeat": {"items": [{"type": 2, "value": 1460, "size": 2}, {"type": 1}, {"type": 3, "value": 7}, {"type": 8, "value": "${stamp}"}], "length_from": "opts_len"}}]}}`)
+
+	frame, decoded := layoutRoundTrip(t, proto, map[string]interface{}{"stamp": []byte("ts")}, []byte("p"))
+	want := mustHex(t, "0c"+"020405b4"+"01"+"030307"+"08047473"+"70")
+	if !bytes.Equal(frame, want) {
+		t.Errorf("frame %x, want %x", frame, want)
+	}
+	var types []int64
+	for _, f := range decoded.fields {
+		if f.name == "type" {
+			types = append(types, f.value.(int64))
+		}
+	}
+	if !slices.Equal(types, []int64{2, 1, 3, 8}) {
+		t.Errorf("options decode as types %v", types)
+	}
+	checkTruncated(t, proto, frame, len(frame)-1)
+
+	// Items can't run past the length that holds them
+	bad := bytes.Clone(frame)
+	bad[0] = 3
+	if _, ok := (&TunnelNode{}).decodeLayerStack(proto.LayerStack, bad, &exprEnv{}); ok {
+		t.Errorf("%x decodes", bad)
+	}
+}
+
+func TestSplitPayload(t *testing.T) {
+	stacks := []struct {
+		name, stack string
+		max         int
+	}{
+		{
+			// DNS TXT strings in one record
+			"txt",
+			`{"layer7": {"header_size": 2, "fields": [{"name": "rdlength", "offset": 0, "size": 2, "type": "uint16_be", "length": {"of": ["chunk:txt"]}}],
+			  "chunks": [{"name": "txt", "repeat": {"split_payload": 255, "length_from": "rdlength"},
+			   "fields": [{"name": "len", "offset": 0, "size": 1, "type": "uint8", "length": {"of": ["field:data"]}},
+			    {"name": "data", "follow": true, "type": "bytes", "size_from": "len", "value": "<<VPN_DATA>>"}]}]}}`,
+			255,
+		},
+		{
+			"tlv",
+			`{"layer7": {"header_size": 2, "fields": [{"name": "ext_len", "offset": 0, "size": 2, "type": "uint16_be", "length": {"of": ["chunk:ext"]}}],
+			  "chunks": [{"name": "ext", "tlv": {"type_size": 2, "length_size": 2},
+			   "repeat": {"split_payload": 200, "each": {"type": 65280}, "length_from": "ext_len"}}]}}`,
+			200,
+		},
+		{
+			// One query name per slice, counted like QDCOUNT
+			"qname",
+			`{"layer7": {"header_size": 2, "fields": [{"name": "qdcount", "offset": 0, "size": 2, "type": "uint16_be"}],
+			  "chunks": [{"name": "question", "repeat": {"split_payload": 150, "count_from": "qdcount"},
+			   "fields": [{"name": "qname", "offset": 0, "type": "dns_labels", "value": "<<VPN_DATA>>"},
+			    {"name": "qtype", "follow": true, "size": 2, "type": "uint16_be", "value": 16}]}]}}`,
+			150,
+		},
+	}
+	for _, st := range stacks {
+		proto := testLayerStack(t, st.stack)
+		for _, size := range []int{0, 1, st.max, st.max + 1, 600} {
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			frame, decoded := layoutRoundTrip(t, proto, nil, data)
+
+			instances := 0
+			for _, f := range decoded.fields {
+				if f.name == "len" || f.name == "type" || f.name == "qtype" {
+					instances++
+				}
+			}
+			if want := max((size+st.max-1)/st.max, 1); instances != want {
+				t.Errorf("%s: %d bytes in %d instances, want %d", st.name, size, instances, want)
+			}
+			checkTruncated(t, proto, frame, len(frame))
+		}
+	}
+
+	// The TXT strings take at most 255 bytes each
+	frame, _ := layoutRoundTrip(t, testLayerStack(t, stacks[0].stack), nil, bytes.Repeat([]byte("x"), 256))
+	if want := mustHex(t, "0102"+"ff"); !bytes.Equal(frame[:3], want) || frame[258] != 1 || len(frame) != 260 {
+		t.Errorf("256 bytes split as %x", frame)
+	}
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
 type Config struct {
 	ProtocolEngine ProtocolEngine `json:"protocol_engine"`
 	Protocols      []Protocol     `json:"protocols"`
@@ -7,14 +13,69 @@ type Config struct {
 }
 
 type TunnelConfig struct {
-	Mode              string `json:"mode"`               // "client" or "server"
-	ListenPort        string `json:"listen_port"`        // Port to listen on
-	ServerAddress     string `json:"server_address"`     // Target server for client mode
-	VPNServerAddress  string `json:"vpn_server_address"` // VPN server for server mode
-	BufferSize        int    `json:"buffer_size"`        // Buffer size for data transfer
-	KeepAliveInterval int    `json:"keepalive_interval"` // Keep alive interval in seconds
-	ProtocolRotation  string `json:"protocol_rotation"`  // "random", "round_robin", "time_based"
-	RotationInterval  int    `json:"rotation_interval"`  // Rotation interval in seconds for time_based
+	Mode              string           `json:"mode"`                // "client" or "server"
+	ListenPort        string           `json:"listen_port"`         // Port to listen on
+	ServerAddress     string           `json:"server_address"`      // Target server for client mode
+	VPNServerAddress  string           `json:"vpn_server_address"`  // VPN server for server mode
+	BufferSize        int              `json:"buffer_size"`         // Buffer size for data transfer
+	KeepAliveInterval int              `json:"keepalive_interval"`  // Keep alive interval in seconds
+	ProtocolRotation  string           `json:"protocol_rotation"`   // "random", "round_robin", "time_based"
+	RotationInterval  int              `json:"rotation_interval"`   // Rotation interval in seconds for time_based
+	SessionTTL        int              `json:"session_ttl"`         // Close sessions idle for this many seconds, 0 to disable
+	MaxSessions       int              `json:"max_sessions"`        // Refuse connections beyond this many sessions, 0 for no limit
+	VPNNetwork        string           `json:"vpn_network"`         // "tcp" (the default) or "udp" for datagram VPNs
+	UDPIdleTimeout    int              `json:"udp_idle_timeout"`    // Drop UDP peers silent for this many seconds, 120 by default
+	UDPPayloadSize    int              `json:"udp_payload_size"`    // Most payload bytes per datagram, 1200 by default
+	TLS               *TLSConfig       `json:"tls,omitempty"`       // Run TCP protocols over TLS
+	WebSocket         *WebSocketConfig `json:"websocket,omitempty"` // Run TCP protocols over WebSocket
+	Polling           *PollingConfig   `json:"polling,omitempty"`   // Run TCP protocols over HTTP request/response polling
+}
+
+// PollingConfig carries the frames of TCP protocols in short HTTP POSTs and
+// their responses, over TLS too if it is configured, for proxies that allow
+// nothing but plain requests. A session ID in a cookie ties a session's
+// requests together, whatever connections they come over.
+type PollingConfig struct {
+	Path            string            `json:"path"`             // Request path, "/" by default
+	Host            string            `json:"host"`             // Host header, by default the TLS server_name or -server
+	Cookie          string            `json:"cookie"`           // Name of the session token cookie, "sid" by default
+	Headers         map[string]string `json:"headers"`          // Added to the client's requests
+	ResponseHeaders map[string]string `json:"response_headers"` // Added to the server's responses
+	MinInterval     int               `json:"min_interval_ms"`  // Poll interval while data flows, 50 by default
+	MaxInterval     int               `json:"max_interval_ms"`  // Poll interval the idle interval doubles up to, 2000 by default
+	MaxBody         int               `json:"max_body"`         // Most frame bytes per request or response, 65536 by default
+	IdleTimeout     int               `json:"idle_timeout"`     // Seconds a session lasts without an answered request, 60 by default
+}
+
+// WebSocketConfig carries the frames of TCP protocols in WebSocket messages,
+// over TLS too if it is configured, so they pass reverse proxies and CDNs
+// that forward WebSockets.
+type WebSocketConfig struct {
+	Path            string            `json:"path"`             // Request path, "/" by default
+	Host            string            `json:"host"`             // Host header, by default the TLS server_name or -server
+	Headers         map[string]string `json:"headers"`          // Added to the client's upgrade request, e.g. Origin or User-Agent
+	ResponseHeaders map[string]string `json:"response_headers"` // Added to the server's 101 response
+	PingInterval    int               `json:"ping_interval"`    // Seconds between pings, 30 by default
+}
+
+// TLSConfig puts a TLS connection under the frames of TCP protocols. Client
+// and server can share it: each side reads the settings of its role.
+type TLSConfig struct {
+	ServerName string   `json:"server_name"` // SNI, by default the host of -server
+	ALPN       []string `json:"alpn"`        // Offered by the client and accepted by the server, e.g. ["h2", "http/1.1"]
+	// PinSHA256 lists the base64 SHA-256 hashes of server public keys
+	// (SubjectPublicKeyInfo) the client accepts. Without a CAFile, a pinned
+	// key is trusted without checking its certificate chain, so self-signed
+	// servers can be pinned.
+	PinSHA256 []string `json:"pin_sha256"`
+	CAFile    string   `json:"ca_file"` // CAs the client verifies the server with, system roots if empty
+
+	CertFile     string `json:"cert_file"`      // Server certificate, self-signed at startup if empty
+	KeyFile      string `json:"key_file"`       // Server private key
+	ClientCAFile string `json:"client_ca_file"` // Require client certificates signed by these CAs
+
+	ClientCertFile string `json:"client_cert_file"` // Client certificate for mutual TLS
+	ClientKeyFile  string `json:"client_key_file"`  // Client private key
 }
 
 type ProtocolEngine struct {
@@ -22,14 +83,30 @@ type ProtocolEngine struct {
 }
 
 type Protocol struct {
-	Identifier     string          `json:"identifier"`
-	Transport      string          `json:"transport"`
-	Ports          []string        `json:"ports"`
-	LayerStack     *LayerStack     `json:"layer_stack,omitempty"`
-	FrameStructure FrameStructure  `json:"frame_structure"`
-	StateMachine   StateMachine    `json:"state_machine"`
-	FPESample      string          `json:"FPE_Sample,omitempty"`
-	TimingAnalysis *TimingAnalysis `json:"timing_analysis,omitempty"`
+	Identifier     string             `json:"identifier"`
+	Transport      string             `json:"transport"`               // "tcp" (the default) or "udp"
+	SessionField   string             `json:"session_field,omitempty"` // UDP: the field carrying ${SESSION_ID}
+	Reliability    *ReliabilityConfig `json:"reliability,omitempty"`
+	HTTP2          *HTTP2Config       `json:"http2,omitempty"` // Carry the payload in HTTP/2 DATA frames
+	Ports          []string           `json:"ports"`
+	LayerStack     *LayerStack        `json:"layer_stack,omitempty"`
+	FrameStructure FrameStructure     `json:"frame_structure"`
+	StateMachine   StateMachine       `json:"state_machine"`
+	FPESample      string             `json:"FPE_Sample,omitempty"`
+	TimingAnalysis *TimingAnalysis    `json:"timing_analysis,omitempty"`
+}
+
+// ReliabilityConfig carries a reliable byte stream over a UDP protocol: the
+// fields that number data frames, acknowledge them and map frames received
+// out of order, the most frames in flight, and the bounds of the
+// retransmission timeout.
+type ReliabilityConfig struct {
+	SeqField  string `json:"seq_field"`
+	AckField  string `json:"ack_field"`
+	SackField string `json:"sack_field,omitempty"`
+	Window    int    `json:"window,omitempty"`     // frames, 256 by default
+	MinRTO    int    `json:"min_rto_ms,omitempty"` // 200 by default
+	MaxRTO    int    `json:"max_rto_ms,omitempty"` // 60000 by default
 }
 
 type LayerStack struct {
@@ -42,6 +119,30 @@ type LayerStack struct {
 	Layer7         *LayerDefinition `json:"layer7,omitempty"`
 }
 
+type namedLayer struct {
+	name string
+	def  *LayerDefinition
+}
+
+// layers returns the defined layers from the bottom of the stack up.
+func (s *LayerStack) layers() []namedLayer {
+	var layers []namedLayer
+	for _, l := range []namedLayer{
+		{"layer2", s.Layer2Ethernet},
+		{"layer3", s.Layer3IPv4},
+		{"layer3", s.Layer3IPv6},
+		{"layer4", s.Layer4},
+		{"layer5", s.Layer5},
+		{"layer6", s.Layer6},
+		{"layer7", s.Layer7},
+	} {
+		if l.def != nil {
+			layers = append(layers, l)
+		}
+	}
+	return layers
+}
+
 type LayerDefinition struct {
 	HeaderSize int     `json:"header_size"`
 	Fields     []Field `json:"fields"`
@@ -54,46 +155,134 @@ type TimingAnalysis struct {
 	TimingVariancePercent       int   `json:"timing_variance_percent,omitempty"`
 }
 
+// HTTP2Config makes a TCP protocol an HTTP/2 connection: the client sends
+// the connection preface, SETTINGS and a HEADERS frame opening a request
+// stream, the server answers with its SETTINGS and a 200 response, and the
+// payload travels in DATA frames within both sides' flow control windows.
+// Header values and the path can hold expressions. Setting names are those
+// of RFC 9113 6.5.2 without the SETTINGS_ prefix, e.g. INITIAL_WINDOW_SIZE.
+type HTTP2Config struct {
+	Method          string            `json:"method"`           // "POST" by default
+	Path            string            `json:"path"`             // "/" by default
+	Authority       string            `json:"authority"`        // By default the TLS server_name or -server
+	Scheme          string            `json:"scheme"`           // "https" by default
+	Headers         map[string]string `json:"headers"`          // Request headers, e.g. content-type
+	ResponseHeaders map[string]string `json:"response_headers"` // Sent with :status 200
+	Settings        map[string]uint32 `json:"settings"`         // Client SETTINGS, Chrome's by default
+	ServerSettings  map[string]uint32 `json:"server_settings"`  // Server SETTINGS, nginx's by default
+	WindowUpdate    uint32            `json:"window_update"`    // Client connection window increment, 15663105 by default
+}
+
 type FrameStructure struct {
-	HeaderSize               int         `json:"header_size,omitempty"`
-	Fields                   []Field     `json:"fields,omitempty"`
-	Chunks                   []Chunk     `json:"chunks,omitempty"`
-	HeaderFormat, LineEnding string      `json:"header_format,line_ending,omitempty"`
-	RequestFormat            interface{} `json:"request_format,omitempty"`
-	ResponseFormat           interface{} `json:"response_format,omitempty"`
+	HeaderSize     int         `json:"header_size,omitempty"`
+	Fields         []Field     `json:"fields,omitempty"`
+	Chunks         []Chunk     `json:"chunks,omitempty"`
+	HeaderFormat   string      `json:"header_format,omitempty"`
+	LineEnding     string      `json:"line_ending,omitempty"`
+	RequestFormat  interface{} `json:"request_format,omitempty"`
+	ResponseFormat interface{} `json:"response_format,omitempty"`
 }
 
+// Chunk is a part of a layer after its header. Condition, a template, leaves
+// the chunk out when it is false; it sees the values of the fields before the
+// chunk by name. Repeat repeats the chunk, and TLV makes each repetition a
+// type-length-value item instead of Fields.
 type Chunk struct {
-	Name   string  `json:"name"`
-	Fields []Field `json:"fields"`
+	Name      string        `json:"name"`
+	Fields    []Field       `json:"fields"`
+	Condition string        `json:"condition,omitempty"`
+	Repeat    *RepeatConfig `json:"repeat,omitempty"`
+	TLV       *TLVConfig    `json:"tlv,omitempty"`
+}
+
+// RepeatConfig says how often a chunk repeats. The sender builds one
+// instance per item, each item giving field values by name (or "type" and
+// "value" for TLV), or Count instances without items. The receiver reads
+// the number of instances from CountFrom, or instances up to the number of
+// bytes in LengthFrom, or Count. The sender fills CountFrom, and LengthFrom
+// unless it is a length field of its own.
+//
+// With SplitPayload the instances carry the payload instead: one per slice
+// of at most SplitPayload bytes, in the chunk's "<<VPN_DATA>>" field (the
+// value of a TLV item), and at least one. Each gives the other field values
+// of every instance. Their number varies with the payload, so the receiver
+// needs CountFrom or LengthFrom. It joins the slices in order.
+type RepeatConfig struct {
+	Items        []map[string]interface{} `json:"items,omitempty"`
+	Count        interface{}              `json:"count,omitempty"`
+	CountFrom    string                   `json:"count_from,omitempty"`
+	LengthFrom   string                   `json:"length_from,omitempty"`
+	SplitPayload int                      `json:"split_payload,omitempty"`
+	Each         map[string]interface{}   `json:"each,omitempty"`
+}
+
+// TLVConfig lays out the instances of a chunk as type, length and value.
+// Types in NoLength, such as TCP's NOP or DHCP's pad, are a lone type.
+type TLVConfig struct {
+	TypeSize             int           `json:"type_size,omitempty"`   // bytes, 1 by default
+	LengthSize           int           `json:"length_size,omitempty"` // bytes, 1 by default
+	LengthIncludesHeader bool          `json:"length_includes_header,omitempty"`
+	NoLength             []interface{} `json:"no_length,omitempty"`
 }
 
+// Field is placed at Offset with Size bytes, or right after the previous
+// field with Follow. SizeFrom takes the size from an earlier field: its value,
+// or the content of this one when that field is a length. "content" sizes a
+// field by its value alone; the decoder then looks for Terminator, or takes
+// the rest of the frame. Align rounds the start and PadTo the end up to a
+// multiple, relative to the layer or chunk.
 type Field struct {
-	Name         string              `json:"name"`
-	Offset, Size int                 `json:"offset,size"`
-	Type         string              `json:"type"`
-	Value        interface{}         `json:"value"`
-	Bits         map[string]BitField `json:"bits,omitempty"`
-	Computation  *ComputationConfig  `json:"computation,omitempty"`
-	Sequence     *SequenceConfig     `json:"sequence,omitempty"`
-	Randomize    bool                `json:"randomize,omitempty"`
-	RangeValues  interface{}         `json:"range,omitempty"`
+	Name        string              `json:"name"`
+	Offset      int                 `json:"offset"`
+	Size        int                 `json:"size"`
+	Follow      bool                `json:"follow,omitempty"`
+	Align       int                 `json:"align,omitempty"`
+	PadTo       int                 `json:"pad_to,omitempty"`
+	SizeFrom    string              `json:"size_from,omitempty"`
+	Terminator  string              `json:"terminator,omitempty"`
+	Type        string              `json:"type"`
+	Value       interface{}         `json:"value"`
+	Bits        map[string]BitField `json:"bits,omitempty"`
+	BitOrder    string              `json:"bit_order,omitempty"`
+	Computation *ComputationConfig  `json:"computation,omitempty"`
+	Length      *LengthConfig       `json:"length,omitempty"`
+	Sequence    *SequenceConfig     `json:"sequence,omitempty"`
+	Randomize   bool                `json:"randomize,omitempty"`
+	RangeValues interface{}         `json:"range,omitempty"`
 }
 
+// SequenceConfig makes a field a counter; see sequence.go for the algorithms.
 type SequenceConfig struct {
-	Start, Increment interface{} `json:"start,increment,omitempty"`
-	Algorithm        string      `json:"algorithm,omitempty"`
+	Start     interface{} `json:"start,omitempty"`
+	Increment interface{} `json:"increment,omitempty"`
+	Algorithm string      `json:"algorithm,omitempty"`
+	Unit      string      `json:"unit,omitempty"`
 }
 
+// BitField is a range of bits in a bitfield, numbered as the field's
+// BitOrder says: "lsb" (the default) counts from the least significant bit
+// of the first byte, "msb" from the most significant one as in RFC diagrams.
+// Ranges may cross byte boundaries.
 type BitField struct {
-	Position, Size int         `json:"position,size"`
-	Value          interface{} `json:"value"`
+	Position int         `json:"position"`
+	Size     int         `json:"size"`
+	Value    interface{} `json:"value"`
+}
+
+// LengthConfig makes a field hold the size of parts of the frame. Of lists
+// scopes such as "layer", "following" or "layer4..end"; the sum is divided
+// by Unit (rounding up) and Adjust is added.
+type LengthConfig struct {
+	Of     []string `json:"of"`
+	Unit   int      `json:"unit,omitempty"`
+	Adjust int      `json:"adjust,omitempty"`
 }
 
 type ComputationConfig struct {
 	Algorithm    string                 `json:"algorithm"`
 	Scope        string                 `json:"scope"`
 	PseudoHeader map[string]interface{} `json:"pseudo_header,omitempty"`
+	Key          string                 `json:"key,omitempty"`
 }
 
 type StateMachine struct {
@@ -115,7 +304,9 @@ type State struct {
 }
 
 type DataHandler struct {
-	Pattern, Action, Priority string `json:"pattern,action,priority,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Priority string `json:"priority,omitempty"`
 }
 
 type Transition struct {
@@ -124,12 +315,14 @@ type Transition struct {
 }
 
 type Trigger struct {
-	Type       string     `json:"type"`
-	Conditions Conditions `json:"conditions"`
+	Type       string     `json:"type"`               // "data", "timeout", "interval" or "idle"
+	Conditions Conditions `json:"conditions"`         // data triggers only
+	Duration   string     `json:"duration,omitempty"` // timer triggers, e.g. "30s"
 }
 
 type Conditions struct {
-	DataPattern, MatchType string `json:"data_pattern,match_type,omitempty"`
+	DataPattern string `json:"data_pattern,omitempty"`
+	MatchType   string `json:"match_type,omitempty"`
 }
 
 type TransitionAction struct {
@@ -137,6 +330,7 @@ type TransitionAction struct {
 	NextState         string                 `json:"next_state"`
 	DelayMicroseconds int                    `json:"delay_microseconds,omitempty"`
 	VariableUpdates   map[string]interface{} `json:"variable_updates,omitempty"`
+	Close             bool                   `json:"close,omitempty"`
 }
 
 // ConnectionInfo replaces PeerInfo
@@ -149,3 +343,20 @@ type ConnectionInfo struct {
 	BytesReceived uint64 `json:"bytes_received"`
 	IsActive      bool   `json:"is_active"`
 }
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pattern: %v", err)
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	if len(config.Protocols) == 0 {
+		return nil, fmt.Errorf("no protocols found in config")
+	}
+	return config, nil
+}
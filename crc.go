@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// crcModel is a CRC in the Rocksoft model. poly is written MSB-first, as in
+// the catalogues; refIn and refOut select reflected input bytes and output.
+type crcModel struct {
+	name   string
+	width  int
+	poly   uint64
+	init   uint64
+	refIn  bool
+	refOut bool
+	xorOut uint64
+	check  uint64 // CRC of "123456789"
+}
+
+// crcCatalogue lists the named CRCs, keyed by algorithmKey(name). The
+// parameters and check values are those of the reveng CRC catalogue.
+var crcCatalogue = map[string]crcModel{}
+
+func init() {
+	for _, m := range []crcModel{
+		{"CRC-8/SMBUS", 8, 0x07, 0x00, false, false, 0x00, 0xF4},
+		{"CRC-8/MAXIM-DOW", 8, 0x31, 0x00, true, true, 0x00, 0xA1},
+		{"CRC-8/AUTOSAR", 8, 0x2F, 0xFF, false, false, 0xFF, 0xDF},
+		{"CRC-16/ARC", 16, 0x8005, 0x0000, true, true, 0x0000, 0xBB3D},
+		{"CRC-16/CCITT-FALSE", 16, 0x1021, 0xFFFF, false, false, 0x0000, 0x29B1},
+		{"CRC-16/XMODEM", 16, 0x1021, 0x0000, false, false, 0x0000, 0x31C3},
+		{"CRC-16/KERMIT", 16, 0x1021, 0x0000, true, true, 0x0000, 0x2189},
+		{"CRC-16/MODBUS", 16, 0x8005, 0xFFFF, true, true, 0x0000, 0x4B37},
+		{"CRC-16/X-25", 16, 0x1021, 0xFFFF, true, true, 0xFFFF, 0x906E},
+		{"CRC-16/USB", 16, 0x8005, 0xFFFF, true, true, 0xFFFF, 0xB4C8},
+		{"CRC-16/DNP", 16, 0x3D65, 0x0000, true, true, 0xFFFF, 0xEA82},
+		{"CRC-24/OPENPGP", 24, 0x864CFB, 0xB704CE, false, false, 0x000000, 0x21CF02},
+		{"CRC-32/ISO-HDLC", 32, 0x04C11DB7, 0xFFFFFFFF, true, true, 0xFFFFFFFF, 0xCBF43926},
+		{"CRC-32C", 32, 0x1EDC6F41, 0xFFFFFFFF, true, true, 0xFFFFFFFF, 0xE3069283},
+		{"CRC-32/BZIP2", 32, 0x04C11DB7, 0xFFFFFFFF, false, false, 0xFFFFFFFF, 0xFC891918},
+		{"CRC-32/MPEG-2", 32, 0x04C11DB7, 0xFFFFFFFF, false, false, 0x00000000, 0x0376E6E7},
+		{"CRC-32/CKSUM", 32, 0x04C11DB7, 0x00000000, false, false, 0xFFFFFFFF, 0x765E7680},
+		{"CRC-64/ECMA-182", 64, 0x42F0E1EBA9EA3693, 0, false, false, 0, 0x6C40DF5F0B497347},
+		{"CRC-64/XZ", 64, 0x42F0E1EBA9EA3693, ^uint64(0), true, true, ^uint64(0), 0x995DC9BBDF1939FA},
+		{"CRC-64/GO-ISO", 64, 0x1B, ^uint64(0), true, true, ^uint64(0), 0xB90956C775A41001},
+	} {
+		crcCatalogue[algorithmKey(m.name)] = m
+	}
+
+	// Short names, as accepted before the catalogue existed
+	for alias, name := range map[string]string{
+		"crc8":       "CRC-8/SMBUS",
+		"crc16":      "CRC-16/ARC",
+		"crc32":      "CRC-32/ISO-HDLC",
+		"crc64":      "CRC-64/XZ",
+		"crc16ccitt": "CRC-16/CCITT-FALSE",
+		"crc32c":     "CRC-32C",
+		"crc32iscsi": "CRC-32C",
+	} {
+		crcCatalogue[algorithmKey(alias)] = crcCatalogue[algorithmKey(name)]
+	}
+}
+
+// checksum computes the CRC bit by bit, MSB-first, which works for any width
+// up to 64.
+func (m crcModel) checksum(data []byte) uint64 {
+	top := uint64(1) << (m.width - 1)
+	mask := top<<1 - 1
+
+	crc := m.init & mask
+	for _, b := range data {
+		if m.refIn {
+			b = bits.Reverse8(b)
+		}
+		for i := 7; i >= 0; i-- {
+			feedback := crc&top != 0
+			if b>>i&1 == 1 {
+				feedback = !feedback
+			}
+			crc = crc << 1 & mask
+			if feedback {
+				crc ^= m.poly
+			}
+		}
+	}
+
+	if m.refOut {
+		crc = bits.Reverse64(crc) >> (64 - m.width)
+	}
+	return (crc ^ m.xorOut) & mask
+}
+
+// crcModelFor looks up a named CRC and applies overrides from params:
+// "width", "polynomial", "init", "refin", "refout" and "xor_out". A name
+// that isn't in the catalogue needs a width and polynomial; the rest then
+// default to zero and false.
+func crcModelFor(algorithm string, params map[string]interface{}) (crcModel, error) {
+	m, ok := crcCatalogue[algorithmKey(algorithm)]
+	if !ok {
+		_, width := params["width"]
+		_, poly := params["polynomial"]
+		if !width || !poly {
+			return crcModel{}, fmt.Errorf("%q is not in the CRC catalogue, and has no width and polynomial", algorithm)
+		}
+		m = crcModel{name: algorithm}
+	}
+
+	number := func(key string, dst *uint64) {
+		if v, ok := params[key]; ok {
+			if n, err := strconv.ParseUint(fmt.Sprintf("%v", v), 0, 64); err == nil {
+				*dst = n
+			}
+		}
+	}
+	flag := func(key string, dst *bool) {
+		switch v := params[key].(type) {
+		case bool:
+			*dst = v
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				*dst = b
+			}
+		}
+	}
+
+	width := uint64(m.width)
+	number("width", &width)
+	if width >= 1 && width <= 64 {
+		m.width = int(width)
+	}
+	if m.width == 0 {
+		return crcModel{}, fmt.Errorf("CRC %q: width must be 1 to 64", algorithm)
+	}
+	number("polynomial", &m.poly)
+	number("init", &m.init)
+	number("xor_out", &m.xorOut)
+	flag("refin", &m.refIn)
+	flag("refout", &m.refOut)
+	return m, nil
+}
+
+// isCRC reports whether an algorithm name is a CRC.
+func isCRC(algorithm string) bool {
+	if _, ok := crcCatalogue[algorithmKey(algorithm)]; ok {
+		return true
+	}
+	return strings.HasPrefix(algorithmKey(algorithm), "CRC")
+}
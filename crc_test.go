@@ -0,0 +1,139 @@
+package main
+
+import (
+	"hash/crc32"
+	"hash/crc64"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCRCCatalogueCheckValues(t *testing.T) {
+	for key, m := range crcCatalogue {
+		if got := m.checksum([]byte("123456789")); got != m.check {
+			t.Errorf("%s (%s): check string gives %#x, want %#x", m.name, key, got, m.check)
+		}
+	}
+}
+
+func TestCRCMatchesStandardLibrary(t *testing.T) {
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+	ecma := crc64.MakeTable(crc64.ECMA)
+	iso := crc64.MakeTable(crc64.ISO)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		data := make([]byte, rng.Intn(300))
+		rng.Read(data)
+
+		tests := []struct {
+			name string
+			want uint64
+		}{
+			{"CRC-32/ISO-HDLC", uint64(crc32.ChecksumIEEE(data))},
+			{"CRC-32C", uint64(crc32.Checksum(data, castagnoli))},
+			{"CRC-64/XZ", crc64.Checksum(data, ecma)},
+			{"CRC-64/GO-ISO", crc64.Checksum(data, iso)},
+		}
+		for _, tt := range tests {
+			m, err := crcModelFor(tt.name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.checksum(data); got != tt.want {
+				t.Fatalf("%s of %x = %#x, want %#x", tt.name, data, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestCRCNames(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"crc32", "CRC-32/ISO-HDLC"},
+		{"CRC32", "CRC-32/ISO-HDLC"},
+		{"crc16", "CRC-16/ARC"},
+		{"crc16_modbus", "CRC-16/MODBUS"},
+		{"crc-16/modbus", "CRC-16/MODBUS"},
+		{"crc32iscsi", "CRC-32C"},
+		{"crc 8 maxim-dow", "CRC-8/MAXIM-DOW"},
+	}
+	for _, tt := range tests {
+		if m, err := crcModelFor(tt.name, nil); err != nil || m.name != tt.want {
+			t.Errorf("%s is %s, %v; want %s", tt.name, m.name, err, tt.want)
+		}
+	}
+
+	// Names outside the catalogue need their parameters
+	for _, name := range []string{"crc-99/unknown", "CRC-16/MODBUSS", "crc"} {
+		if m, err := crcModelFor(name, nil); err == nil {
+			t.Errorf("%s is %s", name, m.name)
+		}
+		if _, err := crcModelFor(name, map[string]interface{}{"width": 16.0}); err == nil {
+			t.Errorf("%s accepted without a polynomial", name)
+		}
+	}
+
+	if !isCRC("CRC-16/MODBUS") || !isCRC("crc12_custom") || isCRC("sha256") {
+		t.Error("isCRC misclassifies names")
+	}
+}
+
+func TestCRCParameterOverrides(t *testing.T) {
+	// CRC-16/ARC's parameters turned into CRC-16/CCITT-FALSE's
+	m, _ := crcModelFor("crc16", map[string]interface{}{
+		"polynomial": "0x1021",
+		"init":       "0xFFFF",
+		"refin":      false,
+		"refout":     "false",
+	})
+	if got := m.checksum([]byte("123456789")); got != 0x29B1 {
+		t.Errorf("overridden CRC = %#x, want 0x29b1", got)
+	}
+
+	// CRC-5/USB, which isn't in the catalogue
+	m, err := crcModelFor("crc5", map[string]interface{}{
+		"width": 5, "polynomial": "0x05", "init": "0x1f",
+		"refin": true, "refout": true, "xor_out": "0x1f",
+	})
+	if got := m.checksum([]byte("123456789")); err != nil || got != 0x19 {
+		t.Errorf("CRC-5/USB = %#x, %v; want 0x19", got, err)
+	}
+
+	// CRC-16/XMODEM, whose init and reflection are left at their defaults
+	m, err = crcModelFor("crc", map[string]interface{}{"width": 16.0, "polynomial": "0x1021"})
+	if got := m.checksum([]byte("123456789")); err != nil || got != 0x31C3 {
+		t.Errorf("CRC-16/XMODEM = %#x, %v; want 0x31c3", got, err)
+	}
+
+	// Out of range widths are ignored, unless the CRC has no other
+	if m, _ := crcModelFor("crc32", map[string]interface{}{"width": 65}); m.width != 32 {
+		t.Errorf("width 65 gives %d, want 32", m.width)
+	}
+	if _, err := crcModelFor("crc65", map[string]interface{}{"width": 65, "polynomial": 1}); err == nil {
+		t.Error("CRC of width 65 accepted")
+	}
+}
+
+func TestCheckComputationsCRCNames(t *testing.T) {
+	tests := []struct {
+		computation string
+		ok          bool
+	}{
+		{`"algorithm": "CRC-16/MODBUS"`, true},
+		{`"algorithm": "crc16_modbus"`, true},
+		{`"algorithm": "CRC-16/MODBUSS"`, false},
+		{`"algorithm": "crc"`, false},
+		{`"algorithm": "crc", "pseudo_header": {"width": 16, "polynomial": "0x1021"}`, true},
+		{`"algorithm": "crc12_custom", "pseudo_header": {"width": 12}`, false},
+	}
+	for _, tt := range tests {
+		pattern := strings.Replace(computationTestPattern, `"algorithm": "sha-256"`, tt.computation, 1)
+		err := checkComputations(reliableTestConfig(t, pattern).Protocols)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: %v", tt.computation, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"tunnel/plugin"
+)
+
+// decodedField is a field located in a received frame.
+type decodedField struct {
+	layer  string
+	name   string
+	offset int // from the start of the frame
+	raw    []byte
+	value  interface{} // nil when raw doesn't decode as the field's type
+	field  Field       // as placed
+}
+
+type decodedFrame struct {
+	fields  []decodedField
+	payload []byte
+	// mismatched lists computed fields whose value doesn't verify
+	mismatched []string
+}
+
+// decodeLayerStack splits a frame built by buildLayerStack into its fields and
+// the payload that follows the last layer. Variable-length fields, chunk
+// conditions and repetitions are placed by the same rules as when building,
+// and computed fields are checked with env resolving HMAC keys.
+func (t *TunnelNode) decodeLayerStack(stack *LayerStack, frame []byte, env *exprEnv) (*decodedFrame, bool) {
+	layout := &packetLayout{frame: frame}
+	place := func(def blockDef) bool {
+		return layout.addBlock(def, func(field Field, placed []Field) (int, bool) {
+			start := layout.end + field.Offset
+			if start > len(frame) {
+				return 0, false
+			}
+			if field.SizeFrom == "" || field.SizeFrom == "content" {
+				if codec, ok := plugin.LookupFieldCodec(field.Type); ok {
+					if m, ok := codec.(plugin.Measurer); ok {
+						return m.Measure(frame[start:])
+					}
+				}
+				if field.Terminator == "" {
+					return len(frame) - start, true
+				}
+				i := bytes.Index(frame[start:], []byte(field.Terminator))
+				if i == -1 {
+					return 0, false
+				}
+				return i + len(field.Terminator), true
+			}
+
+			ref, ok := layout.lookupField(placed, field.SizeFrom)
+			if !ok || ref.span.end > len(frame) {
+				return 0, false
+			}
+			value, ok := decodeValue(ref.field, frame[ref.span.start:ref.span.end])
+			if !ok {
+				return 0, false
+			}
+			u, ok := toUint64(value)
+			if !ok {
+				return 0, false
+			}
+			size := int64(u)
+			if cfg := ref.field.Length; cfg != nil {
+				// Undo the unit and adjustment of the length field
+				size -= int64(cfg.Adjust)
+				if cfg.Unit > 1 {
+					size *= int64(cfg.Unit)
+				}
+			}
+			return int(size), size >= 0 && size <= int64(len(frame))
+		})
+	}
+
+	for _, def := range stackBlocks(stack) {
+		spec := def.spec
+		if spec == nil || spec.Repeat == nil {
+			if spec != nil && !t.chunkPresent(spec, layout, env) {
+				continue
+			}
+			if !place(def) {
+				return nil, false
+			}
+			continue
+		}
+		if !t.chunkPresent(spec, layout, env) {
+			continue
+		}
+
+		count, stop, ok := t.repeatBounds(spec.Repeat, layout, env)
+		if !ok {
+			return nil, false
+		}
+		for i := 0; count < 0 && layout.end < stop || i < count; i++ {
+			d := def
+			d.instance = i + 1
+			if spec.TLV != nil {
+				typeSize, _ := tlvSizes(spec.TLV)
+				if layout.end+typeSize > len(frame) {
+					return nil, false
+				}
+				kind := readUint(frame[layout.end:layout.end+typeSize], binary.BigEndian)
+				d = tlvBlock(d, tlvSingle(spec.TLV, kind))
+			}
+			start := layout.end
+			if !place(d) || count < 0 && (layout.end == start || layout.end > stop) {
+				return nil, false
+			}
+		}
+	}
+
+	decoded := &decodedFrame{payload: frame[layout.end:]}
+	layout.payload = byteRange{layout.end, len(frame)}
+	carried := false
+	for i := range layout.blocks {
+		block := &layout.blocks[i]
+		for _, field := range block.fields {
+			if field.Size == 0 {
+				continue
+			}
+			start := block.span.start + field.Offset
+			if field.Value == "<<VPN_DATA>>" {
+				layout.coverPayload(layoutField{block, field}.position(), carried)
+				carried = true
+			}
+			raw := frame[start : start+field.Size]
+			value, ok := decodeValue(field, bytes.TrimSuffix(raw, []byte(field.Terminator)))
+			if !ok {
+				value = nil
+			}
+			decoded.fields = append(decoded.fields, decodedField{
+				layer:  block.name(),
+				name:   field.Name,
+				field:  field,
+				offset: start,
+				raw:    raw,
+				value:  value,
+			})
+		}
+	}
+
+	decoded.mismatched = t.verifyComputations(layout, env)
+	return decoded, true
+}
+
+// carriesPayload reports whether fields hold the VPN data itself, in one
+// field or split over the instances of a chunk. Otherwise buildLayerStack
+// appends the payload after the last layer.
+func carriesPayload(stack *LayerStack) bool {
+	for _, layer := range stack.layers() {
+		for _, field := range layer.def.Fields {
+			if field.Value == "<<VPN_DATA>>" {
+				return true
+			}
+		}
+		for _, chunk := range layer.def.Chunks {
+			if chunk.Repeat != nil && chunk.Repeat.SplitPayload > 0 {
+				return true
+			}
+			for _, field := range chunk.Fields {
+				if field.Value == "<<VPN_DATA>>" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,1113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expressions appear inside ${...} in field values and request_format strings.
+// They are compiled once when the pattern is loaded and evaluated per packet.
+// Values are int64, string or []byte; evaluation has no side effects apart
+// from drawing random numbers.
+
+const (
+	maxExprDepth  = 64
+	maxExprLength = 4096
+	maxExprBytes  = 65536
+)
+
+type exprEnv struct {
+	connID    string
+	sessionID int64
+	data      []byte
+	seq       int64
+	vars      map[string]interface{}
+	// src and dst are the connection's addresses as the sender sees them
+	src, dst net.Addr
+}
+
+func (e *exprEnv) lookup(name string) (interface{}, error) {
+	switch name {
+	case "CONN_ID":
+		return e.connID, nil
+	case "SESSION_ID":
+		return e.sessionID, nil
+	case "TIMESTAMP":
+		return time.Now().Unix(), nil
+	case "DATA_SIZE", "DATA_LENGTH":
+		return int64(len(e.data)), nil
+	case "payload":
+		return e.data, nil
+	case "seq":
+		return e.seq, nil
+	case "SRC_IP":
+		return addrIP(e.src).String(), nil
+	case "DST_IP":
+		return addrIP(e.dst).String(), nil
+	case "SRC_PORT":
+		return int64(addrPort(e.src)), nil
+	case "DST_PORT":
+		return int64(addrPort(e.dst)), nil
+	}
+	if v, ok := e.vars[name]; ok {
+		return normalizeExprValue(v)
+	}
+	return nil, fmt.Errorf("unknown identifier %q", name)
+}
+
+func normalizeExprValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case int64, string, []byte:
+		return x, nil
+	case int:
+		return int64(x), nil
+	case uint8:
+		return int64(x), nil
+	case uint16:
+		return int64(x), nil
+	case uint32:
+		return int64(x), nil
+	case uint64:
+		return int64(x), nil
+	case float64:
+		return int64(x), nil
+	case bool:
+		if x {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+// Templates
+
+type templatePart struct {
+	literal string
+	expr    exprNode
+	source  string
+}
+
+type template struct {
+	parts []templatePart
+}
+
+func compileTemplate(s string) (*template, error) {
+	tpl := &template{}
+	rest := s
+	for {
+		idx := strings.Index(rest, "${")
+		if idx == -1 {
+			if rest != "" {
+				tpl.parts = append(tpl.parts, templatePart{literal: rest})
+			}
+			return tpl, nil
+		}
+		if idx > 0 {
+			tpl.parts = append(tpl.parts, templatePart{literal: rest[:idx]})
+		}
+		end := findExprEnd(rest[idx+2:])
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated ${ in %q", s)
+		}
+		source := rest[idx+2 : idx+2+end]
+		node, err := parseExpr(source)
+		if err != nil {
+			return nil, fmt.Errorf("${%s}: %v", source, err)
+		}
+		tpl.parts = append(tpl.parts, templatePart{expr: node, source: source})
+		rest = rest[idx+2+end+1:]
+	}
+}
+
+// findExprEnd returns the index of the closing brace, skipping string literals.
+func findExprEnd(s string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+// value evaluates the template. A template consisting of a single expression
+// keeps the expression's type so that numeric fields can be computed.
+func (tpl *template) value(env *exprEnv) (interface{}, error) {
+	if len(tpl.parts) == 1 && tpl.parts[0].expr != nil {
+		return tpl.parts[0].expr.eval(env, 0)
+	}
+	return tpl.render(env)
+}
+
+func (tpl *template) render(env *exprEnv) (string, error) {
+	var sb strings.Builder
+	for _, p := range tpl.parts {
+		if p.expr == nil {
+			sb.WriteString(p.literal)
+			continue
+		}
+		v, err := p.expr.eval(env, 0)
+		if err != nil {
+			return "", fmt.Errorf("${%s}: %v", p.source, err)
+		}
+		sb.WriteString(exprString(v))
+	}
+	return sb.String(), nil
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  int64
+}
+
+func tokenize(src string) ([]token, error) {
+	if len(src) > maxExprLength {
+		return nil, fmt.Errorf("expression too long")
+	}
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (isIdentChar(src[j])) {
+				j++
+			}
+			n, err := strconv.ParseInt(src[i:j], 0, 64)
+			if err != nil {
+				u, uerr := strconv.ParseUint(src[i:j], 0, 64)
+				if uerr != nil {
+					return nil, fmt.Errorf("invalid number %q", src[i:j])
+				}
+				n = int64(u)
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:j], num: n})
+			i = j
+		case isIdentStart(c):
+			j := i
+			for j < len(src) && isIdentChar(src[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:j]})
+			i = j
+		case c == '"' || c == '\'':
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, text: s})
+			i += n
+		default:
+			op := ""
+			for _, candidate := range []string{"<<", ">>", "==", "!=", "<=", ">=", "&&", "||"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("+-*/%&|^~!<>(),", rune(c)) {
+					return nil, fmt.Errorf("unexpected character %q", c)
+				}
+				op = string(c)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func lexString(src string) (string, int, error) {
+	quote := src[0]
+	var sb strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		if c == quote {
+			return sb.String(), i + 1, nil
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(src) {
+			break
+		}
+		switch src[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case '0':
+			sb.WriteByte(0)
+		case 'x':
+			if i+2 >= len(src) {
+				return "", 0, fmt.Errorf("invalid \\x escape")
+			}
+			b, err := strconv.ParseUint(src[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid \\x escape")
+			}
+			sb.WriteByte(byte(b))
+			i += 2
+		default:
+			sb.WriteByte(src[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string literal")
+}
+
+// Parser
+
+type exprNode interface {
+	eval(env *exprEnv, depth int) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+type identNode struct{ name string }
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+type callNode struct {
+	name string
+	fn   exprFunc
+	args []exprNode
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// Binary operator precedence, following Go.
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4, "|": 4, "^": 4,
+	"*": 5, "/": 5, "%": 5, "<<": 5, ">>": 5, "&": 5,
+}
+
+func parseExpr(src string) (exprNode, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	node, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q", tok.text)
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) expect(op string) error {
+	if tok := p.next(); tok.kind != tokOp || tok.text != op {
+		return fmt.Errorf("expected %q", op)
+	}
+	return nil
+}
+
+func (p *parser) parseBinary(minPrec int) (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		prec, ok := exprPrecedence[tok.text]
+		if tok.kind != tokOp || !ok || prec < minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExprDepth {
+		return nil, fmt.Errorf("expression nested too deeply")
+	}
+
+	tok := p.peek()
+	if tok.kind == tokOp && (tok.text == "-" || tok.text == "+" || tok.text == "~" || tok.text == "!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: tok.text, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		return &literalNode{value: tok.num}, nil
+	case tokString:
+		return &literalNode{value: tok.text}, nil
+	case tokIdent:
+		if p.peek().kind == tokOp && p.peek().text == "(" {
+			return p.parseCall(tok.text)
+		}
+		return &identNode{name: tok.text}, nil
+	case tokOp:
+		if tok.text == "(" {
+			node, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+func (p *parser) parseCall(name string) (exprNode, error) {
+	def, ok := exprFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	p.next() // (
+	call := &callNode{name: name, fn: def.fn}
+	if tok := p.peek(); tok.kind == tokOp && tok.text == ")" {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			tok := p.next()
+			if tok.kind == tokOp && tok.text == ")" {
+				break
+			}
+			if tok.kind != tokOp || tok.text != "," {
+				return nil, fmt.Errorf("expected \",\" or \")\" in call to %s", name)
+			}
+		}
+	}
+	if len(call.args) < def.minArgs || (def.maxArgs >= 0 && len(call.args) > def.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments to %s", name)
+	}
+	return call, nil
+}
+
+// Evaluation
+
+func (n *literalNode) eval(env *exprEnv, depth int) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *identNode) eval(env *exprEnv, depth int) (interface{}, error) {
+	if env == nil {
+		return nil, fmt.Errorf("unknown identifier %q", n.name)
+	}
+	return env.lookup(n.name)
+}
+
+func (n *unaryNode) eval(env *exprEnv, depth int) (interface{}, error) {
+	v, err := n.operand.eval(env, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	i, err := exprInt(v)
+	if err != nil {
+		return nil, fmt.Errorf("operator %s: %v", n.op, err)
+	}
+	switch n.op {
+	case "-":
+		return -i, nil
+	case "~":
+		return ^i, nil
+	case "!":
+		return boolInt(i == 0), nil
+	}
+	return i, nil
+}
+
+func (n *binaryNode) eval(env *exprEnv, depth int) (interface{}, error) {
+	left, err := n.left.eval(env, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuit logical operators.
+	if n.op == "&&" || n.op == "||" {
+		l, err := exprInt(left)
+		if err != nil {
+			return nil, fmt.Errorf("operator %s: %v", n.op, err)
+		}
+		if (n.op == "&&" && l == 0) || (n.op == "||" && l != 0) {
+			return boolInt(l != 0), nil
+		}
+		right, err := n.right.eval(env, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		r, err := exprInt(right)
+		if err != nil {
+			return nil, fmt.Errorf("operator %s: %v", n.op, err)
+		}
+		return boolInt(r != 0), nil
+	}
+
+	right, err := n.right.eval(env, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "+" {
+		switch l := left.(type) {
+		case string:
+			return l + exprString(right), nil
+		case []byte:
+			r, err := exprBytes(right)
+			if err != nil {
+				return nil, err
+			}
+			if len(l)+len(r) > maxExprBytes {
+				return nil, fmt.Errorf("result too large")
+			}
+			return append(append([]byte{}, l...), r...), nil
+		}
+	}
+
+	if n.op == "==" || n.op == "!=" {
+		if _, isInt := left.(int64); !isInt {
+			equal := exprString(left) == exprString(right)
+			return boolInt(equal == (n.op == "==")), nil
+		}
+	}
+
+	l, err := exprInt(left)
+	if err != nil {
+		return nil, fmt.Errorf("operator %s: %v", n.op, err)
+	}
+	r, err := exprInt(right)
+	if err != nil {
+		return nil, fmt.Errorf("operator %s: %v", n.op, err)
+	}
+
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l % r, nil
+	case "&":
+		return l & r, nil
+	case "|":
+		return l | r, nil
+	case "^":
+		return l ^ r, nil
+	case "<<":
+		if r < 0 || r > 63 {
+			return nil, fmt.Errorf("shift count out of range")
+		}
+		return l << uint(r), nil
+	case ">>":
+		if r < 0 || r > 63 {
+			return nil, fmt.Errorf("shift count out of range")
+		}
+		return l >> uint(r), nil
+	case "==":
+		return boolInt(l == r), nil
+	case "!=":
+		return boolInt(l != r), nil
+	case "<":
+		return boolInt(l < r), nil
+	case "<=":
+		return boolInt(l <= r), nil
+	case ">":
+		return boolInt(l > r), nil
+	case ">=":
+		return boolInt(l >= r), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+func (n *callNode) eval(env *exprEnv, depth int) (interface{}, error) {
+	if depth > maxExprDepth {
+		return nil, fmt.Errorf("expression nested too deeply")
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return v, nil
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func exprInt(v interface{}) (int64, error) {
+	switch x := v.(type) {
+	case int64:
+		return x, nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(x), 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", x)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %s", exprTypeName(v))
+}
+
+func exprString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func exprBytes(v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case []byte:
+		return x, nil
+	case string:
+		return []byte(x), nil
+	}
+	return nil, fmt.Errorf("expected bytes, got %s", exprTypeName(v))
+}
+
+func exprTypeName(v interface{}) string {
+	switch v.(type) {
+	case int64:
+		return "int"
+	case string:
+		return "string"
+	case []byte:
+		return "bytes"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Functions
+
+type exprFunc func(args []interface{}) (interface{}, error)
+
+type exprFuncDef struct {
+	minArgs, maxArgs int
+	fn               exprFunc
+}
+
+var exprFuncs map[string]exprFuncDef
+
+func init() {
+	exprFuncs = map[string]exprFuncDef{
+		"len":      {1, 1, fnLen},
+		"hex":      {1, 1, fnHex},
+		"unhex":    {1, 1, fnUnhex},
+		"base64":   {1, 1, fnBase64},
+		"rand":     {1, 1, fnRand},
+		"randint":  {2, 2, fnRandInt},
+		"randstr":  {1, 3, fnRandStr},
+		"choice":   {1, -1, fnChoice},
+		"weighted": {2, -1, fnWeighted},
+		"str":      {1, 1, fnStr},
+		"int":      {1, 1, fnInt},
+		"bytes":    {1, 1, fnBytes},
+		"upper":    {1, 1, fnUpper},
+		"lower":    {1, 1, fnLower},
+		"slice":    {2, 3, fnSlice},
+		"min":      {1, -1, fnMin},
+		"max":      {1, -1, fnMax},
+		"be16":     {1, 1, fnPackInt(2, false)},
+		"be32":     {1, 1, fnPackInt(4, false)},
+		"be64":     {1, 1, fnPackInt(8, false)},
+		"le16":     {1, 1, fnPackInt(2, true)},
+		"le32":     {1, 1, fnPackInt(4, true)},
+		"le64":     {1, 1, fnPackInt(8, true)},
+	}
+}
+
+func fnLen(args []interface{}) (interface{}, error) {
+	switch x := args[0].(type) {
+	case string:
+		return int64(len(x)), nil
+	case []byte:
+		return int64(len(x)), nil
+	}
+	return nil, fmt.Errorf("expected string or bytes, got %s", exprTypeName(args[0]))
+}
+
+func fnHex(args []interface{}) (interface{}, error) {
+	if n, ok := args[0].(int64); ok {
+		return strconv.FormatUint(uint64(n), 16), nil
+	}
+	b, err := exprBytes(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func fnUnhex(args []interface{}) (interface{}, error) {
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("expected string, got %s", exprTypeName(args[0]))
+	}
+	return hex.DecodeString(s)
+}
+
+func fnBase64(args []interface{}) (interface{}, error) {
+	b, err := exprBytes(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func fnRand(args []interface{}) (interface{}, error) {
+	n, err := exprInt(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > maxExprBytes {
+		return nil, fmt.Errorf("length %d out of range", n)
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func fnRandInt(args []interface{}) (interface{}, error) {
+	lo, err := exprInt(args[0])
+	if err != nil {
+		return nil, err
+	}
+	hi, err := exprInt(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if hi < lo {
+		return nil, fmt.Errorf("empty range [%d, %d]", lo, hi)
+	}
+	return randomBetween(lo, hi), nil
+}
+
+// fnRandStr is randstr(n), randstr(min, max) or randstr(min, max, charset),
+// with the charsets of ranges; the default is alphanumeric.
+func fnRandStr(args []interface{}) (interface{}, error) {
+	lo, err := exprInt(args[0])
+	if err != nil {
+		return nil, err
+	}
+	hi := lo
+	if len(args) > 1 {
+		if hi, err = exprInt(args[1]); err != nil {
+			return nil, err
+		}
+	}
+	if lo < 0 || hi < lo || hi > maxExprBytes {
+		return nil, fmt.Errorf("length range [%d, %d] is invalid", lo, hi)
+	}
+	charset := charsets["alnum"]
+	if len(args) > 2 {
+		charset = exprString(args[2])
+		if named, ok := charsets[charset]; ok {
+			charset = named
+		}
+		if charset == "" {
+			return nil, fmt.Errorf("empty charset")
+		}
+	}
+	return randomString(charset, int(randomBetween(lo, hi))), nil
+}
+
+func fnChoice(args []interface{}) (interface{}, error) {
+	return args[mrand.Intn(len(args))], nil
+}
+
+// fnWeighted is weighted(value, weight, value, weight, ...).
+func fnWeighted(args []interface{}) (interface{}, error) {
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("expected value, weight pairs")
+	}
+	var values []interface{}
+	var weights []float64
+	var total float64
+	for i := 0; i < len(args); i += 2 {
+		w, err := exprInt(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		if w < 0 {
+			return nil, fmt.Errorf("negative weight %d", w)
+		}
+		values = append(values, args[i])
+		weights = append(weights, float64(w))
+		total += float64(w)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("weights are all zero")
+	}
+	return values[weightedIndex(weights, len(values))], nil
+}
+
+func fnStr(args []interface{}) (interface{}, error) {
+	return exprString(args[0]), nil
+}
+
+func fnInt(args []interface{}) (interface{}, error) {
+	return exprInt(args[0])
+}
+
+func fnBytes(args []interface{}) (interface{}, error) {
+	return exprBytes(args[0])
+}
+
+func fnUpper(args []interface{}) (interface{}, error) {
+	return strings.ToUpper(exprString(args[0])), nil
+}
+
+func fnLower(args []interface{}) (interface{}, error) {
+	return strings.ToLower(exprString(args[0])), nil
+}
+
+func fnSlice(args []interface{}) (interface{}, error) {
+	var length int
+	switch x := args[0].(type) {
+	case string:
+		length = len(x)
+	case []byte:
+		length = len(x)
+	default:
+		return nil, fmt.Errorf("expected string or bytes, got %s", exprTypeName(args[0]))
+	}
+
+	start, err := exprInt(args[1])
+	if err != nil {
+		return nil, err
+	}
+	end := int64(length)
+	if len(args) == 3 {
+		if end, err = exprInt(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	start = min(max(start, 0), int64(length))
+	end = min(max(end, 0), int64(length))
+	if start > end {
+		start = end
+	}
+
+	if s, ok := args[0].(string); ok {
+		return s[start:end], nil
+	}
+	return append([]byte{}, args[0].([]byte)[start:end]...), nil
+}
+
+func fnMin(args []interface{}) (interface{}, error) {
+	return foldInts(args, func(a, b int64) bool { return b < a })
+}
+
+func fnMax(args []interface{}) (interface{}, error) {
+	return foldInts(args, func(a, b int64) bool { return b > a })
+}
+
+func foldInts(args []interface{}, better func(a, b int64) bool) (interface{}, error) {
+	best, err := exprInt(args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range args[1:] {
+		v, err := exprInt(arg)
+		if err != nil {
+			return nil, err
+		}
+		if better(best, v) {
+			best = v
+		}
+	}
+	return best, nil
+}
+
+func fnPackInt(size int, little bool) exprFunc {
+	return func(args []interface{}) (interface{}, error) {
+		n, err := exprInt(args[0])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 8)
+		if little {
+			binary.LittleEndian.PutUint64(buf, uint64(n))
+			return buf[:size], nil
+		}
+		binary.BigEndian.PutUint64(buf, uint64(n))
+		return buf[8-size:], nil
+	}
+}
+
+// compileProtocolTemplates compiles every string in the protocols that may hold
+// an expression, so syntax errors surface when the pattern is loaded.
+func compileProtocolTemplates(protocols []Protocol) (map[string]*template, error) {
+	templates := make(map[string]*template)
+	add := func(where string, value interface{}) error {
+		s, ok := value.(string)
+		if !ok || !strings.Contains(s, "${") {
+			return nil
+		}
+		if _, exists := templates[s]; exists {
+			return nil
+		}
+		tpl, err := compileTemplate(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", where, err)
+		}
+		templates[s] = tpl
+		return nil
+	}
+
+	addFields := func(where string, fields []Field) error {
+		for _, field := range fields {
+			if err := add(where+"."+field.Name, field.Value); err != nil {
+				return err
+			}
+			if bits, ok := field.Value.(map[string]interface{}); ok {
+				for name, v := range bits {
+					if err := add(where+"."+field.Name+"."+name, v); err != nil {
+						return err
+					}
+				}
+			}
+			if r, err := parseRange(field.RangeValues); err == nil {
+				for _, choice := range r.choices {
+					if err := add(where+"."+field.Name+".range", choice); err != nil {
+						return err
+					}
+				}
+			}
+			if field.Computation != nil {
+				if err := add(where+"."+field.Name+".key", field.Computation.Key); err != nil {
+					return err
+				}
+				for _, key := range []string{"source_ip", "dest_ip", "length"} {
+					if err := add(where+"."+field.Name+"."+key, field.Computation.PseudoHeader[key]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	addChunk := func(where string, chunk Chunk) error {
+		where += "." + chunk.Name
+		if err := addFields(where, chunk.Fields); err != nil {
+			return err
+		}
+		if err := add(where+".condition", chunk.Condition); err != nil {
+			return err
+		}
+		if chunk.Repeat == nil {
+			return nil
+		}
+		if err := add(where+".count", chunk.Repeat.Count); err != nil {
+			return err
+		}
+		for i, item := range chunk.Repeat.Items {
+			for name, v := range item {
+				if err := add(fmt.Sprintf("%s[%d].%s", where, i, name), v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	addFormat := func(where string, format interface{}) error {
+		var items []interface{}
+		switch v := format.(type) {
+		case []interface{}:
+			items = v
+		case map[string]interface{}:
+			for _, item := range v {
+				items = append(items, item)
+			}
+		default:
+			items = []interface{}{v}
+		}
+		for _, item := range items {
+			if headers, ok := item.(map[string]interface{}); ok {
+				for name, val := range headers {
+					if err := add(where+"."+name, val); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := add(where, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, proto := range protocols {
+		frame := proto.FrameStructure
+		if err := addFormat(proto.Identifier+".request_format", frame.RequestFormat); err != nil {
+			return nil, err
+		}
+		if err := addFormat(proto.Identifier+".response_format", frame.ResponseFormat); err != nil {
+			return nil, err
+		}
+		if err := addFields(proto.Identifier, frame.Fields); err != nil {
+			return nil, err
+		}
+		for _, chunk := range frame.Chunks {
+			if err := addChunk(proto.Identifier, chunk); err != nil {
+				return nil, err
+			}
+		}
+
+		if cfg := proto.HTTP2; cfg != nil {
+			if err := add(proto.Identifier+".http2.path", cfg.Path); err != nil {
+				return nil, err
+			}
+			if err := add(proto.Identifier+".http2.authority", cfg.Authority); err != nil {
+				return nil, err
+			}
+			for _, headers := range []map[string]string{cfg.Headers, cfg.ResponseHeaders} {
+				for name, value := range headers {
+					if err := add(proto.Identifier+".http2."+name, value); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		if proto.LayerStack == nil {
+			continue
+		}
+		for _, layer := range proto.LayerStack.layers() {
+			where := proto.Identifier + "." + layer.name
+			if err := addFields(where, layer.def.Fields); err != nil {
+				return nil, err
+			}
+			for _, chunk := range layer.def.Chunks {
+				if err := addChunk(where, chunk); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return templates, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testExprEnv() *exprEnv {
+	return &exprEnv{
+		connID:    "conn-1",
+		sessionID: 0x1234,
+		data:      []byte("hello"),
+		seq:       7,
+		vars:      map[string]interface{}{"host": "example.com", "port": 443, "key": []byte{0xde, 0xad}},
+		src:       &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000},
+		dst:       &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443},
+	}
+}
+
+func evalExpr(t *testing.T, src string) (interface{}, error) {
+	t.Helper()
+	node, err := parseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	return node.eval(testExprEnv(), 0)
+}
+
+func TestExprValues(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"0x10 | 1", int64(17)},
+		{"1 << 4 >> 2", int64(4)},
+		{"7 % 4 == 3 && 1", int64(1)},
+		{"0 || 0", int64(0)},
+		{"-DATA_SIZE", int64(-5)},
+		{"'a' + 'b'", "ab"},
+		{"host == 'example.com'", int64(1)},
+		{"port + 1", int64(444)},
+		{"seq", int64(7)},
+		{"SESSION_ID", int64(0x1234)},
+		{"SRC_IP + ':' + str(DST_PORT)", "10.0.0.1:443"},
+		{"len(payload)", int64(5)},
+		{"hex(key)", "dead"},
+		{"unhex('beef')", []byte{0xbe, 0xef}},
+		{"base64('hi')", "aGk="},
+		{"upper(host)", "EXAMPLE.COM"},
+		{"int('0x20')", int64(32)},
+		{"min(3, 1, 2)", int64(1)},
+		{"max(3, 1, 2)", int64(3)},
+		{"be16(0x0102)", []byte{1, 2}},
+		{"le32(1)", []byte{1, 0, 0, 0}},
+		{"payload + key", []byte{'h', 'e', 'l', 'l', 'o', 0xde, 0xad}},
+		{"slice(host, 0, 7)", "example"},
+		{"slice(host, 8)", "com"},
+		{"slice(payload, 1, 3)", []byte("el")},
+	}
+	for _, tt := range tests {
+		got, err := evalExpr(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !exprEqual(got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExprSliceBounds(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"slice(host, 0, -1)", ""},
+		{"slice(host, -5, -1)", ""},
+		{"slice(host, -5, 3)", "exa"},
+		{"slice(host, 5, 2)", ""},
+		{"slice(host, 20)", ""},
+		{"slice(host, 20, 30)", ""},
+		{"slice(host, 8, 100)", "com"},
+		{"slice(payload, 0, -1)", []byte{}},
+		{"slice(payload, 9, 2)", []byte{}},
+	}
+	for _, tt := range tests {
+		got, err := evalExpr(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !exprEqual(got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"1 / 0", "division by zero"},
+		{"1 % 0", "division by zero"},
+		{"1 << 64", "shift count out of range"},
+		{"nosuch", "unknown identifier"},
+		{"nosuch(1)", ""},
+		{"len()", ""},
+		{"slice(1, 0)", "expected string or bytes"},
+		{"'abc' - 1", "not a number"},
+		{"(1 + 2", ""},
+		{"'open", ""},
+	}
+	for _, tt := range tests {
+		_, err := evalExpr(t, tt.src)
+		if err == nil {
+			t.Errorf("%s: no error", tt.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %q, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	env := testExprEnv()
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"plain", "plain"},
+		{"GET /${host}/${seq} HTTP/1.1", "GET /example.com/7 HTTP/1.1"},
+		{"${port}", int64(443)},
+		{"${'}' + host}", "}example.com"},
+		{"${CONN_ID}-${DATA_SIZE}", "conn-1-5"},
+	}
+	for _, tt := range tests {
+		tpl, err := compileTemplate(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		got, err := tpl.value(env)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !exprEqual(got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+
+	for _, src := range []string{"${host", "${1 +}"} {
+		if _, err := compileTemplate(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
+
+func exprEqual(got, want interface{}) bool {
+	if w, ok := want.([]byte); ok {
+		g, ok := got.([]byte)
+		return ok && bytes.Equal(g, w)
+	}
+	return got == want
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+
+	"tunnel/plugin"
+)
+
+// fieldCodec implements plugin.FieldCodec for the built-in types beyond the
+// basic ones in setValue.
+type fieldCodec struct {
+	// encode returns the wire form of a value. size is the field's declared
+	// size, or 0 when the field is sized by its content.
+	encode func(value interface{}, size int) ([]byte, bool)
+	decode func(raw []byte) (interface{}, bool)
+	// measure returns how long the field at the start of data is, for types
+	// that delimit themselves. Others need a size, size_from or terminator.
+	measure func(data []byte) (int, bool)
+	// variable types without a declared size are sized by their content
+	variable bool
+}
+
+func (c fieldCodec) Encode(value interface{}, size int) ([]byte, bool) { return c.encode(value, size) }
+func (c fieldCodec) Decode(raw []byte) (interface{}, bool)             { return c.decode(raw) }
+func (c fieldCodec) Variable() bool                                    { return c.variable }
+
+// measuringCodec is a fieldCodec that delimits itself.
+type measuringCodec struct{ fieldCodec }
+
+func (c measuringCodec) Measure(data []byte) (int, bool) { return c.measure(data) }
+
+func init() {
+	for name, codec := range builtinCodecs {
+		if codec.measure != nil {
+			plugin.RegisterFieldCodec(name, measuringCodec{codec})
+		} else {
+			plugin.RegisterFieldCodec(name, codec)
+		}
+	}
+}
+
+var builtinCodecs = map[string]fieldCodec{
+	"uint64_be": uintCodec(8, binary.BigEndian, false),
+	"uint64_le": uintCodec(8, binary.LittleEndian, false),
+	"int8":      uintCodec(1, binary.BigEndian, true),
+	"int16_be":  uintCodec(2, binary.BigEndian, true),
+	"int16_le":  uintCodec(2, binary.LittleEndian, true),
+	"int32_be":  uintCodec(4, binary.BigEndian, true),
+	"int32_le":  uintCodec(4, binary.LittleEndian, true),
+	"int64_be":  uintCodec(8, binary.BigEndian, true),
+	"int64_le":  uintCodec(8, binary.LittleEndian, true),
+
+	"leb128":      {encode: encodeLEB128(false), decode: decodeLEB128(false), measure: measureLEB128, variable: true},
+	"sleb128":     {encode: encodeLEB128(true), decode: decodeLEB128(true), measure: measureLEB128, variable: true},
+	"quic_varint": {encode: encodeQUICVarint, decode: decodeQUICVarint, measure: measureQUICVarint, variable: true},
+
+	"mac_address": {encode: encodeMAC, decode: decodeMAC},
+
+	"ascii_decimal": {encode: encodeASCIINumber(10), decode: decodeASCIINumber(10), variable: true},
+	"ascii_hex":     {encode: encodeASCIINumber(16), decode: decodeASCIINumber(16), variable: true},
+
+	"base64":    textCodec(base64.StdEncoding),
+	"base64url": textCodec(base64.RawURLEncoding),
+	"base32":    textCodec(base32.StdEncoding),
+
+	"pstring8":  prefixedCodec(1),
+	"pstring16": prefixedCodec(2),
+
+	"dns_name":   {encode: encodeDNSName, decode: decodeDNSName, measure: measureDNSName, variable: true},
+	"dns_labels": {encode: encodeDNSLabels, decode: decodeDNSLabels, measure: measureDNSName, variable: true},
+}
+
+// isVariableField reports whether a field's size depends on its value.
+func isVariableField(field Field) bool {
+	if field.SizeFrom != "" {
+		return true
+	}
+	codec, ok := plugin.LookupFieldCodec(field.Type)
+	return field.Size == 0 && ok && codec.Variable()
+}
+
+// encodeField returns the bytes a field holds for a value, for sizing fields
+// by their content.
+func encodeField(field Field, value interface{}) []byte {
+	if codec, ok := plugin.LookupFieldCodec(field.Type); ok {
+		data, _ := codec.Encode(value, 0)
+		return data
+	}
+	return fieldContent(value)
+}
+
+// decodeValue reads the value of a received field: int64 for numbers (uint64
+// for the unsigned 64-bit types), string for text and addresses, a map of
+// names to int64 for bitfields, []byte otherwise.
+func decodeValue(field Field, raw []byte) (interface{}, bool) {
+	switch field.Type {
+	case "uint8", "uint16_be", "uint32_be":
+		return int64(readUint(raw, binary.BigEndian)), len(raw) > 0 && len(raw) <= 8
+	case "uint16_le", "uint32_le":
+		return int64(readUint(raw, binary.LittleEndian)), len(raw) > 0 && len(raw) <= 8
+	case "ipv4_address", "ipv6_address":
+		if len(raw) != net.IPv4len && len(raw) != net.IPv6len {
+			return nil, false
+		}
+		return net.IP(raw).String(), true
+	case "string":
+		return strings.TrimRight(string(raw), "\x00"), true
+	case "bytes", "":
+		return raw, true
+	case "bitfield":
+		values := make(map[string]interface{}, len(field.Bits))
+		for name, bitField := range field.Bits {
+			values[name] = int64(getBits(raw, bitField.Position, bitField.Size, field.BitOrder == "msb"))
+		}
+		return values, true
+	}
+	if codec, ok := plugin.LookupFieldCodec(field.Type); ok {
+		return codec.Decode(raw)
+	}
+	return raw, true
+}
+
+// readUint reads an unsigned integer of up to 8 bytes.
+func readUint(raw []byte, order binary.ByteOrder) uint64 {
+	var v uint64
+	if order == binary.BigEndian {
+		for _, b := range raw {
+			v = v<<8 | uint64(b)
+		}
+	} else {
+		for i := len(raw) - 1; i >= 0; i-- {
+			v = v<<8 | uint64(raw[i])
+		}
+	}
+	return v
+}
+
+func uintCodec(width int, order binary.ByteOrder, signed bool) fieldCodec {
+	return fieldCodec{
+		encode: func(value interface{}, size int) ([]byte, bool) {
+			v, ok := toUint64(value)
+			if !ok {
+				return nil, false
+			}
+			buf := make([]byte, 8)
+			if order == binary.BigEndian {
+				binary.BigEndian.PutUint64(buf, v)
+				return buf[8-width:], true
+			}
+			binary.LittleEndian.PutUint64(buf, v)
+			return buf[:width], true
+		},
+		decode: func(raw []byte) (interface{}, bool) {
+			if len(raw) != width {
+				return nil, false
+			}
+			v := readUint(raw, order)
+			if !signed {
+				return v, true
+			}
+			// Sign-extend
+			shift := 64 - 8*width
+			return int64(v<<shift) >> shift, true
+		},
+	}
+}
+
+// LEB128, as in DWARF and WebAssembly. A declared size pads the encoding
+// with continuation bytes.
+func encodeLEB128(signed bool) func(interface{}, int) ([]byte, bool) {
+	return func(value interface{}, size int) ([]byte, bool) {
+		u, ok := toUint64(value)
+		if !ok {
+			return nil, false
+		}
+		v := int64(u)
+
+		var out []byte
+		for {
+			b := byte(u & 0x7f)
+			var done bool
+			if signed {
+				v >>= 7
+				done = v == 0 && b&0x40 == 0 || v == -1 && b&0x40 != 0
+				u = uint64(v)
+			} else {
+				u >>= 7
+				done = u == 0
+			}
+			if done {
+				out = append(out, b)
+				break
+			}
+			out = append(out, b|0x80)
+		}
+
+		pad := byte(0x00)
+		if signed && v < 0 {
+			pad = 0x7f
+		}
+		for len(out) < size {
+			out[len(out)-1] |= 0x80
+			out = append(out, pad)
+		}
+		return out, true
+	}
+}
+
+func decodeLEB128(signed bool) func([]byte) (interface{}, bool) {
+	return func(raw []byte) (interface{}, bool) {
+		n, ok := measureLEB128(raw)
+		if !ok || n != len(raw) {
+			return nil, false
+		}
+		var v uint64
+		var shift uint
+		for _, b := range raw {
+			if shift < 64 {
+				v |= uint64(b&0x7f) << shift
+				shift += 7
+			}
+		}
+		if signed && shift < 64 && raw[n-1]&0x40 != 0 {
+			v |= ^uint64(0) << shift
+		}
+		return int64(v), true
+	}
+}
+
+func measureLEB128(data []byte) (int, bool) {
+	for i, b := range data {
+		if b&0x80 == 0 {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// QUIC variable-length integers (RFC 9000, section 16): the top two bits of
+// the first byte give the length. A declared size of 1, 2, 4 or 8 forces
+// that encoding.
+func encodeQUICVarint(value interface{}, size int) ([]byte, bool) {
+	v, ok := toUint64(value)
+	if !ok || v >= 1<<62 {
+		return nil, false
+	}
+	if size == 0 {
+		switch {
+		case v < 1<<6:
+			size = 1
+		case v < 1<<14:
+			size = 2
+		case v < 1<<30:
+			size = 4
+		default:
+			size = 8
+		}
+	}
+
+	var prefix byte
+	switch size {
+	case 1:
+		prefix = 0x00
+	case 2:
+		prefix = 0x40
+	case 4:
+		prefix = 0x80
+	case 8:
+		prefix = 0xc0
+	default:
+		return nil, false
+	}
+	if size < 8 && v >= 1<<(8*size-2) {
+		return nil, false
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	out := buf[8-size:]
+	out[0] |= prefix
+	return out, true
+}
+
+func decodeQUICVarint(raw []byte) (interface{}, bool) {
+	n, ok := measureQUICVarint(raw)
+	if !ok || n != len(raw) {
+		return nil, false
+	}
+	v := uint64(raw[0] & 0x3f)
+	for _, b := range raw[1:] {
+		v = v<<8 | uint64(b)
+	}
+	return int64(v), true
+}
+
+func measureQUICVarint(data []byte) (int, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+	n := 1 << (data[0] >> 6)
+	return n, n <= len(data)
+}
+
+func encodeMAC(value interface{}, size int) ([]byte, bool) {
+	switch v := value.(type) {
+	case string:
+		mac, err := net.ParseMAC(v)
+		if err != nil {
+			return nil, false
+		}
+		return mac, true
+	case []byte:
+		return v, true
+	}
+	return nil, false
+}
+
+func decodeMAC(raw []byte) (interface{}, bool) {
+	if len(raw) != 6 && len(raw) != 8 {
+		return nil, false
+	}
+	return net.HardwareAddr(raw).String(), true
+}
+
+// Numbers written as ASCII text. A declared size pads them with leading zeros.
+func encodeASCIINumber(base int) func(interface{}, int) ([]byte, bool) {
+	return func(value interface{}, size int) ([]byte, bool) {
+		v, ok := toUint64(value)
+		if !ok {
+			return nil, false
+		}
+		var s string
+		if base == 10 {
+			s = strconv.FormatInt(int64(v), 10)
+		} else {
+			s = strconv.FormatUint(v, base)
+		}
+		if len(s) < size && !strings.HasPrefix(s, "-") {
+			s = strings.Repeat("0", size-len(s)) + s
+		}
+		return []byte(s), true
+	}
+}
+
+func decodeASCIINumber(base int) func([]byte) (interface{}, bool) {
+	return func(raw []byte) (interface{}, bool) {
+		s := strings.TrimSpace(strings.TrimRight(string(raw), "\x00"))
+		if base == 10 {
+			n, err := strconv.ParseInt(s, 10, 64)
+			return n, err == nil
+		}
+		n, err := strconv.ParseUint(s, base, 64)
+		return int64(n), err == nil
+	}
+}
+
+// textEncoding is satisfied by the base64 and base32 encodings.
+type textEncoding interface {
+	EncodeToString([]byte) string
+	DecodeString(string) ([]byte, error)
+}
+
+// textCodec writes bytes as base64 or base32 text.
+func textCodec(enc textEncoding) fieldCodec {
+	return fieldCodec{
+		encode: func(value interface{}, size int) ([]byte, bool) {
+			data := fieldContent(value)
+			if data == nil {
+				return nil, false
+			}
+			return []byte(enc.EncodeToString(data)), true
+		},
+		decode: func(raw []byte) (interface{}, bool) {
+			data, err := enc.DecodeString(strings.TrimRight(string(raw), "\x00"))
+			return data, err == nil
+		},
+		variable: true,
+	}
+}
+
+// prefixedCodec writes a string after its length, in 1 or 2 big-endian
+// bytes.
+func prefixedCodec(width int) fieldCodec {
+	max := 1<<(8*width) - 1
+	return fieldCodec{
+		encode: func(value interface{}, size int) ([]byte, bool) {
+			data := fieldContent(value)
+			if data == nil {
+				return nil, false
+			}
+			if len(data) > max {
+				data = data[:max]
+			}
+			out := make([]byte, width, width+len(data))
+			if width == 1 {
+				out[0] = byte(len(data))
+			} else {
+				binary.BigEndian.PutUint16(out, uint16(len(data)))
+			}
+			return append(out, data...), true
+		},
+		decode: func(raw []byte) (interface{}, bool) {
+			n, ok := measurePrefixed(raw, width)
+			if !ok || n > len(raw) {
+				return nil, false
+			}
+			return string(raw[width:n]), true
+		},
+		measure: func(data []byte) (int, bool) {
+			return measurePrefixed(data, width)
+		},
+		variable: true,
+	}
+}
+
+func measurePrefixed(data []byte, width int) (int, bool) {
+	if len(data) < width {
+		return 0, false
+	}
+	n := width + int(readUint(data[:width], binary.BigEndian))
+	return n, n <= len(data)
+}
+
+// DNS names in wire format (RFC 1035, section 3.1): length-prefixed labels
+// ending with an empty one. Names are written uncompressed, and compressed
+// names can't be decoded without the rest of the message.
+func encodeDNSName(value interface{}, size int) ([]byte, bool) {
+	name, ok := value.(string)
+	if !ok {
+		return nil, false
+	}
+	name = strings.TrimSuffix(name, ".")
+
+	var out []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, false
+			}
+			out = append(out, byte(len(label)))
+			out = append(out, label...)
+		}
+	}
+	out = append(out, 0)
+	if len(out) > 255 {
+		return nil, false
+	}
+	return out, true
+}
+
+func decodeDNSName(raw []byte) (interface{}, bool) {
+	n, ok := measureDNSName(raw)
+	if !ok || n != len(raw) {
+		return nil, false
+	}
+	var labels []string
+	for i := 0; raw[i] != 0; i += 1 + int(raw[i]) {
+		labels = append(labels, string(raw[i+1:i+1+int(raw[i])]))
+	}
+	return strings.Join(labels, ".") + ".", true
+}
+
+func measureDNSName(data []byte) (int, bool) {
+	for i := 0; i < len(data) && i < 255; {
+		switch l := int(data[i]); {
+		case l == 0:
+			return i + 1, true
+		case l > 63:
+			return 0, false // compression pointer or reserved
+		default:
+			i += 1 + l
+		}
+	}
+	return 0, false
+}
+
+// encodeDNSLabels lays bytes out as the labels of a DNS name, 63 bytes to a
+// label, so a payload can ride in a query name; the name keeps to 255 bytes.
+func encodeDNSLabels(value interface{}, size int) ([]byte, bool) {
+	data := fieldContent(value)
+	var out []byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > 63 {
+			n = 63
+		}
+		out = append(out, byte(n))
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	out = append(out, 0)
+	if len(out) > 255 {
+		return nil, false
+	}
+	return out, true
+}
+
+// decodeDNSLabels joins the labels of a name back into bytes.
+func decodeDNSLabels(raw []byte) (interface{}, bool) {
+	n, ok := measureDNSName(raw)
+	if !ok || n != len(raw) {
+		return nil, false
+	}
+	out := []byte{}
+	for i := 0; raw[i] != 0; i += 1 + int(raw[i]) {
+		out = append(out, raw[i+1:i+1+int(raw[i])]...)
+	}
+	return out, true
+}
+
+// fieldModulus is the number of values an integer field can hold, so counters
+// wrap where the field does; 0 stands for 2^64.
+func fieldModulus(field Field) uint64 {
+	bits := 64
+	switch field.Type {
+	case "uint8", "int8":
+		bits = 8
+	case "uint16_be", "uint16_le", "int16_be", "int16_le":
+		bits = 16
+	case "uint32_be", "uint32_le", "int32_be", "int32_le":
+		bits = 32
+	case "quic_varint":
+		bits = 62
+	case "leb128", "sleb128":
+		if field.Size > 0 {
+			bits = 7 * field.Size
+		}
+	case "ascii_hex":
+		if field.Size > 0 {
+			bits = 4 * field.Size
+		}
+	case "ascii_decimal":
+		if field.Size > 0 && field.Size < 20 {
+			mod := uint64(1)
+			for i := 0; i < field.Size; i++ {
+				mod *= 10
+			}
+			return mod
+		}
+	default:
+		if !strings.Contains(field.Type, "64") && field.Size > 0 && field.Size < 8 {
+			bits = 8 * field.Size
+		}
+	}
+	if bits >= 64 {
+		return 0
+	}
+	return 1 << bits
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFieldCodecVectors(t *testing.T) {
+	tests := []struct {
+		typ   string
+		size  int
+		value interface{}
+		wire  string
+		back  interface{} // decoded value, when it differs from value
+	}{
+		{"uint64_be", 0, uint64(0x0102030405060708), "0102030405060708", nil},
+		{"uint64_le", 0, uint64(0x0102030405060708), "0807060504030201", nil},
+		{"uint64_be", 0, uint64(math.MaxUint64), "ffffffffffffffff", nil},
+		{"int8", 0, int64(-1), "ff", nil},
+		{"int16_be", 0, int64(-2), "fffe", nil},
+		{"int16_le", 0, int64(-2), "feff", nil},
+		{"int32_be", 0, int64(math.MinInt32), "80000000", nil},
+		{"int64_le", 0, int64(-3), "fdffffffffffffff", nil},
+
+		// DWARF examples
+		{"leb128", 0, int64(2), "02", nil},
+		{"leb128", 0, int64(127), "7f", nil},
+		{"leb128", 0, int64(128), "8001", nil},
+		{"leb128", 0, int64(624485), "e58e26", nil},
+		{"leb128", 3, int64(1), "818000", nil},
+		{"sleb128", 0, int64(-1), "7f", nil},
+		{"sleb128", 0, int64(63), "3f", nil},
+		{"sleb128", 0, int64(64), "c000", nil},
+		{"sleb128", 0, int64(-64), "40", nil},
+		{"sleb128", 0, int64(-65), "bf7f", nil},
+		{"sleb128", 0, int64(-123456), "c0bb78", nil},
+		{"sleb128", 3, int64(-1), "ffff7f", nil},
+		{"sleb128", 0, int64(math.MinInt64), "8080808080808080807f", nil},
+
+		// RFC 9000, appendix A.1
+		{"quic_varint", 0, int64(37), "25", nil},
+		{"quic_varint", 0, int64(15293), "7bbd", nil},
+		{"quic_varint", 0, int64(494878333), "9d7f3e7d", nil},
+		{"quic_varint", 0, int64(151288809941952652), "c2197c5eff14e88c", nil},
+		{"quic_varint", 2, int64(37), "4025", nil},
+
+		{"mac_address", 0, "00:1a:2b:3c:4d:5e", "001a2b3c4d5e", nil},
+		{"ascii_decimal", 0, int64(1234), "31323334", nil},
+		{"ascii_decimal", 6, int64(42), "303030303432", nil},
+		{"ascii_hex", 4, int64(0xbeef), "62656566", nil},
+		{"ascii_hex", 6, int64(0xbeef), "303062656566", nil},
+		{"base64", 0, []byte("hi!?"), hex.EncodeToString([]byte("aGkhPw==")), []byte("hi!?")},
+		{"base64url", 0, []byte{0xfb, 0xff}, hex.EncodeToString([]byte("-_8")), []byte{0xfb, 0xff}},
+		{"base32", 0, []byte("f"), hex.EncodeToString([]byte("MY======")), []byte("f")},
+		{"pstring8", 0, "abc", "03616263", nil},
+		{"pstring16", 0, "abc", "0003616263", nil},
+		{"dns_name", 0, "www.example.com", "03777777076578616d706c6503636f6d00", "www.example.com."},
+		{"dns_name", 0, "", "00", "."},
+		{"dns_labels", 0, []byte("ab"), "02616200", []byte("ab")},
+	}
+	for _, tt := range tests {
+		want := mustHex(t, tt.wire)
+		field := Field{Type: tt.typ, Size: tt.size}
+		codec := builtinCodecs[tt.typ]
+		got, ok := codec.encode(tt.value, tt.size)
+		if !ok || !bytes.Equal(got, want) {
+			t.Errorf("%s(%v, size %d) = %x, %v; want %s", tt.typ, tt.value, tt.size, got, ok, tt.wire)
+			continue
+		}
+		back := tt.back
+		if back == nil {
+			back = tt.value
+		}
+		decoded, ok := decodeValue(field, want)
+		if !ok || !exprEqual(decoded, back) {
+			t.Errorf("%s decodes %s to %#v, %v; want %#v", tt.typ, tt.wire, decoded, ok, back)
+		}
+		if codec.measure != nil {
+			if n, ok := codec.measure(append(want, 0xaa, 0xbb)); !ok || n != len(want) {
+				t.Errorf("%s measures %s as %d, %v; want %d", tt.typ, tt.wire, n, ok, len(want))
+			}
+		}
+	}
+}
+
+func TestFieldCodecRejects(t *testing.T) {
+	encodes := []struct {
+		typ   string
+		size  int
+		value interface{}
+	}{
+		{"quic_varint", 0, int64(1) << 62},
+		{"quic_varint", 1, int64(64)},
+		{"quic_varint", 3, int64(1)},
+		{"mac_address", 0, "not a mac"},
+		{"dns_name", 0, "a..b"},
+		{"dns_name", 0, string(bytes.Repeat([]byte("x"), 64)) + ".com"},
+		{"dns_labels", 0, bytes.Repeat([]byte("x"), 300)},
+	}
+	for _, tt := range encodes {
+		if got, ok := builtinCodecs[tt.typ].encode(tt.value, tt.size); ok {
+			t.Errorf("%s(%v, size %d) = %x, want failure", tt.typ, tt.value, tt.size, got)
+		}
+	}
+
+	decodes := []struct {
+		typ  string
+		wire string
+	}{
+		{"int16_be", "01"},
+		{"uint64_le", "010203"},
+		{"leb128", "80"},
+		{"leb128", "0101"},
+		{"quic_varint", "40"},
+		{"quic_varint", "2501"},
+		{"mac_address", "0102"},
+		{"ascii_decimal", "313278"},
+		{"base64", "2a2a2a"},
+		{"pstring8", "056162"},
+		{"dns_name", "03777777"},
+		{"dns_name", "c00c"},
+		{"dns_name", "0161000000"},
+	}
+	for _, tt := range decodes {
+		if v, ok := decodeValue(Field{Type: tt.typ}, mustHex(t, tt.wire)); ok {
+			t.Errorf("%s decodes %s to %#v, want failure", tt.typ, tt.wire, v)
+		}
+	}
+}
+
+func TestLEB128Limits(t *testing.T) {
+	// The largest unsigned value takes ten bytes
+	wire := mustHex(t, "ffffffffffffffffff01")
+	got, ok := builtinCodecs["leb128"].encode(uint64(math.MaxUint64), 0)
+	if !ok || !bytes.Equal(got, wire) {
+		t.Fatalf("leb128(MaxUint64) = %x, want %x", got, wire)
+	}
+	if v, ok := decodeLEB128(false)(wire); !ok || v != int64(-1) {
+		t.Errorf("leb128 decodes %x to %v, want the bits of MaxUint64", wire, v)
+	}
+
+	// Bytes past 64 bits are read but ignored
+	long := mustHex(t, "8180808080808080808080808000")
+	if v, ok := decodeLEB128(false)(long); !ok || v != int64(1) {
+		t.Errorf("leb128 decodes %x to %v, want 1", long, v)
+	}
+
+	for _, v := range []int64{0, 1, -1, 1000, -1000, math.MaxInt64, math.MinInt64} {
+		wire, ok := builtinCodecs["sleb128"].encode(v, 0)
+		if !ok {
+			t.Fatalf("sleb128(%d) failed", v)
+		}
+		if back, ok := decodeLEB128(true)(wire); !ok || back != v {
+			t.Errorf("sleb128 round trip of %d gives %v (%x)", v, back, wire)
+		}
+	}
+}
+
+func TestFieldModulus(t *testing.T) {
+	tests := []struct {
+		field Field
+		want  uint64
+	}{
+		{Field{Type: "uint8"}, 1 << 8},
+		{Field{Type: "int16_le"}, 1 << 16},
+		{Field{Type: "uint32_be"}, 1 << 32},
+		{Field{Type: "uint64_be"}, 0},
+		{Field{Type: "quic_varint"}, 1 << 62},
+		{Field{Type: "leb128", Size: 2}, 1 << 14},
+		{Field{Type: "leb128"}, 0},
+		{Field{Type: "ascii_hex", Size: 3}, 1 << 12},
+		{Field{Type: "ascii_decimal", Size: 4}, 10000},
+		{Field{Type: "bytes", Size: 3}, 1 << 24},
+	}
+	for _, tt := range tests {
+		if got := fieldModulus(tt.field); got != tt.want {
+			t.Errorf("fieldModulus(%s, size %d) = %d, want %d", tt.field.Type, tt.field.Size, got, tt.want)
+		}
+	}
+}
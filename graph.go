@@ -0,0 +1,287 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runGraph implements the "graph" subcommand: it renders the state machines
+// of a pattern as Graphviz DOT or Mermaid and reports lint findings on stderr.
+func runGraph(args []string) int {
+	fs := flag.NewFlagSet("graph", flag.ContinueOnError)
+	patternFile := fs.String("pattern", "llm.json", "Protocol pattern file")
+	protocolID := fs.String("protocol", "", "Only render this protocol (default: all)")
+	format := fs.String("format", "dot", "Output format: dot or mermaid")
+	lintOnly := fs.Bool("lint", false, "Only report lint findings")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *format != "dot" && *format != "mermaid" {
+		fmt.Fprintf(os.Stderr, "❌ Unknown format %q (use dot or mermaid)\n", *format)
+		return 2
+	}
+
+	config, err := loadConfig(*patternFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	found := false
+	errors := 0
+	for _, proto := range config.Protocols {
+		if *protocolID != "" && proto.Identifier != *protocolID {
+			continue
+		}
+		found = true
+
+		for _, issue := range lintStateMachine(proto) {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", proto.Identifier, issue.severity, issue.message)
+			if issue.severity == "error" {
+				errors++
+			}
+		}
+
+		if *lintOnly {
+			continue
+		}
+		if *format == "mermaid" {
+			writeMermaid(os.Stdout, proto)
+		} else {
+			writeDOT(os.Stdout, proto)
+		}
+	}
+
+	if !found {
+		fmt.Fprintf(os.Stderr, "❌ Protocol %q not found in %s\n", *protocolID, *patternFile)
+		return 1
+	}
+	if errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+type lintIssue struct {
+	severity string // "error" or "warning"
+	message  string
+}
+
+func lintStateMachine(proto Protocol) []lintIssue {
+	var issues []lintIssue
+	sm := proto.StateMachine
+
+	defined := make(map[string]bool)
+	for _, state := range sm.States {
+		if defined[state.Name] {
+			issues = append(issues, lintIssue{"error", fmt.Sprintf("state %q is defined more than once", state.Name)})
+		}
+		defined[state.Name] = true
+	}
+
+	if sm.InitialState == "" {
+		issues = append(issues, lintIssue{"error", "initial_state is not set"})
+	} else if !defined[sm.InitialState] {
+		issues = append(issues, lintIssue{"error", fmt.Sprintf("initial_state %q is not defined", sm.InitialState)})
+	}
+
+	packets := make(map[string]bool)
+	for _, name := range packetNames(proto) {
+		packets[name] = true
+	}
+
+	for _, state := range sm.States {
+		exits := 0
+		for i, tr := range state.Transitions {
+			target := transitionTarget(state, tr)
+			if !defined[target] {
+				issues = append(issues, lintIssue{"error", fmt.Sprintf("state %q transition %d: next_state %q is not defined", state.Name, i, target)})
+			}
+			if target != state.Name || tr.Action.Close {
+				exits++
+			}
+			switch tr.Trigger.Type {
+			case "", "data":
+			case "timeout", "interval", "idle":
+				if _, ok := triggerDuration(tr.Trigger); !ok {
+					issues = append(issues, lintIssue{"error", fmt.Sprintf("state %q transition %d: %s trigger needs a positive duration, got %q", state.Name, i, tr.Trigger.Type, tr.Trigger.Duration)})
+				}
+			default:
+				issues = append(issues, lintIssue{"error", fmt.Sprintf("state %q transition %d: unknown trigger type %q", state.Name, i, tr.Trigger.Type)})
+			}
+			if tr.Action.SendPacket != "" && !packets[tr.Action.SendPacket] {
+				issues = append(issues, lintIssue{"error", fmt.Sprintf("state %q transition %d: send_packet %q does not exist", state.Name, i, tr.Action.SendPacket)})
+			}
+		}
+		if exits == 0 {
+			issues = append(issues, lintIssue{"warning", fmt.Sprintf("state %q has no exits", state.Name)})
+		}
+	}
+
+	if defined[sm.InitialState] {
+		reachable := reachableStates(sm)
+		for _, state := range sm.States {
+			if !reachable[state.Name] {
+				issues = append(issues, lintIssue{"warning", fmt.Sprintf("state %q is unreachable from %q", state.Name, sm.InitialState)})
+			}
+		}
+	}
+
+	return issues
+}
+
+// transitionTarget returns the state a transition leads to; an empty
+// next_state keeps the machine where it is.
+func transitionTarget(state State, tr Transition) string {
+	if tr.Action.NextState == "" {
+		return state.Name
+	}
+	return tr.Action.NextState
+}
+
+func reachableStates(sm StateMachine) map[string]bool {
+	byName := make(map[string]State)
+	for _, state := range sm.States {
+		byName[state.Name] = state
+	}
+
+	reachable := map[string]bool{sm.InitialState: true}
+	queue := []string{sm.InitialState}
+	for len(queue) > 0 {
+		state := byName[queue[0]]
+		queue = queue[1:]
+		for _, tr := range state.Transitions {
+			target := transitionTarget(state, tr)
+			if _, exists := byName[target]; exists && !reachable[target] {
+				reachable[target] = true
+				queue = append(queue, target)
+			}
+		}
+	}
+	return reachable
+}
+
+func transitionLabel(tr Transition) string {
+	var parts []string
+	trigger := tr.Trigger.Type
+	if trigger == "" {
+		trigger = "data"
+	}
+	if tr.Trigger.Conditions.DataPattern != "" {
+		trigger += fmt.Sprintf(" %q", tr.Trigger.Conditions.DataPattern)
+	}
+	if isTimerTrigger(tr.Trigger.Type) {
+		trigger += " " + tr.Trigger.Duration
+	}
+	parts = append(parts, trigger)
+	if tr.Action.SendPacket != "" {
+		parts = append(parts, "send "+tr.Action.SendPacket)
+	}
+	if tr.Action.Close {
+		parts = append(parts, "close")
+	}
+	return strings.Join(parts, " / ")
+}
+
+func writeDOT(w io.Writer, proto Protocol) {
+	sm := proto.StateMachine
+	fmt.Fprintf(w, "digraph %s {\n", dotQuote(proto.Identifier))
+	fmt.Fprintf(w, "  rankdir=LR;\n")
+	fmt.Fprintf(w, "  node [shape=ellipse];\n")
+
+	defined := make(map[string]bool)
+	for _, state := range sm.States {
+		defined[state.Name] = true
+		attrs := ""
+		if state.Description != "" {
+			attrs = fmt.Sprintf(" [tooltip=%s]", dotQuote(state.Description))
+		}
+		fmt.Fprintf(w, "  %s%s;\n", dotQuote(state.Name), attrs)
+	}
+
+	if sm.InitialState != "" {
+		fmt.Fprintf(w, "  \"__start\" [shape=point];\n")
+		fmt.Fprintf(w, "  \"__start\" -> %s;\n", dotQuote(sm.InitialState))
+	}
+
+	missing := make(map[string]bool)
+	for _, state := range sm.States {
+		for _, tr := range state.Transitions {
+			target := transitionTarget(state, tr)
+			if !defined[target] {
+				missing[target] = true
+			}
+			fmt.Fprintf(w, "  %s -> %s [label=%s];\n", dotQuote(state.Name), dotQuote(target), dotQuote(transitionLabel(tr)))
+		}
+	}
+
+	for _, name := range sortedKeys(missing) {
+		fmt.Fprintf(w, "  %s [color=red, style=dashed];\n", dotQuote(name))
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func writeMermaid(w io.Writer, proto Protocol) {
+	sm := proto.StateMachine
+	fmt.Fprintf(w, "---\ntitle: %s\n---\n", proto.Identifier)
+	fmt.Fprintf(w, "stateDiagram-v2\n")
+
+	for _, state := range sm.States {
+		if state.Description != "" {
+			fmt.Fprintf(w, "  %s : %s\n", mermaidID(state.Name), mermaidText(state.Description))
+		} else if mermaidID(state.Name) != state.Name {
+			fmt.Fprintf(w, "  state %q as %s\n", state.Name, mermaidID(state.Name))
+		}
+	}
+
+	if sm.InitialState != "" {
+		fmt.Fprintf(w, "  [*] --> %s\n", mermaidID(sm.InitialState))
+	}
+
+	for _, state := range sm.States {
+		for _, tr := range state.Transitions {
+			target := transitionTarget(state, tr)
+			fmt.Fprintf(w, "  %s --> %s : %s\n", mermaidID(state.Name), mermaidID(target), mermaidText(transitionLabel(tr)))
+		}
+		if len(state.Transitions) == 0 {
+			fmt.Fprintf(w, "  %s --> [*]\n", mermaidID(state.Name))
+		}
+	}
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func mermaidID(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if isIdentChar(s[i]) {
+			sb.WriteByte(s[i])
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	if sb.Len() == 0 {
+		return "_"
+	}
+	return sb.String()
+}
+
+func mermaidText(s string) string {
+	return strings.NewReplacer("\n", " ", ":", "#58;", ";", "#59;").Replace(s)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
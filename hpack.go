@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A small HPACK (RFC 7541) for the headers of HTTP/2 protocols. Header
+// fields are indexed and strings Huffman-coded where that is shorter, as
+// browsers do, so repeated requests shrink to a few bytes.
+
+type headerField struct {
+	name, value string
+}
+
+// hpackStatic is the static table (RFC 7541 Appendix A), index 1 first.
+var hpackStatic = []headerField{
+	{":authority", ""}, {":method", "GET"}, {":method", "POST"}, {":path", "/"},
+	{":path", "/index.html"}, {":scheme", "http"}, {":scheme", "https"},
+	{":status", "200"}, {":status", "204"}, {":status", "206"}, {":status", "304"},
+	{":status", "400"}, {":status", "404"}, {":status", "500"},
+	{"accept-charset", ""}, {"accept-encoding", "gzip, deflate"}, {"accept-language", ""},
+	{"accept-ranges", ""}, {"accept", ""}, {"access-control-allow-origin", ""}, {"age", ""},
+	{"allow", ""}, {"authorization", ""}, {"cache-control", ""}, {"content-disposition", ""},
+	{"content-encoding", ""}, {"content-language", ""}, {"content-length", ""},
+	{"content-location", ""}, {"content-range", ""}, {"content-type", ""}, {"cookie", ""},
+	{"date", ""}, {"etag", ""}, {"expect", ""}, {"expires", ""}, {"from", ""}, {"host", ""},
+	{"if-match", ""}, {"if-modified-since", ""}, {"if-none-match", ""}, {"if-range", ""},
+	{"if-unmodified-since", ""}, {"last-modified", ""}, {"link", ""}, {"location", ""},
+	{"max-forwards", ""}, {"proxy-authenticate", ""}, {"proxy-authorization", ""},
+	{"range", ""}, {"referer", ""}, {"refresh", ""}, {"retry-after", ""}, {"server", ""},
+	{"set-cookie", ""}, {"strict-transport-security", ""}, {"transfer-encoding", ""},
+	{"user-agent", ""}, {"vary", ""}, {"via", ""}, {"www-authenticate", ""},
+}
+
+const hpackTableSize = 4096 // the default SETTINGS_HEADER_TABLE_SIZE
+
+// hpackTable is the dynamic table of one direction, newest entry first.
+type hpackTable struct {
+	entries []headerField
+	size    int
+	max     int
+}
+
+func newHpackTable() hpackTable {
+	return hpackTable{max: hpackTableSize}
+}
+
+// entrySize counts an entry as RFC 7541 4.1 does.
+func entrySize(f headerField) int {
+	return len(f.name) + len(f.value) + 32
+}
+
+func (t *hpackTable) add(f headerField) {
+	t.entries = append([]headerField{f}, t.entries...)
+	t.size += entrySize(f)
+	t.evict()
+}
+
+func (t *hpackTable) setMax(max int) {
+	t.max = max
+	t.evict()
+}
+
+func (t *hpackTable) evict() {
+	for t.size > t.max && len(t.entries) > 0 {
+		last := len(t.entries) - 1
+		t.size -= entrySize(t.entries[last])
+		t.entries = t.entries[:last]
+	}
+}
+
+// field returns the entry at index, counting the static table first.
+func (t *hpackTable) field(index int) (headerField, bool) {
+	switch {
+	case index <= 0:
+		return headerField{}, false
+	case index <= len(hpackStatic):
+		return hpackStatic[index-1], true
+	case index-len(hpackStatic) <= len(t.entries):
+		return t.entries[index-len(hpackStatic)-1], true
+	}
+	return headerField{}, false
+}
+
+// search returns the index of an entry matching f, and whether the value
+// matches too; 0 if not even the name does.
+func (t *hpackTable) search(f headerField) (int, bool) {
+	nameIndex := 0
+	all := append(hpackStatic[:len(hpackStatic):len(hpackStatic)], t.entries...)
+	for i, entry := range all {
+		if entry.name != f.name {
+			continue
+		}
+		if entry.value == f.value {
+			return i + 1, true
+		}
+		if nameIndex == 0 {
+			nameIndex = i + 1
+		}
+	}
+	return nameIndex, false
+}
+
+type hpackEncoder struct {
+	table hpackTable
+	// sizeUpdate is a smaller table size the peer asked for, announced at
+	// the start of the next header block
+	sizeUpdate int
+}
+
+func newHpackEncoder() *hpackEncoder {
+	return &hpackEncoder{table: newHpackTable(), sizeUpdate: -1}
+}
+
+// limit follows the peer's SETTINGS_HEADER_TABLE_SIZE, up to the default.
+func (e *hpackEncoder) limit(size int) {
+	if size > hpackTableSize {
+		size = hpackTableSize
+	}
+	if size != e.table.max {
+		e.table.setMax(size)
+		e.sizeUpdate = size
+	}
+}
+
+// encode makes a header block: indexed fields where the tables hold them,
+// literals with incremental indexing otherwise.
+func (e *hpackEncoder) encode(fields []headerField) []byte {
+	var block []byte
+	if e.sizeUpdate >= 0 {
+		block = appendHpackInt(block, 5, 0x20, uint64(e.sizeUpdate))
+		e.sizeUpdate = -1
+	}
+	for _, f := range fields {
+		index, exact := e.table.search(f)
+		if exact {
+			block = appendHpackInt(block, 7, 0x80, uint64(index))
+			continue
+		}
+		block = appendHpackInt(block, 6, 0x40, uint64(index))
+		if index == 0 {
+			block = appendHpackString(block, f.name)
+		}
+		block = appendHpackString(block, f.value)
+		e.table.add(f)
+	}
+	return block
+}
+
+type hpackDecoder struct {
+	table   hpackTable
+	limit   int // the SETTINGS_HEADER_TABLE_SIZE announced to the peer
+	maxList int // the SETTINGS_MAX_HEADER_LIST_SIZE, 0 for none
+}
+
+func newHpackDecoder() *hpackDecoder {
+	return &hpackDecoder{table: newHpackTable(), limit: hpackTableSize}
+}
+
+func (d *hpackDecoder) decode(block []byte) ([]headerField, error) {
+	var fields []headerField
+	listSize := 0 // counted as RFC 9113 6.5.2 does, which bounds what indexing expands to
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed (6.1)
+			index, n, err := readHpackInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			f, ok := d.table.field(int(index))
+			if !ok {
+				return nil, fmt.Errorf("hpack: no entry %d", index)
+			}
+			fields = append(fields, f)
+			listSize += entrySize(f)
+
+		case b&0xE0 == 0x20: // dynamic table size update (6.3)
+			size, n, err := readHpackInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.limit) {
+				return nil, fmt.Errorf("hpack: table size %d beyond %d", size, d.limit)
+			}
+			block = block[n:]
+			d.table.setMax(int(size))
+
+		default: // literals (6.2), with incremental indexing or not
+			prefix := uint(4)
+			if b&0xC0 == 0x40 {
+				prefix = 6
+			}
+			index, n, err := readHpackInt(block, prefix)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			var f headerField
+			if index > 0 {
+				named, ok := d.table.field(int(index))
+				if !ok {
+					return nil, fmt.Errorf("hpack: no entry %d", index)
+				}
+				f.name = named.name
+			} else if f.name, block, err = readHpackString(block); err != nil {
+				return nil, err
+			}
+			if f.value, block, err = readHpackString(block); err != nil {
+				return nil, err
+			}
+			if prefix == 6 {
+				d.table.add(f)
+			}
+			fields = append(fields, f)
+			listSize += entrySize(f)
+		}
+		if d.maxList > 0 && listSize > d.maxList {
+			return nil, fmt.Errorf("hpack: header list beyond %d bytes", d.maxList)
+		}
+	}
+	return fields, nil
+}
+
+// appendHpackInt encodes v with an n-bit prefix in the low bits of the first
+// byte, whose high bits are flags (RFC 7541 5.1).
+func appendHpackInt(b []byte, n uint, flags byte, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(b, flags|byte(v))
+	}
+	b = append(b, flags|byte(max))
+	for v -= max; v >= 0x80; v >>= 7 {
+		b = append(b, byte(v)|0x80)
+	}
+	return append(b, byte(v))
+}
+
+func readHpackInt(b []byte, n uint) (uint64, int, error) {
+	max := uint64(1)<<n - 1
+	v := uint64(b[0]) & max
+	if v < max {
+		return v, 1, nil
+	}
+	for i, shift := 1, uint(0); i < len(b) && shift < 63; i, shift = i+1, shift+7 {
+		v += uint64(b[i]&0x7F) << shift
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("hpack: truncated integer")
+}
+
+// appendHpackString appends a string literal, Huffman-coded if that is
+// shorter.
+func appendHpackString(b []byte, s string) []byte {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(hpackHuffmanLengths[s[i]])
+	}
+	if n := (bits + 7) / 8; n < len(s) {
+		b = appendHpackInt(b, 7, 0x80, uint64(n))
+		return appendHuffman(b, s)
+	}
+	b = appendHpackInt(b, 7, 0, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendHuffman appends the Huffman code of s, padded with the most
+// significant bits of EOS, which are all ones.
+func appendHuffman(b []byte, s string) []byte {
+	var acc uint64
+	n := 0
+	for i := 0; i < len(s); i++ {
+		length := int(hpackHuffmanLengths[s[i]])
+		acc = acc<<uint(length) | uint64(hpackHuffmanCodes[s[i]])
+		for n += length; n >= 8; n -= 8 {
+			b = append(b, byte(acc>>uint(n-8)))
+		}
+	}
+	if n > 0 {
+		b = append(b, byte(acc<<uint(8-n))|byte(0xFF>>uint(n)))
+	}
+	return b
+}
+
+// hpackHuffmanSymbols maps codes, keyed by length<<32|code, to their byte.
+var hpackHuffmanSymbols = func() map[uint64]byte {
+	symbols := make(map[uint64]byte, 256)
+	for i := range hpackHuffmanCodes {
+		symbols[uint64(hpackHuffmanLengths[i])<<32|uint64(hpackHuffmanCodes[i])] = byte(i)
+	}
+	return symbols
+}()
+
+func decodeHuffman(b []byte) (string, error) {
+	var out []byte
+	var code uint64
+	length := 0
+	for _, c := range b {
+		for bit := 7; bit >= 0; bit-- {
+			code = code<<1 | uint64(c>>uint(bit)&1)
+			length++
+			if sym, ok := hpackHuffmanSymbols[uint64(length)<<32|code]; ok {
+				out = append(out, sym)
+				code, length = 0, 0
+			} else if length >= 30 {
+				return "", errors.New("hpack: bad Huffman code")
+			}
+		}
+	}
+	// What is left must be padding: fewer than 8 one bits
+	if length >= 8 || code != 1<<uint(length)-1 {
+		return "", errors.New("hpack: bad Huffman padding")
+	}
+	return string(out), nil
+}
+
+func readHpackString(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, errors.New("hpack: truncated string")
+	}
+	huffman := b[0]&0x80 != 0
+	length, n, err := readHpackInt(b, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(b)-n) < length {
+		return "", nil, errors.New("hpack: truncated string")
+	}
+	end := n + int(length)
+	if huffman {
+		s, err := decodeHuffman(b[n:end])
+		return s, b[end:], err
+	}
+	return string(b[n:end]), b[end:], nil
+}
+
+// hpackHuffmanCodes and hpackHuffmanLengths are the Huffman code of each
+// byte (RFC 7541 Appendix B).
+var hpackHuffmanCodes = [256]uint32{
+	0x1ff8, 0x7fffd8, 0xfffffe2, 0xfffffe3, 0xfffffe4, 0xfffffe5, 0xfffffe6, 0xfffffe7,
+	0xfffffe8, 0xffffea, 0x3ffffffc, 0xfffffe9, 0xfffffea, 0x3ffffffd, 0xfffffeb, 0xfffffec,
+	0xfffffed, 0xfffffee, 0xfffffef, 0xffffff0, 0xffffff1, 0xffffff2, 0x3ffffffe, 0xffffff3,
+	0xffffff4, 0xffffff5, 0xffffff6, 0xffffff7, 0xffffff8, 0xffffff9, 0xffffffa, 0xffffffb,
+	0x14, 0x3f8, 0x3f9, 0xffa, 0x1ff9, 0x15, 0xf8, 0x7fa,
+	0x3fa, 0x3fb, 0xf9, 0x7fb, 0xfa, 0x16, 0x17, 0x18,
+	0x0, 0x1, 0x2, 0x19, 0x1a, 0x1b, 0x1c, 0x1d,
+	0x1e, 0x1f, 0x5c, 0xfb, 0x7ffc, 0x20, 0xffb, 0x3fc,
+	0x1ffa, 0x21, 0x5d, 0x5e, 0x5f, 0x60, 0x61, 0x62,
+	0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a,
+	0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72,
+	0xfc, 0x73, 0xfd, 0x1ffb, 0x7fff0, 0x1ffc, 0x3ffc, 0x22,
+	0x7ffd, 0x3, 0x23, 0x4, 0x24, 0x5, 0x25, 0x26,
+	0x27, 0x6, 0x74, 0x75, 0x28, 0x29, 0x2a, 0x7,
+	0x2b, 0x76, 0x2c, 0x8, 0x9, 0x2d, 0x77, 0x78,
+	0x79, 0x7a, 0x7b, 0x7ffe, 0x7fc, 0x3ffd, 0x1ffd, 0xffffffc,
+	0xfffe6, 0x3fffd2, 0xfffe7, 0xfffe8, 0x3fffd3, 0x3fffd4, 0x3fffd5, 0x7fffd9,
+	0x3fffd6, 0x7fffda, 0x7fffdb, 0x7fffdc, 0x7fffdd, 0x7fffde, 0xffffeb, 0x7fffdf,
+	0xffffec, 0xffffed, 0x3fffd7, 0x7fffe0, 0xffffee, 0x7fffe1, 0x7fffe2, 0x7fffe3,
+	0x7fffe4, 0x1fffdc, 0x3fffd8, 0x7fffe5, 0x3fffd9, 0x7fffe6, 0x7fffe7, 0xffffef,
+	0x3fffda, 0x1fffdd, 0xfffe9, 0x3fffdb, 0x3fffdc, 0x7fffe8, 0x7fffe9, 0x1fffde,
+	0x7fffea, 0x3fffdd, 0x3fffde, 0xfffff0, 0x1fffdf, 0x3fffdf, 0x7fffeb, 0x7fffec,
+	0x1fffe0, 0x1fffe1, 0x3fffe0, 0x1fffe2, 0x7fffed, 0x3fffe1, 0x7fffee, 0x7fffef,
+	0xfffea, 0x3fffe2, 0x3fffe3, 0x3fffe4, 0x7ffff0, 0x3fffe5, 0x3fffe6, 0x7ffff1,
+	0x3ffffe0, 0x3ffffe1, 0xfffeb, 0x7fff1, 0x3fffe7, 0x7ffff2, 0x3fffe8, 0x1ffffec,
+	0x3ffffe2, 0x3ffffe3, 0x3ffffe4, 0x7ffffde, 0x7ffffdf, 0x3ffffe5, 0xfffff1, 0x1ffffed,
+	0x7fff2, 0x1fffe3, 0x3ffffe6, 0x7ffffe0, 0x7ffffe1, 0x3ffffe7, 0x7ffffe2, 0xfffff2,
+	0x1fffe4, 0x1fffe5, 0x3ffffe8, 0x3ffffe9, 0xffffffd, 0x7ffffe3, 0x7ffffe4, 0x7ffffe5,
+	0xfffec, 0xfffff3, 0xfffed, 0x1fffe6, 0x3fffe9, 0x1fffe7, 0x1fffe8, 0x7ffff3,
+	0x3fffea, 0x3fffeb, 0x1ffffee, 0x1ffffef, 0xfffff4, 0xfffff5, 0x3ffffea, 0x7ffff4,
+	0x3ffffeb, 0x7ffffe6, 0x3ffffec, 0x3ffffed, 0x7ffffe7, 0x7ffffe8, 0x7ffffe9, 0x7ffffea,
+	0x7ffffeb, 0xffffffe, 0x7ffffec, 0x7ffffed, 0x7ffffee, 0x7ffffef, 0x7fffff0, 0x3ffffee,
+}
+
+var hpackHuffmanLengths = [256]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+}
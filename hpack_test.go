@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHpackInt(t *testing.T) {
+	// RFC 7541, appendix C.1
+	tests := []struct {
+		prefix uint
+		v      uint64
+		wire   string
+	}{
+		{5, 10, "0a"},
+		{5, 1337, "1f9a0a"},
+		{8, 42, "2a"},
+		{7, 127, "7f00"},
+		{4, 1 << 40, "0ff1ffffffff1f"},
+	}
+	for _, tt := range tests {
+		want := mustHex(t, tt.wire)
+		if got := appendHpackInt(nil, tt.prefix, 0, tt.v); !bytes.Equal(got, want) {
+			t.Errorf("%d with a %d-bit prefix = %x, want %s", tt.v, tt.prefix, got, tt.wire)
+		}
+		if v, n, err := readHpackInt(append(want, 0xff), tt.prefix); err != nil || v != tt.v || n != len(want) {
+			t.Errorf("%s reads as %d, %d bytes, %v", tt.wire, v, n, err)
+		}
+	}
+	if _, _, err := readHpackInt(mustHex(t, "1f9a"), 5); err == nil {
+		t.Error("truncated integer read")
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	// RFC 7541, appendix C.4 and C.6
+	tests := []struct{ s, wire string }{
+		{"www.example.com", "f1e3c2e5f23a6ba0ab90f4ff"},
+		{"no-cache", "a8eb10649cbf"},
+		{"custom-key", "25a849e95ba97d7f"},
+		{"custom-value", "25a849e95bb8e8b4bf"},
+		{"302", "6402"},
+		{"private", "aec3771a4b"},
+		{"Mon, 21 Oct 2013 20:13:21 GMT", "d07abe941054d444a8200595040b8166e082a62d1bff"},
+		{"https://www.example.com", "9d29ad171863c78f0b97c8e9ae82ae43d3"},
+	}
+	for _, tt := range tests {
+		want := mustHex(t, tt.wire)
+		if got := appendHuffman(nil, tt.s); !bytes.Equal(got, want) {
+			t.Errorf("%q codes as %x, want %s", tt.s, got, tt.wire)
+		}
+		if s, err := decodeHuffman(want); err != nil || s != tt.s {
+			t.Errorf("%s decodes to %q, %v", tt.wire, s, err)
+		}
+	}
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	if s, err := decodeHuffman(appendHuffman(nil, string(all))); err != nil || s != string(all) {
+		t.Errorf("every byte decodes to %q, %v", s, err)
+	}
+
+	for _, wire := range []string{"ff", "ffff", "f1e3c2e5f23a6ba0ab90f4fe", "fffffffc"} {
+		if s, err := decodeHuffman(mustHex(t, wire)); err == nil {
+			t.Errorf("%s decodes to %q", wire, s)
+		}
+	}
+}
+
+func TestHpackRequests(t *testing.T) {
+	requests := [][]headerField{
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}},
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}, {"cache-control", "no-cache"}},
+		{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"}, {"custom-key", "custom-value"}},
+	}
+	// RFC 7541, appendix C.3 without Huffman coding and C.4 with it
+	plain := []string{
+		"828684410f7777772e6578616d706c652e636f6d",
+		"828684be58086e6f2d6361636865",
+		"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+	}
+	huffman := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	tableSizes := []int{57, 110, 164}
+
+	enc := newHpackEncoder()
+	for i, want := range huffman {
+		if got := enc.encode(requests[i]); !bytes.Equal(got, mustHex(t, want)) {
+			t.Errorf("request %d encodes as %x, want %s", i+1, got, want)
+		}
+	}
+	for _, blocks := range [][]string{plain, huffman} {
+		dec := newHpackDecoder()
+		for i, block := range blocks {
+			fields, err := dec.decode(mustHex(t, block))
+			if err != nil {
+				t.Fatalf("request %d: %v", i+1, err)
+			}
+			if !equalHeaders(fields, requests[i]) {
+				t.Errorf("request %d decodes to %v", i+1, fields)
+			}
+			if dec.table.size != tableSizes[i] {
+				t.Errorf("request %d leaves a table of %d bytes, want %d", i+1, dec.table.size, tableSizes[i])
+			}
+		}
+	}
+}
+
+func TestHpackEviction(t *testing.T) {
+	// RFC 7541, appendix C.6: responses with a 256 byte table
+	responses := []struct {
+		block  string
+		fields []headerField
+		table  []headerField
+	}{
+		{
+			"488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff6e919d29ad171863c78f0b97c8e9ae82ae43d3",
+			[]headerField{{":status", "302"}, {"cache-control", "private"}, {"date", "Mon, 21 Oct 2013 20:13:21 GMT"}, {"location", "https://www.example.com"}},
+			[]headerField{{"location", "https://www.example.com"}, {"date", "Mon, 21 Oct 2013 20:13:21 GMT"}, {"cache-control", "private"}, {":status", "302"}},
+		},
+		{
+			"4883640effc1c0bf",
+			[]headerField{{":status", "307"}, {"cache-control", "private"}, {"date", "Mon, 21 Oct 2013 20:13:21 GMT"}, {"location", "https://www.example.com"}},
+			[]headerField{{":status", "307"}, {"location", "https://www.example.com"}, {"date", "Mon, 21 Oct 2013 20:13:21 GMT"}, {"cache-control", "private"}},
+		},
+		{
+			"88c16196d07abe941054d444a8200595040b8166e084a62d1bffc05a839bd9ab77ad94e7821dd7f2e6c7b335dfdfcd5b3960d5af27087f3672c1ab270fb5291f9587316065c003ed4ee5b1063d5007",
+			[]headerField{{":status", "200"}, {"cache-control", "private"}, {"date", "Mon, 21 Oct 2013 20:13:22 GMT"},
+				{"location", "https://www.example.com"}, {"content-encoding", "gzip"},
+				{"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"}},
+			[]headerField{{"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+				{"content-encoding", "gzip"}, {"date", "Mon, 21 Oct 2013 20:13:22 GMT"}},
+		},
+	}
+	dec := newHpackDecoder()
+	dec.table.setMax(256)
+	for i, r := range responses {
+		fields, err := dec.decode(mustHex(t, r.block))
+		if err != nil {
+			t.Fatalf("response %d: %v", i+1, err)
+		}
+		if !equalHeaders(fields, r.fields) {
+			t.Errorf("response %d decodes to %v", i+1, fields)
+		}
+		if !equalHeaders(dec.table.entries, r.table) {
+			t.Errorf("response %d leaves the table %v", i+1, dec.table.entries)
+		}
+	}
+}
+
+func TestHpackDecodeErrors(t *testing.T) {
+	tests := []string{
+		"be",       // no dynamic entry yet
+		"80",       // index 0
+		"3fe21f",   // a table of 4097 bytes
+		"4003",     // truncated name
+		"41ff",     // truncated length
+		"418cf1e3", // truncated value
+	}
+	for _, block := range tests {
+		if fields, err := newHpackDecoder().decode(mustHex(t, block)); err == nil {
+			t.Errorf("%s decodes to %v", block, fields)
+		}
+	}
+
+	// Indexing can't expand a block beyond the list size
+	dec := newHpackDecoder()
+	dec.maxList = 100
+	if _, err := dec.decode(mustHex(t, "8282")); err != nil {
+		t.Errorf("two fields: %v", err)
+	}
+	if _, err := dec.decode(mustHex(t, "828282")); err == nil {
+		t.Error("three fields of 42 bytes fit in 100")
+	}
+}
+
+func TestHpackSizeUpdate(t *testing.T) {
+	enc, dec := newHpackEncoder(), newHpackDecoder()
+	fields := []headerField{{"x-long", string(bytes.Repeat([]byte("v"), 100))}}
+	dec.decode(enc.encode(fields))
+
+	// A smaller table announced by the peer is signalled and evicts
+	enc.limit(64)
+	block := enc.encode(fields)
+	if block[0]&0xE0 != 0x20 {
+		t.Fatalf("block %x doesn't start with a size update", block)
+	}
+	got, err := dec.decode(block)
+	if err != nil || !equalHeaders(got, fields) {
+		t.Fatalf("decoded %v, %v", got, err)
+	}
+	if dec.table.max != 64 || len(dec.table.entries) != 0 || len(enc.table.entries) != 0 {
+		t.Errorf("tables of %d and %d entries, max %d", len(enc.table.entries), len(dec.table.entries), dec.table.max)
+	}
+}
+
+func equalHeaders(a, b []headerField) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,784 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HTTP/2 framing as RFC 9113 defines it
+const (
+	h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	h2Data         = 0x0
+	h2Headers      = 0x1
+	h2RSTStream    = 0x3
+	h2Settings     = 0x4
+	h2Ping         = 0x6
+	h2GoAway       = 0x7
+	h2WindowUpdate = 0x8
+	h2Continuation = 0x9
+
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	h2DefaultWindow    = 65535
+	h2DefaultFrameSize = 16384
+	h2MaxFrameSize     = 1<<24 - 1
+	h2MaxWindow        = 1<<31 - 1
+	h2MaxHeaderList    = 64 << 10 // taken unless MAX_HEADER_LIST_SIZE says otherwise
+)
+
+var h2SettingIDs = map[string]uint16{
+	"HEADER_TABLE_SIZE":      0x1,
+	"ENABLE_PUSH":            0x2,
+	"MAX_CONCURRENT_STREAMS": 0x3,
+	"INITIAL_WINDOW_SIZE":    0x4,
+	"MAX_FRAME_SIZE":         0x5,
+	"MAX_HEADER_LIST_SIZE":   0x6,
+}
+
+// What Chrome and nginx send after the preface unless the pattern says
+// otherwise
+var (
+	h2ClientSettings = map[string]uint32{
+		"HEADER_TABLE_SIZE":    65536,
+		"ENABLE_PUSH":          0,
+		"INITIAL_WINDOW_SIZE":  6291456,
+		"MAX_HEADER_LIST_SIZE": 262144,
+	}
+	h2ServerSettings = map[string]uint32{
+		"MAX_CONCURRENT_STREAMS": 128,
+		"INITIAL_WINDOW_SIZE":    65536,
+		"MAX_FRAME_SIZE":         16777215,
+	}
+)
+
+const h2ClientWindowUpdate = 15663105
+
+// checkHTTP2 validates the HTTP/2 settings of every protocol. HTTP/2 frames
+// only make sense as a whole connection, so TCP protocols use it alike.
+func checkHTTP2(protocols []Protocol) error {
+	with, without := "", ""
+	for _, proto := range protocols {
+		cfg := proto.HTTP2
+		if protocolTransport(&proto) != "tcp" {
+			if cfg != nil {
+				return fmt.Errorf("%s: http2 needs the tcp transport", proto.Identifier)
+			}
+			continue
+		}
+		if cfg == nil {
+			without = proto.Identifier
+			continue
+		}
+		with = proto.Identifier
+
+		if cfg.Path != "" && !strings.HasPrefix(cfg.Path, "/") {
+			return fmt.Errorf("%s: path %q doesn't start with /", proto.Identifier, cfg.Path)
+		}
+		for _, settings := range []map[string]uint32{cfg.Settings, cfg.ServerSettings} {
+			for name, v := range settings {
+				if _, ok := h2SettingIDs[name]; !ok {
+					return fmt.Errorf("%s: unknown setting %s", proto.Identifier, name)
+				}
+				if name == "INITIAL_WINDOW_SIZE" && v > h2MaxWindow ||
+					name == "MAX_FRAME_SIZE" && (v < h2DefaultFrameSize || v > h2MaxFrameSize) {
+					return fmt.Errorf("%s: %s %d is out of range", proto.Identifier, name, v)
+				}
+			}
+		}
+		for _, headers := range []map[string]string{cfg.Headers, cfg.ResponseHeaders} {
+			for name := range headers {
+				switch strings.ToLower(name) {
+				case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+					return fmt.Errorf("%s: header %s isn't allowed in HTTP/2", proto.Identifier, name)
+				}
+				if strings.HasPrefix(name, ":") {
+					return fmt.Errorf("%s: pseudo-header %s is set from method, path, authority and scheme", proto.Identifier, name)
+				}
+			}
+		}
+	}
+	if with != "" && without != "" {
+		return fmt.Errorf("%s uses http2 and %s doesn't; TCP protocols need it alike", with, without)
+	}
+	return nil
+}
+
+// http2Conn is the HTTP/2 connection a session's frames make up. The client
+// opens a request stream for the protocol it sends with, ending the
+// previous stream when the protocol changes, and the server answers on the
+// latest stream the client opened. Each side keeps within the windows the
+// other grants, and grants more as it takes data in.
+type http2Conn struct {
+	t      *TunnelNode
+	sess   *session
+	out    *frameWriter
+	client bool
+
+	settings     map[string]uint32 // sent after the preface
+	windowUpdate uint32            // connection window increment sent with them
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	closed bool
+	opened bool // the preface and SETTINGS are out
+	enc    *hpackEncoder
+	dec    *hpackDecoder
+
+	// Sending: data goes on stream, 0 until there is one
+	stream     uint32
+	nextStream uint32           // the client's next stream ID
+	answered   map[uint32]bool  // streams the server sent its response headers on
+	connWindow int64            // what the peer takes on the connection
+	windows    map[uint32]int64 // and on each open stream
+	peerWindow int64            // initial window of new streams
+	peerFrame  int              // the largest frame the peer takes
+
+	// Receiving
+	buf         []byte
+	prefaced    bool                 // the server has seen the client preface
+	streams     map[uint32]*Protocol // open streams and their protocol
+	block       []byte               // a header block awaiting CONTINUATION
+	blockStream uint32
+	blockEnd    bool             // whether its HEADERS ended the stream
+	maxFrame    int              // the MAX_FRAME_SIZE sent in SETTINGS
+	maxBlock    int              // and the MAX_HEADER_LIST_SIZE
+	recvWindow  int64            // the stream window granted in SETTINGS
+	recvConn    int64            // and the connection window
+	consumed    map[uint32]int64 // since the last WINDOW_UPDATE, 0 for the connection
+	reply       []byte           // frames answering those received
+}
+
+// http2Conn returns the HTTP/2 connection of a session, creating it on first
+// use, or nil when proto isn't an HTTP/2 protocol or the session runs over
+// UDP.
+func (t *TunnelNode) http2Conn(sess *session, proto *Protocol) *http2Conn {
+	cfg := proto.HTTP2
+	if cfg == nil || sess.transport == "udp" {
+		return nil
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.h2 == nil {
+		c := &http2Conn{
+			t:          t,
+			sess:       sess,
+			out:        sess.machine.out,
+			client:     t.mode == "client",
+			enc:        newHpackEncoder(),
+			dec:        newHpackDecoder(),
+			nextStream: 1,
+			answered:   make(map[uint32]bool),
+			connWindow: h2DefaultWindow,
+			windows:    make(map[uint32]int64),
+			peerWindow: h2DefaultWindow,
+			peerFrame:  h2DefaultFrameSize,
+			streams:    make(map[uint32]*Protocol),
+			consumed:   make(map[uint32]int64),
+		}
+		c.cond = sync.NewCond(&c.mu)
+		if c.client {
+			c.settings, c.windowUpdate = cfg.Settings, cfg.WindowUpdate
+			if c.settings == nil {
+				c.settings = h2ClientSettings
+			}
+			if c.windowUpdate == 0 {
+				c.windowUpdate = h2ClientWindowUpdate
+			}
+		} else {
+			c.settings = cfg.ServerSettings
+			if c.settings == nil {
+				c.settings = h2ServerSettings
+			}
+		}
+		c.recvWindow = h2DefaultWindow
+		if v, ok := c.settings["INITIAL_WINDOW_SIZE"]; ok {
+			c.recvWindow = int64(v)
+		}
+		c.recvConn = h2DefaultWindow + int64(c.windowUpdate)
+		if v, ok := c.settings["HEADER_TABLE_SIZE"]; ok && v > hpackTableSize {
+			c.dec.limit = int(v)
+		}
+		c.maxFrame, c.maxBlock = h2DefaultFrameSize, h2MaxHeaderList
+		if v, ok := c.settings["MAX_FRAME_SIZE"]; ok {
+			c.maxFrame = int(v)
+		}
+		if v, ok := c.settings["MAX_HEADER_LIST_SIZE"]; ok && v > 0 {
+			c.maxBlock = int(v)
+		}
+		c.dec.maxList = c.maxBlock
+		sess.h2 = c
+	}
+	return sess.h2
+}
+
+// frames builds what carries data on the connection: the client's preface
+// and SETTINGS first, HEADERS when a stream opens or is first answered, then
+// DATA frames no larger than the peer takes. It doesn't wait for the
+// windows to admit the data; send does.
+func (c *http2Conn) frames(proto *Protocol, env *exprEnv) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b []byte
+	if c.client && !c.opened {
+		c.opened = true
+		b = append(b, h2Preface...)
+		b = appendH2Settings(b, c.settings)
+		b = appendH2WindowUpdate(b, 0, c.windowUpdate)
+	}
+
+	if c.client {
+		if c.stream == 0 || c.streams[c.stream].Identifier != proto.Identifier {
+			if c.stream != 0 {
+				b = appendH2Frame(b, h2Data, h2FlagEndStream, c.stream, nil)
+				c.forget(c.stream)
+			}
+			c.stream = c.nextStream
+			c.nextStream += 2
+			c.streams[c.stream] = proto
+			c.windows[c.stream] = c.peerWindow
+			b = c.appendHeaders(b, c.stream, 0, c.t.requestHeaders(proto, env))
+		}
+	} else {
+		if c.stream == 0 {
+			if *verbose {
+				log.Printf("⚠️ Session %s: no HTTP/2 stream to answer on yet", c.sess.id)
+			}
+			return b
+		}
+		if !c.answered[c.stream] {
+			c.answered[c.stream] = true
+			b = c.appendHeaders(b, c.stream, 0, c.t.responseHeaders(c.streams[c.stream], env))
+		}
+	}
+
+	for data := env.data; len(data) > 0; {
+		n := len(data)
+		if n > c.peerFrame {
+			n = c.peerFrame
+		}
+		payload := c.t.processVPNData(env.connID, data[:n])
+		b = appendH2Frame(b, h2Data, 0, c.stream, payload)
+		c.connWindow -= int64(len(payload))
+		c.windows[c.stream] -= int64(len(payload))
+		data = data[n:]
+	}
+	return b
+}
+
+// send wraps data in frames as the windows admit it, waiting for them to
+// open, and writes them out. It returns the number of bytes framed.
+func (c *http2Conn) send(data []byte) (int, error) {
+	wrapped := 0
+	for len(data) > 0 {
+		n, err := c.reserve(len(data))
+		if err != nil {
+			return wrapped, err
+		}
+		frame := c.t.wrapData(data[:n], c.sess)
+		if err := c.out.writeFrame(frame); err != nil {
+			return wrapped, err
+		}
+		wrapped += len(frame)
+		data = data[n:]
+	}
+	return wrapped, nil
+}
+
+// reserve waits until the windows of the connection and the stream data
+// goes on admit some data, and returns how much of n they do. The server
+// waits for the client to open a stream too.
+func (c *http2Conn) reserve(n int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		window := c.connWindow
+		switch {
+		case c.stream != 0:
+			window = min(window, c.windows[c.stream])
+		case c.client:
+			window = min(window, c.peerWindow)
+		default:
+			window = 0
+		}
+		if window > 0 {
+			return int(min(int64(n), window)), nil
+		}
+		c.cond.Wait()
+	}
+}
+
+// receive takes bytes of the connection, which needn't end on a frame
+// boundary, and returns the payload of the DATA frames they complete and
+// the protocol of their stream. SETTINGS, PING and the data taken in are
+// answered at once.
+func (c *http2Conn) receive(chunk []byte) ([]byte, *Protocol, error) {
+	c.mu.Lock()
+	data, proto, err := c.parse(chunk)
+	reply, goaway := c.reply, c.closed
+	c.reply = nil
+	c.mu.Unlock()
+
+	if len(reply) > 0 {
+		if werr := c.out.writeFrame(reply); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if goaway {
+		c.sess.close()
+	}
+	return data, proto, err
+}
+
+// parse splits the buffered bytes into frames and handles them. Callers
+// hold c.mu.
+func (c *http2Conn) parse(chunk []byte) ([]byte, *Protocol, error) {
+	c.buf = append(c.buf, chunk...)
+	if !c.client && !c.prefaced {
+		n := min(len(c.buf), len(h2Preface))
+		if string(c.buf[:n]) != h2Preface[:n] {
+			return nil, nil, errors.New("no HTTP/2 connection preface")
+		}
+		if n < len(h2Preface) {
+			return nil, nil, nil
+		}
+		c.buf = c.buf[n:]
+		c.prefaced = true
+		// The server's SETTINGS are its part of the preface
+		c.opened = true
+		c.reply = appendH2Settings(c.reply, c.settings)
+		c.reply = appendH2WindowUpdate(c.reply, 0, c.windowUpdate)
+	}
+
+	var data []byte
+	var proto *Protocol
+	for len(c.buf) >= 9 {
+		length := int(c.buf[0])<<16 | int(c.buf[1])<<8 | int(c.buf[2])
+		if length > c.maxFrame {
+			// Refused before it is buffered
+			return data, proto, fmt.Errorf("FRAME_SIZE_ERROR: %d byte frame beyond MAX_FRAME_SIZE %d", length, c.maxFrame)
+		}
+		if len(c.buf) < 9+length {
+			break
+		}
+		kind, flags := c.buf[3], c.buf[4]
+		stream := binary.BigEndian.Uint32(c.buf[5:9]) & 0x7FFFFFFF
+		payload := c.buf[9 : 9+length]
+		c.buf = c.buf[9+length:]
+
+		got, p, err := c.handle(kind, flags, stream, payload)
+		if err != nil {
+			return data, proto, err
+		}
+		data = append(data, got...)
+		if p != nil {
+			proto = p
+		}
+	}
+	// Keep what is left of a frame without the bytes before it
+	c.buf = append([]byte(nil), c.buf...)
+	return data, proto, nil
+}
+
+// handle processes one frame and returns the payload it carries and the
+// protocol of its stream. Callers hold c.mu.
+func (c *http2Conn) handle(kind, flags byte, stream uint32, payload []byte) ([]byte, *Protocol, error) {
+	if c.block != nil && kind != h2Continuation {
+		return nil, nil, errors.New("PROTOCOL_ERROR: frame inside a header block")
+	}
+	switch kind {
+	case h2Data:
+		// Padding counts against the windows too
+		c.take(stream, len(payload))
+		body, ok := h2Unpad(flags, payload)
+		if !ok {
+			return nil, nil, errors.New("bad DATA padding")
+		}
+		proto := c.streams[stream]
+		if flags&h2FlagEndStream != 0 {
+			c.peerEnded(stream)
+		}
+		return c.t.reverseFPE(body), proto, nil
+
+	case h2Headers:
+		block, ok := h2Unpad(flags, payload)
+		if ok && flags&h2FlagPriority != 0 {
+			ok = len(block) >= 5
+			if ok {
+				block = block[5:]
+			}
+		}
+		if !ok {
+			return nil, nil, errors.New("bad HEADERS padding")
+		}
+		if len(block) > c.maxBlock {
+			return nil, nil, fmt.Errorf("header block beyond %d bytes", c.maxBlock)
+		}
+		c.block = append([]byte{}, block...)
+		c.blockStream, c.blockEnd = stream, flags&h2FlagEndStream != 0
+		if flags&h2FlagEndHeaders == 0 {
+			return nil, nil, nil
+		}
+		return c.headersDone()
+
+	case h2Continuation:
+		if stream != c.blockStream || c.block == nil {
+			return nil, nil, errors.New("CONTINUATION without HEADERS")
+		}
+		if len(c.block)+len(payload) > c.maxBlock {
+			return nil, nil, fmt.Errorf("header block beyond %d bytes", c.maxBlock)
+		}
+		c.block = append(c.block, payload...)
+		if flags&h2FlagEndHeaders == 0 {
+			return nil, nil, nil
+		}
+		return c.headersDone()
+
+	case h2Settings:
+		if flags&h2FlagAck != 0 {
+			return nil, nil, nil
+		}
+		if len(payload)%6 != 0 {
+			return nil, nil, errors.New("bad SETTINGS length")
+		}
+		for i := 0; i < len(payload); i += 6 {
+			id, v := binary.BigEndian.Uint16(payload[i:]), binary.BigEndian.Uint32(payload[i+2:])
+			switch id {
+			case h2SettingIDs["HEADER_TABLE_SIZE"]:
+				c.enc.limit(int(v))
+			case h2SettingIDs["INITIAL_WINDOW_SIZE"]:
+				if v > h2MaxWindow {
+					return nil, nil, fmt.Errorf("FLOW_CONTROL_ERROR: INITIAL_WINDOW_SIZE %d", v)
+				}
+				// Open streams' windows change by the difference
+				delta := int64(v) - c.peerWindow
+				for s := range c.windows {
+					c.windows[s] += delta
+					if c.windows[s] > h2MaxWindow {
+						return nil, nil, fmt.Errorf("FLOW_CONTROL_ERROR: INITIAL_WINDOW_SIZE %d overflows stream %d", v, s)
+					}
+				}
+				c.peerWindow = int64(v)
+			case h2SettingIDs["MAX_FRAME_SIZE"]:
+				if v < h2DefaultFrameSize || v > h2MaxFrameSize {
+					return nil, nil, fmt.Errorf("PROTOCOL_ERROR: MAX_FRAME_SIZE %d", v)
+				}
+				c.peerFrame = int(v)
+			}
+		}
+		c.reply = appendH2Frame(c.reply, h2Settings, h2FlagAck, 0, nil)
+		c.cond.Broadcast()
+
+	case h2WindowUpdate:
+		if len(payload) != 4 {
+			return nil, nil, errors.New("bad WINDOW_UPDATE length")
+		}
+		increment := int64(binary.BigEndian.Uint32(payload) & 0x7FFFFFFF)
+		if increment == 0 {
+			return nil, nil, errors.New("PROTOCOL_ERROR: WINDOW_UPDATE of 0")
+		}
+		if stream == 0 {
+			c.connWindow += increment
+			if c.connWindow > h2MaxWindow {
+				return nil, nil, errors.New("FLOW_CONTROL_ERROR: connection window beyond 2^31-1")
+			}
+		} else if _, open := c.windows[stream]; open {
+			c.windows[stream] += increment
+			if c.windows[stream] > h2MaxWindow {
+				return nil, nil, fmt.Errorf("FLOW_CONTROL_ERROR: stream %d window beyond 2^31-1", stream)
+			}
+		}
+		c.cond.Broadcast()
+
+	case h2Ping:
+		if flags&h2FlagAck == 0 {
+			c.reply = appendH2Frame(c.reply, h2Ping, h2FlagAck, 0, payload)
+		}
+
+	case h2RSTStream:
+		c.forget(stream)
+
+	case h2GoAway:
+		c.closed = true
+		c.cond.Broadcast()
+	}
+	// PRIORITY, PUSH_PROMISE and unknown frames are ignored
+	return nil, nil, nil
+}
+
+// headersDone decodes a complete header block. On the server it opens the
+// stream data is answered on, for the protocol its request is for. Callers
+// hold c.mu.
+func (c *http2Conn) headersDone() ([]byte, *Protocol, error) {
+	fields, err := c.dec.decode(c.block)
+	c.block = nil
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := c.blockStream
+	proto := c.streams[stream]
+	if !c.client {
+		proto = c.t.http2Protocol(fields)
+		c.streams[stream] = proto
+		c.windows[stream] = c.peerWindow
+		c.stream = stream
+		c.cond.Broadcast()
+	}
+	if c.blockEnd {
+		c.peerEnded(stream)
+	}
+	return nil, proto, nil
+}
+
+// take counts data received against the windows granted and grants more
+// once half of one is used. Callers hold c.mu.
+func (c *http2Conn) take(stream uint32, n int) {
+	if n == 0 {
+		return
+	}
+	c.consumed[0] += int64(n)
+	if c.consumed[0] >= c.recvConn/2 {
+		c.reply = appendH2WindowUpdate(c.reply, 0, uint32(c.consumed[0]))
+		c.consumed[0] = 0
+	}
+	if _, open := c.streams[stream]; !open {
+		return
+	}
+	c.consumed[stream] += int64(n)
+	if c.consumed[stream] >= c.recvWindow/2 {
+		c.reply = appendH2WindowUpdate(c.reply, stream, uint32(c.consumed[stream]))
+		c.consumed[stream] = 0
+	}
+}
+
+// peerEnded handles the end of the peer's side of a stream. The server ends
+// its side too, the client opens a new stream for what it sends next.
+// Callers hold c.mu.
+func (c *http2Conn) peerEnded(stream uint32) {
+	if !c.client {
+		if c.answered[stream] {
+			c.reply = appendH2Frame(c.reply, h2Data, h2FlagEndStream, stream, nil)
+		} else {
+			c.reply = c.appendHeaders(c.reply, stream, h2FlagEndStream, c.t.responseHeaders(c.streams[stream], c.sess.exprEnv(nil)))
+		}
+	}
+	c.forget(stream)
+}
+
+// forget drops a closed stream. Callers hold c.mu.
+func (c *http2Conn) forget(stream uint32) {
+	delete(c.streams, stream)
+	delete(c.windows, stream)
+	delete(c.answered, stream)
+	delete(c.consumed, stream)
+	if c.stream == stream {
+		c.stream = 0
+	}
+}
+
+// appendHeaders appends a header block as HEADERS and, if the peer's
+// frame size calls for it, CONTINUATION frames. Callers hold c.mu.
+func (c *http2Conn) appendHeaders(b []byte, stream uint32, flags byte, fields []headerField) []byte {
+	block := c.enc.encode(fields)
+	kind := byte(h2Headers)
+	for {
+		n := min(len(block), c.peerFrame)
+		if n == len(block) {
+			return appendH2Frame(b, kind, flags|h2FlagEndHeaders, stream, block)
+		}
+		b = appendH2Frame(b, kind, flags, stream, block[:n])
+		block, kind, flags = block[n:], h2Continuation, 0
+	}
+}
+
+func (c *http2Conn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+}
+
+// requestHeaders are the headers of the request opening a stream.
+func (t *TunnelNode) requestHeaders(proto *Protocol, env *exprEnv) []headerField {
+	cfg := proto.HTTP2
+	authority := cfg.Authority
+	if authority == "" && t.config.Tunnel.TLS != nil {
+		authority = t.config.Tunnel.TLS.ServerName
+	}
+	if authority == "" {
+		authority = t.serverAddr
+	}
+	scheme := cfg.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	fields := []headerField{
+		{":method", http2Method(cfg)},
+		{":authority", t.renderString(authority, env)},
+		{":scheme", scheme},
+		{":path", t.renderString(http2Path(cfg), env)},
+	}
+	return append(fields, t.headerFields(cfg.Headers, env)...)
+}
+
+// responseHeaders are the headers of the server's answer on a stream.
+func (t *TunnelNode) responseHeaders(proto *Protocol, env *exprEnv) []headerField {
+	fields := []headerField{{":status", "200"}}
+	if proto == nil {
+		return fields
+	}
+	return append(fields, t.headerFields(proto.HTTP2.ResponseHeaders, env)...)
+}
+
+// headerFields renders headers in a stable order with the lower-case names
+// HTTP/2 requires.
+func (t *TunnelNode) headerFields(headers map[string]string, env *exprEnv) []headerField {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]headerField, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, headerField{strings.ToLower(name), t.renderString(headers[name], env)})
+	}
+	return fields
+}
+
+// http2Protocol finds the protocol a request is for by its method and
+// path, comparing a path with expressions up to the first of them. It falls
+// back to the first HTTP/2 protocol.
+func (t *TunnelNode) http2Protocol(fields []headerField) *Protocol {
+	method, path := "", ""
+	for _, f := range fields {
+		switch f.name {
+		case ":method":
+			method = f.value
+		case ":path":
+			path = f.value
+		}
+	}
+
+	var fallback *Protocol
+	for i := range t.protocols {
+		proto := &t.protocols[i]
+		if proto.HTTP2 == nil {
+			continue
+		}
+		if fallback == nil {
+			fallback = proto
+		}
+		if http2Method(proto.HTTP2) != method {
+			continue
+		}
+		want := http2Path(proto.HTTP2)
+		if i := strings.Index(want, "${"); i >= 0 && strings.HasPrefix(path, want[:i]) || want == path {
+			return proto
+		}
+	}
+	return fallback
+}
+
+func http2Method(cfg *HTTP2Config) string {
+	if cfg.Method == "" {
+		return "POST"
+	}
+	return strings.ToUpper(cfg.Method)
+}
+
+func http2Path(cfg *HTTP2Config) string {
+	if cfg.Path == "" {
+		return "/"
+	}
+	return cfg.Path
+}
+
+func appendH2Frame(b []byte, kind, flags byte, stream uint32, payload []byte) []byte {
+	n := len(payload)
+	b = append(b, byte(n>>16), byte(n>>8), byte(n), kind, flags)
+	b = binary.BigEndian.AppendUint32(b, stream&0x7FFFFFFF)
+	return append(b, payload...)
+}
+
+// appendH2Settings appends a SETTINGS frame with settings in the order of
+// their identifiers.
+func appendH2Settings(b []byte, settings map[string]uint32) []byte {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return h2SettingIDs[names[i]] < h2SettingIDs[names[j]] })
+
+	var payload []byte
+	for _, name := range names {
+		payload = binary.BigEndian.AppendUint16(payload, h2SettingIDs[name])
+		payload = binary.BigEndian.AppendUint32(payload, settings[name])
+	}
+	return appendH2Frame(b, h2Settings, 0, 0, payload)
+}
+
+// appendH2WindowUpdate appends a WINDOW_UPDATE frame unless increment is 0.
+func appendH2WindowUpdate(b []byte, stream, increment uint32) []byte {
+	if increment == 0 {
+		return b
+	}
+	return appendH2Frame(b, h2WindowUpdate, 0, stream, binary.BigEndian.AppendUint32(nil, increment&0x7FFFFFFF))
+}
+
+// h2Unpad strips the padding of a PADDED frame.
+func h2Unpad(flags byte, payload []byte) ([]byte, bool) {
+	if flags&h2FlagPadded == 0 {
+		return payload, true
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, false
+	}
+	return payload[1 : len(payload)-int(payload[0])], true
+}
+
+// describeHTTP2 lists the frames in bytes of an HTTP/2 connection, for the
+// simulator. Header blocks aren't decoded, since that takes the state of
+// the connection.
+func describeHTTP2(data []byte) []string {
+	names := map[byte]string{
+		h2Data: "DATA", h2Headers: "HEADERS", 0x2: "PRIORITY", h2RSTStream: "RST_STREAM",
+		h2Settings: "SETTINGS", 0x5: "PUSH_PROMISE", h2Ping: "PING", h2GoAway: "GOAWAY",
+		h2WindowUpdate: "WINDOW_UPDATE", h2Continuation: "CONTINUATION",
+	}
+	var lines []string
+	if strings.HasPrefix(string(data), h2Preface) {
+		lines = append(lines, "    connection preface")
+		data = data[len(h2Preface):]
+	}
+	for len(data) >= 9 {
+		length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+		name, ok := names[data[3]]
+		if !ok {
+			name = fmt.Sprintf("type %#x", data[3])
+		}
+		stream := binary.BigEndian.Uint32(data[5:9]) & 0x7FFFFFFF
+		lines = append(lines, fmt.Sprintf("    %-14s stream %-3d flags %#02x  %d bytes", name, stream, data[4], length))
+		if len(data) < 9+length {
+			break
+		}
+		data = data[9+length:]
+	}
+	return lines
+}
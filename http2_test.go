@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testHTTP2Conn is the client end of an HTTP/2 connection, whose frames
+// tests feed to parse.
+func testHTTP2Conn(settings map[string]uint32) *http2Conn {
+	t := &TunnelNode{mode: "client", config: &Config{}}
+	sess := &session{id: "h2", transport: "tcp"}
+	sess.machine = &stateMachine{out: &frameWriter{}}
+	return t.http2Conn(sess, &Protocol{Identifier: "h2", HTTP2: &HTTP2Config{Settings: settings}})
+}
+
+func h2SettingsFrame(id uint16, v uint32) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, id)
+	return appendH2Frame(nil, h2Settings, 0, 0, binary.BigEndian.AppendUint32(payload, v))
+}
+
+func TestHTTP2FrameLimits(t *testing.T) {
+	c := testHTTP2Conn(nil)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The header of a frame beyond MAX_FRAME_SIZE is enough to refuse it
+	head := appendH2Frame(nil, h2Data, 0, 1, nil)
+	head[0], head[1], head[2] = 0, 0x40, 0x01
+	if _, _, err := c.parse(head); err == nil || !strings.Contains(err.Error(), "FRAME_SIZE_ERROR") {
+		t.Errorf("16385 byte frame: %v", err)
+	}
+
+	c = testHTTP2Conn(map[string]uint32{"MAX_FRAME_SIZE": 32768, "MAX_HEADER_LIST_SIZE": 100})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ping := appendH2Frame(nil, h2Ping, 0, 0, make([]byte, 8))
+	if _, _, err := c.parse(append(appendH2Frame(nil, 0xff, 0, 0, make([]byte, 20000)), ping...)); err != nil {
+		t.Fatalf("frame within MAX_FRAME_SIZE 32768: %v", err)
+	}
+	if want := appendH2Frame(nil, h2Ping, h2FlagAck, 0, make([]byte, 8)); !bytes.Equal(c.reply, want) {
+		t.Errorf("PING answered with %x", c.reply)
+	}
+
+	// Header blocks grow up to MAX_HEADER_LIST_SIZE across CONTINUATION
+	frames := appendH2Frame(nil, h2Headers, 0, 2, make([]byte, 60))
+	frames = appendH2Frame(frames, h2Continuation, 0, 2, make([]byte, 40))
+	if _, _, err := c.parse(frames); err != nil {
+		t.Fatalf("100 byte header block: %v", err)
+	}
+	if _, _, err := c.parse(appendH2Frame(nil, h2Continuation, 0, 2, []byte{0x82})); err == nil {
+		t.Error("101 byte header block taken")
+	}
+
+	c = testHTTP2Conn(nil)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	frames = appendH2Frame(nil, h2Headers, 0, 2, []byte{0x88})
+	frames = appendH2Frame(frames, h2Ping, 0, 0, make([]byte, 8))
+	if _, _, err := c.parse(frames); err == nil || !strings.Contains(err.Error(), "inside a header block") {
+		t.Errorf("PING between HEADERS and CONTINUATION: %v", err)
+	}
+}
+
+func TestHTTP2Settings(t *testing.T) {
+	c := testHTTP2Conn(nil)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.windows[1] = 1000
+
+	frames := h2SettingsFrame(h2SettingIDs["INITIAL_WINDOW_SIZE"], 70000)
+	frames = append(frames, h2SettingsFrame(h2SettingIDs["MAX_FRAME_SIZE"], 20000)...)
+	if _, _, err := c.parse(frames); err != nil {
+		t.Fatal(err)
+	}
+	if c.peerWindow != 70000 || c.windows[1] != 1000+70000-h2DefaultWindow || c.peerFrame != 20000 {
+		t.Errorf("window %d, stream window %d, frame size %d", c.peerWindow, c.windows[1], c.peerFrame)
+	}
+	if want := append(appendH2Frame(nil, h2Settings, h2FlagAck, 0, nil), appendH2Frame(nil, h2Settings, h2FlagAck, 0, nil)...); !bytes.Equal(c.reply, want) {
+		t.Errorf("SETTINGS answered with %x", c.reply)
+	}
+
+	tests := []struct {
+		frame []byte
+		want  string
+	}{
+		{h2SettingsFrame(h2SettingIDs["INITIAL_WINDOW_SIZE"], 1<<31), "FLOW_CONTROL_ERROR"},
+		{h2SettingsFrame(h2SettingIDs["INITIAL_WINDOW_SIZE"], h2MaxWindow), "overflows stream 1"},
+		{h2SettingsFrame(h2SettingIDs["MAX_FRAME_SIZE"], 16383), "PROTOCOL_ERROR"},
+		{h2SettingsFrame(h2SettingIDs["MAX_FRAME_SIZE"], 1<<24), "PROTOCOL_ERROR"},
+		{appendH2Frame(nil, h2Settings, 0, 0, make([]byte, 5)), "bad SETTINGS length"},
+	}
+	for _, tt := range tests {
+		c := testHTTP2Conn(nil)
+		c.mu.Lock()
+		c.windows[1] = 100000 // which a window of 2^31-1 overflows
+		if _, _, err := c.parse(tt.frame); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%x: error %v, want %q", tt.frame, err, tt.want)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func TestHTTP2WindowUpdate(t *testing.T) {
+	update := func(stream, increment uint32) []byte {
+		return appendH2Frame(nil, h2WindowUpdate, 0, stream, binary.BigEndian.AppendUint32(nil, increment))
+	}
+
+	c := testHTTP2Conn(nil)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.windows[1] = 10
+	if _, _, err := c.parse(append(update(0, 100), update(1, 5)...)); err != nil {
+		t.Fatal(err)
+	}
+	if c.connWindow != h2DefaultWindow+100 || c.windows[1] != 15 {
+		t.Errorf("windows %d and %d after updates", c.connWindow, c.windows[1])
+	}
+	// Windows of closed streams are left alone
+	if _, _, err := c.parse(update(3, h2MaxWindow)); err != nil || len(c.windows) != 1 {
+		t.Errorf("update of a closed stream: %v, %d windows", err, len(c.windows))
+	}
+
+	tests := []struct {
+		frame []byte
+		want  string
+	}{
+		{update(0, 0), "WINDOW_UPDATE of 0"},
+		{update(1, 0), "WINDOW_UPDATE of 0"},
+		{update(0, h2MaxWindow), "connection window"},
+		{update(1, h2MaxWindow), "stream 1 window"},
+		{appendH2Frame(nil, h2WindowUpdate, 0, 0, []byte{0, 1}), "bad WINDOW_UPDATE length"},
+	}
+	for _, tt := range tests {
+		c := testHTTP2Conn(nil)
+		c.mu.Lock()
+		c.windows[1] = 10
+		if _, _, err := c.parse(tt.frame); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%x: error %v, want %q", tt.frame, err, tt.want)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func TestHTTP2HeadersAcrossFrames(t *testing.T) {
+	server := &TunnelNode{mode: "server", config: &Config{}}
+	server.protocols = []Protocol{
+		{Identifier: "a", HTTP2: &HTTP2Config{Path: "/a"}},
+		{Identifier: "b", HTTP2: &HTTP2Config{Method: "PUT", Path: "/b/${SESSION_ID}"}},
+	}
+	sess := &session{id: "h2", transport: "tcp"}
+	sess.machine = &stateMachine{out: &frameWriter{}}
+	c := server.http2Conn(sess, &server.protocols[0])
+
+	block := newHpackEncoder().encode([]headerField{
+		{":method", "PUT"}, {":scheme", "https"}, {":path", "/b/42"}, {":authority", "example.com"},
+	})
+	frames := []byte(h2Preface)
+	frames = appendH2Frame(frames, h2Headers, 0, 1, block[:5])
+	frames = appendH2Frame(frames, h2Continuation, 0, 1, block[5:])
+	frames = appendH2Frame(frames, h2Continuation, h2FlagEndHeaders, 1, nil)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Split anywhere, even inside the preface
+	for _, chunk := range [][]byte{frames[:10], frames[10:30], frames[30:]} {
+		if _, _, err := c.parse(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.stream != 1 || c.streams[1] != &server.protocols[1] {
+		t.Errorf("stream %d opened for %v", c.stream, c.streams[1])
+	}
+}
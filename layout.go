@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteRange is a half-open range of frame offsets.
+type byteRange struct {
+	start, end int
+}
+
+func (r byteRange) len() int { return r.end - r.start }
+
+func (r byteRange) overlaps(o byteRange) bool {
+	return r.start < o.end && o.start < r.end
+}
+
+// packetBlock is a layer header or one of its chunks, placed in the frame.
+// Its fields carry their resolved offsets and sizes.
+type packetBlock struct {
+	layer    string
+	chunk    string // empty for the layer header
+	instance int    // of a repeated chunk, from 1
+	span     byteRange
+	fields   []Field
+	values   []interface{} // field values, when building
+}
+
+func (b *packetBlock) name() string {
+	switch {
+	case b.chunk == "":
+		return b.layer
+	case b.instance > 0:
+		return fmt.Sprintf("%s.%s[%d]", b.layer, b.chunk, b.instance-1)
+	}
+	return b.layer + "." + b.chunk
+}
+
+// packetLayout is a layer stack frame with the position of every block, so
+// length fields and computations can refer to other parts of the frame. The
+// builder grows the frame as blocks are added; the decoder lays blocks out
+// over a received frame.
+type packetLayout struct {
+	frame   []byte
+	grow    bool
+	end     int // end of the last block
+	blocks  []packetBlock
+	payload byteRange
+}
+
+// coverPayload extends the payload range over a field that carries it; the
+// first such field starts it. A split payload spans its first slice to its
+// last, with whatever lies between.
+func (l *packetLayout) coverPayload(pos byteRange, extend bool) {
+	if extend {
+		l.payload.end = pos.end
+	} else {
+		l.payload = pos
+	}
+}
+
+// blockDef is a layer header or chunk as declared in the stack.
+type blockDef struct {
+	layer, chunk string
+	headerSize   int
+	fields       []Field
+	spec         *Chunk // nil for layer headers
+	instance     int
+}
+
+// stackBlocks lists the blocks of a stack in frame order, each chunk once.
+// A TLV chunk has the fields of an item with a length.
+func stackBlocks(stack *LayerStack) []blockDef {
+	var blocks []blockDef
+	for _, layer := range stack.layers() {
+		blocks = append(blocks, blockDef{layer: layer.name, headerSize: layer.def.HeaderSize, fields: layer.def.Fields})
+		for i := range layer.def.Chunks {
+			chunk := &layer.def.Chunks[i]
+			def := blockDef{layer: layer.name, chunk: chunk.Name, fields: chunk.Fields, spec: chunk}
+			if chunk.TLV != nil {
+				def = tlvBlock(def, false)
+			}
+			blocks = append(blocks, def)
+		}
+	}
+	return blocks
+}
+
+// fieldSizer returns the size of a variable-length field: one with SizeFrom,
+// or of a variable type without a size, which is sized by its content. The
+// field has its offset already; placed holds the fields of the block before
+// it.
+type fieldSizer func(field Field, placed []Field) (int, bool)
+
+// addBlock places a block after the ones already laid out. A field with
+// Follow starts where the previous field ended instead of at its Offset,
+// Align rounds the start up and PadTo the end, both relative to the block,
+// and fields with SizeFrom are sized by sizer. The block is at least
+// headerSize bytes and ends after its last field.
+func (l *packetLayout) addBlock(def blockDef, sizer fieldSizer) bool {
+	start := l.end
+	placed := make([]Field, 0, len(def.fields))
+	size, prev := def.headerSize, 0
+	for _, field := range def.fields {
+		if field.Follow {
+			field.Offset = prev
+		}
+		field.Offset = alignUp(field.Offset, field.Align)
+		if isVariableField(field) {
+			n, ok := sizer(field, placed)
+			if !ok || n < 0 {
+				return false
+			}
+			field.Size = n
+		}
+		placed = append(placed, field)
+
+		prev = alignUp(field.Offset+field.Size, field.PadTo)
+		if prev > size {
+			size = prev
+		}
+	}
+
+	if l.grow && start+size > len(l.frame) {
+		l.frame = append(l.frame, make([]byte, start+size-len(l.frame))...)
+	}
+	if start+size > len(l.frame) {
+		return false
+	}
+
+	l.end = start + size
+	l.blocks = append(l.blocks, packetBlock{
+		layer:    def.layer,
+		chunk:    def.chunk,
+		instance: def.instance,
+		span:     byteRange{start, l.end},
+		fields:   placed,
+	})
+	return true
+}
+
+func alignUp(n, align int) int {
+	if align <= 1 {
+		return n
+	}
+	return (n + align - 1) / align * align
+}
+
+// bytes returns the block's part of the frame. Writes go to the frame; the
+// capacity is capped so appending to it never does.
+func (l *packetLayout) bytes(b *packetBlock) []byte {
+	return l.frame[b.span.start:b.span.end:b.span.end]
+}
+
+// fieldRef is a field located by name.
+type fieldRef struct {
+	block *packetBlock // nil for the block being placed
+	index int
+	field Field
+	span  byteRange
+}
+
+// lookupField finds the field a size_from names while a block is being
+// placed: among the fields placed so far, then in earlier blocks, nearest
+// first.
+func (l *packetLayout) lookupField(placed []Field, name string) (fieldRef, bool) {
+	for i := len(placed) - 1; i >= 0; i-- {
+		if placed[i].Name == name {
+			start := l.end + placed[i].Offset
+			return fieldRef{nil, i, placed[i], byteRange{start, start + placed[i].Size}}, true
+		}
+	}
+	for b := len(l.blocks) - 1; b >= 0; b-- {
+		if ref, ok := l.blocks[b].find(name); ok {
+			return ref, true
+		}
+	}
+	return fieldRef{}, false
+}
+
+func (b *packetBlock) find(name string) (fieldRef, bool) {
+	for i, field := range b.fields {
+		if field.Name == name {
+			start := b.span.start + field.Offset
+			return fieldRef{b, i, field, byteRange{start, start + field.Size}}, true
+		}
+	}
+	return fieldRef{}, false
+}
+
+// layerSpan covers a layer's header and chunks.
+func (l *packetLayout) layerSpan(layer string) (byteRange, bool) {
+	span, found := byteRange{}, false
+	for _, b := range l.blocks {
+		if b.layer != layer {
+			continue
+		}
+		if !found {
+			span, found = b.span, true
+		}
+		span.end = b.span.end
+	}
+	return span, found
+}
+
+// part finds a layer's header ("header") or one of its chunks, which covers
+// every instance of a repeated chunk.
+func (l *packetLayout) part(layer, name string) (byteRange, bool) {
+	if name == "header" {
+		name = ""
+	}
+	span, found := byteRange{}, false
+	for _, b := range l.blocks {
+		if b.layer == layer && b.chunk == name {
+			if !found {
+				span, found = b.span, true
+			}
+			span.end = b.span.end
+		}
+	}
+	return span, found
+}
+
+// scope resolves the part of the frame a computation scope or length
+// reference names, as seen from a field in block b:
+//
+//	header, layer, chunk   the field's layer header, layer or chunk
+//	chunk:NAME             a chunk of the field's layer, or of any layer
+//	field:NAME             a field of the field's block, or of any block
+//	following              everything after the field's layer
+//	payload                the VPN data
+//	all                    from the field's block to the end
+//	layerN                 a layer with its chunks
+//	layerN.header          a layer's fixed part
+//	layerN.NAME            one of a layer's chunks
+//	start, end             the empty ranges at either end of the frame
+//	A..B                   from the start of A to the end of B
+//	N:M                    offsets from the field's block; M < 0 counts
+//	                       back from the end of the frame
+//
+// An empty scope is the field's block.
+func (l *packetLayout) scope(b *packetBlock, scope string) (byteRange, bool) {
+	layer, _ := l.layerSpan(b.layer)
+
+	switch scope {
+	case "":
+		return b.span, true
+	case "header":
+		return l.part(b.layer, "header")
+	case "layer":
+		return layer, true
+	case "chunk":
+		return b.span, true
+	case "following":
+		return byteRange{layer.end, len(l.frame)}, true
+	case "payload", "data":
+		return l.payload, true
+	case "all":
+		return byteRange{b.span.start, len(l.frame)}, true
+	case "start":
+		return byteRange{0, 0}, true
+	case "end":
+		return byteRange{len(l.frame), len(l.frame)}, true
+	}
+
+	if from, to, ok := strings.Cut(scope, ".."); ok {
+		first, ok1 := l.scope(b, from)
+		last, ok2 := l.scope(b, to)
+		if !ok1 || !ok2 || first.start > last.end {
+			return byteRange{}, false
+		}
+		return byteRange{first.start, last.end}, true
+	}
+
+	if name, ok := strings.CutPrefix(scope, "field:"); ok {
+		if ref, ok := b.find(name); ok {
+			return ref.span, true
+		}
+		for i := range l.blocks {
+			if ref, ok := l.blocks[i].find(name); ok {
+				return ref.span, true
+			}
+		}
+		return byteRange{}, false
+	}
+
+	if name, ok := strings.CutPrefix(scope, "chunk:"); ok {
+		if span, ok := l.part(b.layer, name); ok {
+			return span, true
+		}
+		for _, o := range l.blocks {
+			if o.chunk == name {
+				return l.part(o.layer, name)
+			}
+		}
+		return byteRange{}, false
+	}
+
+	if from, to, ok := strings.Cut(scope, ":"); ok {
+		start, err1 := strconv.Atoi(from)
+		end, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil {
+			return byteRange{}, false
+		}
+		start += b.span.start
+		if end < 0 {
+			end += len(l.frame)
+		} else {
+			end += b.span.start
+		}
+		if start < 0 || start > end || end > len(l.frame) {
+			// Valid, but past what this frame holds: covers nothing
+			return byteRange{}, true
+		}
+		return byteRange{start, end}, true
+	}
+
+	if name, part, ok := strings.Cut(scope, "."); ok {
+		return l.part(name, part)
+	}
+	return l.layerSpan(scope)
+}
+
+// length computes the value of a length field.
+func (l *packetLayout) length(b *packetBlock, cfg *LengthConfig) int64 {
+	total := 0
+	for _, ref := range cfg.Of {
+		if span, ok := l.scope(b, ref); ok {
+			total += span.len()
+		}
+	}
+	if cfg.Unit > 1 {
+		total = (total + cfg.Unit - 1) / cfg.Unit
+	}
+	return int64(total + cfg.Adjust)
+}
+
+// layoutField is a field together with the block it belongs to.
+type layoutField struct {
+	block *packetBlock
+	field Field
+}
+
+// position is where the field's own bytes are in the frame.
+func (f layoutField) position() byteRange {
+	start := f.block.span.start + f.field.Offset
+	return byteRange{start, start + f.field.Size}
+}
+
+// computationOrder sorts computed fields so that each one runs after the
+// computed fields inside the bytes it covers: an Ethernet FCS after the IP
+// and TCP checksums, a TCP checksum after a MAC carried in the payload.
+// Fields that cover each other keep their declaration order.
+func (t *TunnelNode) computationOrder(l *packetLayout, fields []layoutField) []layoutField {
+	covers := make([]byteRange, len(fields))
+	for i, f := range fields {
+		covers[i], _ = l.scope(f.block, f.field.Computation.Scope)
+	}
+
+	done := make([]bool, len(fields))
+	ordered := make([]layoutField, 0, len(fields))
+	for len(ordered) < len(fields) {
+		next := -1
+		for i := range fields {
+			if done[i] {
+				continue
+			}
+			if next == -1 {
+				next = i // fallback for cycles
+			}
+			ready := true
+			for j := range fields {
+				if j != i && !done[j] && covers[i].overlaps(fields[j].position()) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		done[next] = true
+		ordered = append(ordered, fields[next])
+	}
+	return ordered
+}
+
+// applyComputation computes a field over its scope and writes it. Digests
+// longer than the field are truncated to their leftmost bytes.
+func (t *TunnelNode) applyComputation(l *packetLayout, f layoutField, env *exprEnv) {
+	scope, _ := l.scope(f.block, f.field.Computation.Scope)
+	value := t.computeUniversalChecksum(f.field.Computation, l.frame[scope.start:scope.end], env)
+	if digest, ok := value.([]byte); ok {
+		value = fitDigest(f.field, digest)
+	}
+	t.setValue(l.bytes(f.block), f.field, value)
+}
+
+func fitDigest(field Field, digest []byte) interface{} {
+	if len(digest) > field.Size {
+		digest = digest[:field.Size]
+	}
+	if field.Type == "bytes" || field.Type == "string" {
+		return digest
+	}
+	var v int64
+	for _, b := range digest {
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// verifyComputations recomputes the computed fields of a received frame the
+// way the sender did: in the same order, each seeing the fields computed
+// before it and zeros for the rest. It returns the fields that don't match,
+// leaving out checksums over the connection's addresses.
+func (t *TunnelNode) verifyComputations(l *packetLayout, env *exprEnv) []string {
+	var computed []layoutField
+	for i := range l.blocks {
+		for _, field := range l.blocks[i].fields {
+			if field.Computation != nil {
+				computed = append(computed, layoutField{&l.blocks[i], field})
+			}
+		}
+	}
+	if len(computed) == 0 {
+		return nil
+	}
+
+	replay := *l
+	replay.frame = append([]byte(nil), l.frame...)
+	for _, f := range computed {
+		pos := f.position()
+		clear(replay.frame[pos.start:pos.end])
+	}
+
+	var mismatched []string
+	for _, f := range t.computationOrder(&replay, computed) {
+		t.applyComputation(&replay, f, env)
+		pos := f.position()
+		if !bytes.Equal(replay.frame[pos.start:pos.end], l.frame[pos.start:pos.end]) {
+			if !pseudoHeaderFromConnection(f.field.Computation) {
+				mismatched = append(mismatched, f.block.name()+"."+f.field.Name)
+			}
+			copy(replay.frame[pos.start:pos.end], l.frame[pos.start:pos.end])
+		}
+	}
+	return mismatched
+}
+
+// checkLayerStacks reports size_from references to fields that aren't placed
+// before, and computation scopes and length references that name nothing in
+// their stack.
+func checkLayerStacks(protocols []Protocol) error {
+	for _, proto := range protocols {
+		if proto.LayerStack == nil {
+			continue
+		}
+
+		layout := &packetLayout{grow: true}
+		for _, def := range stackBlocks(proto.LayerStack) {
+			where := def.layer
+			if def.chunk != "" {
+				where += "." + def.chunk
+			}
+			if def.spec != nil {
+				if err := checkChunk(layout, def.spec); err != nil {
+					return fmt.Errorf("%s: %s: %v", proto.Identifier, where, err)
+				}
+			}
+			var err error
+			layout.addBlock(def, func(field Field, placed []Field) (int, bool) {
+				if field.SizeFrom == "" || field.SizeFrom == "content" {
+					return 0, true
+				}
+				if _, ok := layout.lookupField(placed, field.SizeFrom); !ok && err == nil {
+					err = fmt.Errorf("%s: %s.%s: size_from %q names no earlier field", proto.Identifier, where, field.Name, field.SizeFrom)
+				}
+				return 0, true
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range layout.blocks {
+			block := &layout.blocks[i]
+			for _, field := range block.fields {
+				if field.Type == "bitfield" {
+					if field.BitOrder != "" && field.BitOrder != "lsb" && field.BitOrder != "msb" {
+						return fmt.Errorf("%s: %s.%s: bit_order must be \"lsb\" or \"msb\"", proto.Identifier, block.name(), field.Name)
+					}
+					for name, bits := range field.Bits {
+						if bits.Size < 1 || bits.Size > 64 || bits.Position < 0 || bits.Position+bits.Size > field.Size*8 {
+							return fmt.Errorf("%s: %s.%s: bits %q do not fit in %d bytes", proto.Identifier, block.name(), field.Name, name, field.Size)
+						}
+					}
+				}
+
+				var refs []string
+				if field.Length != nil {
+					if len(field.Length.Of) == 0 {
+						return fmt.Errorf("%s: %s.%s: length has no \"of\"", proto.Identifier, block.name(), field.Name)
+					}
+					refs = field.Length.Of
+				}
+				if field.Computation != nil {
+					refs = append(refs, field.Computation.Scope)
+				}
+				for _, ref := range refs {
+					if _, ok := layout.scope(block, ref); !ok {
+						return fmt.Errorf("%s: %s.%s: unknown scope %q", proto.Identifier, block.name(), field.Name, ref)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// testLayerStack parses a layer stack and checks it as loading a pattern
+// does.
+func testLayerStack(t *testing.T, src string) *Protocol {
+	t.Helper()
+	protocols := []Protocol{{Identifier: "p", LayerStack: &LayerStack{}}}
+	if err := json.Unmarshal([]byte(src), protocols[0].LayerStack); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLayerStacks(protocols); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkComputations(protocols); err != nil {
+		t.Fatal(err)
+	}
+	return &protocols[0]
+}
+
+// layoutRoundTrip builds a frame of proto carrying data, with vars set in
+// the session, and has the receiver take the payload out of it again.
+func layoutRoundTrip(t *testing.T, proto *Protocol, vars map[string]interface{}, data []byte) ([]byte, *decodedFrame) {
+	t.Helper()
+	node := &TunnelNode{}
+	sess, _ := newSessionStore(0, 0).create("layout", nil)
+	sess.setVariables(vars)
+	frame := node.build("request", &packetContext{env: sess.exprEnv(data), sess: sess, proto: proto})
+	got, decoded, ok := node.extractVPNDataFromLayers(frame, proto, sess)
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatalf("frame %x carries %q, %v; want %q", frame, got, ok, data)
+	}
+	return frame, decoded
+}
+
+// decodedInt returns the value of a received integer field.
+func decodedInt(t *testing.T, d *decodedFrame, layer, name string) int64 {
+	t.Helper()
+	for _, f := range d.fields {
+		if f.layer == layer && f.name == name {
+			if v, ok := f.value.(int64); ok {
+				return v
+			}
+		}
+	}
+	t.Fatalf("no integer field %s.%s", layer, name)
+	return 0
+}
+
+// checkTruncated feeds the receiver every prefix of frame shorter than n,
+// which must not decode.
+func checkTruncated(t *testing.T, proto *Protocol, frame []byte, n int) {
+	t.Helper()
+	node := &TunnelNode{}
+	for i := 0; i < n; i++ {
+		if _, ok := node.decodeLayerStack(proto.LayerStack, frame[:i], &exprEnv{}); ok {
+			t.Errorf("%d of %d bytes decode", i, len(frame))
+		}
+	}
+}
+
+func TestLayoutLengths(t *testing.T) {
+	// The checksum comes first but covers the lengths, so they are filled
+	// before it
+	proto := testLayerStack(t, `{
+	 "layer3_ipv4": {"header_size": 8, "fields": [
+	  {"name": "sum", "offset": 6, "size": 2, "type": "uint16_be", "computation": {"algorithm": "checksum", "scope": "layer"}},
+	  {"name": "total", "offset": 0, "size": 2, "type": "uint16_be", "length": {"of": ["layer", "following"]}},
+	  {"name": "words", "offset": 2, "size": 1, "type": "uint8", "length": {"of": ["layer"], "unit": 4}},
+	  {"name": "payload_words", "offset": 3, "size": 1, "type": "uint8", "length": {"of": ["payload"], "unit": 4}},
+	  {"name": "rest", "offset": 4, "size": 2, "type": "uint16_be", "length": {"of": ["header", "chunk:opts"], "adjust": -3}}]},
+	 "layer4": {"header_size": 4, "fields": [
+	  {"name": "len", "offset": 0, "size": 2, "type": "uint16_be", "length": {"of": ["layer", "payload"]}},
+	  {"name": "opts_len", "offset": 2, "size": 1, "type": "uint8", "length": {"of": ["chunk:opts"]}}],
+	  "chunks": [{"name": "opts", "fields": [{"name": "kind", "offset": 0, "size": 3, "type": "bytes", "value": "abc"}]}]}}`)
+
+	frame, decoded := layoutRoundTrip(t, proto, nil, []byte("hello"))
+	want := mustHex(t, "00140202"+"0008"+"fde1"+"000c0300"+"616263"+"68656c6c6f")
+	if !bytes.Equal(frame, want) {
+		t.Errorf("frame %x, want %x", frame, want)
+	}
+	if computeInternetChecksum(frame[:8], nil) != 0 {
+		t.Errorf("checksum %x doesn't cover the lengths", frame[6:8])
+	}
+	if n := decodedInt(t, decoded, "layer3", "total"); n != int64(len(frame)) {
+		t.Errorf("total length %d of %d bytes", n, len(frame))
+	}
+	checkTruncated(t, proto, frame, 8+4+3)
+
+	// An empty payload is a length of 0, not a missing one
+	frame, _ = layoutRoundTrip(t, proto, nil, nil)
+	if !bytes.Equal(frame[:4], mustHex(t, "000f0200")) || !bytes.Equal(frame[8:10], mustHex(t, "0007")) {
+		t.Errorf("frame without payload %x", frame)
+	}
+}
+
+func TestLayoutScopes(t *testing.T) {
+	// layer2 0-4, layer3 4-8 with its chunk opt 8-10, layer4 10-14, payload 14-17
+	l := &packetLayout{grow: true}
+	place := func(layer, chunk string, fields ...Field) {
+		l.addBlock(blockDef{layer: layer, chunk: chunk, fields: fields}, nil)
+	}
+	place("layer2", "", Field{Name: "mac", Size: 4})
+	place("layer3", "", Field{Name: "x", Size: 2}, Field{Name: "y", Offset: 2, Size: 2})
+	place("layer3", "opt", Field{Name: "o", Size: 2})
+	place("layer4", "", Field{Name: "sum", Size: 4})
+	l.frame = append(l.frame, "abc"...)
+	l.payload = byteRange{14, 17}
+	layer3, layer4 := &l.blocks[1], &l.blocks[3]
+
+	tests := []struct {
+		from  *packetBlock
+		scope string
+		want  byteRange
+	}{
+		{layer4, "", byteRange{10, 14}},
+		{layer3, "header", byteRange{4, 8}},
+		{layer3, "layer", byteRange{4, 10}},
+		{&l.blocks[2], "chunk", byteRange{8, 10}},
+		{layer3, "following", byteRange{10, 17}},
+		{layer4, "payload", byteRange{14, 17}},
+		{layer3, "all", byteRange{4, 17}},
+		{layer4, "start", byteRange{0, 0}},
+		{layer4, "end", byteRange{17, 17}},
+		{layer4, "layer3", byteRange{4, 10}},
+		{layer4, "layer3.header", byteRange{4, 8}},
+		{layer4, "layer3.opt", byteRange{8, 10}},
+		{layer4, "chunk:opt", byteRange{8, 10}},
+		{layer4, "field:y", byteRange{6, 8}},
+		{layer4, "layer4..end", byteRange{10, 17}},
+		{layer4, "layer2..layer3", byteRange{0, 10}},
+		{layer4, "start..layer3.header", byteRange{0, 8}},
+		{layer4, "0:2", byteRange{10, 12}},
+		{layer4, "2:-1", byteRange{12, 16}},
+		{layer4, "2:20", byteRange{}}, // past the frame: nothing
+	}
+	for _, tt := range tests {
+		got, ok := l.scope(tt.from, tt.scope)
+		if !ok || got != tt.want {
+			t.Errorf("%q from %s = %v, %v; want %v", tt.scope, tt.from.name(), got, ok, tt.want)
+		}
+	}
+
+	for _, scope := range []string{"layer5", "layer3.nosuch", "chunk:nosuch", "field:nosuch", "layer4..layer2", "a:b"} {
+		if got, ok := l.scope(layer4, scope); ok {
+			t.Errorf("%q = %v", scope, got)
+		}
+	}
+}
+
+func TestLayoutCrossLayerChecksum(t *testing.T) {
+	// A TCP-style checksum over its own layer, the layers above and the
+	// payload, and a frame check sequence below it over everything
+	proto := testLayerStack(t, `{
+	 "layer2_ethernet": {"header_size": 4, "fields": [
+	  {"name": "fcs", "offset": 0, "size": 4, "type": "uint32_be", "computation": {"algorithm": "crc32", "scope": "layer3..end"}}]},
+	 "layer3_ipv4": {"header_size": 2, "fields": [
+	  {"name": "ttl", "offset": 0, "size": 1, "type": "uint8", "value": 64}]},
+	 "layer4": {"header_size": 4, "fields": [
+	  {"name": "port", "offset": 0, "size": 2, "type": "uint16_be", "value": 443},
+	  {"name": "sum", "offset": 2, "size": 2, "type": "uint16_be", "computation": {"algorithm": "checksum", "scope": "layer4..end"}}]},
+	 "layer7": {"header_size": 2, "fields": [
+	  {"name": "kind", "offset": 0, "size": 2, "type": "uint16_be", "value": 7}]}}`)
+
+	frame, decoded := layoutRoundTrip(t, proto, nil, []byte("data"))
+	if len(frame) != 4+2+4+2+4 {
+		t.Fatalf("frame %x", frame)
+	}
+	if computeInternetChecksum(frame[6:], nil) != 0 {
+		t.Errorf("checksum %x doesn't cover layer4 to the end of %x", frame[8:10], frame)
+	}
+	if crc, _ := computeCRC(frame[4:], "crc32", nil); uint64(crc.(uint32)) != uint64(decodedInt(t, decoded, "layer2", "fcs")) {
+		t.Errorf("FCS %x isn't the CRC of %x, which includes the checksum", frame[:4], frame[4:])
+	}
+
+	node := &TunnelNode{}
+	for i := 4; i < len(frame); i++ {
+		tampered := bytes.Clone(frame)
+		tampered[i] ^= 0x80
+		if d, ok := node.decodeLayerStack(proto.LayerStack, tampered, &exprEnv{}); !ok || len(d.mismatched) == 0 {
+			t.Errorf("byte %d changed, frame still verifies", i)
+		}
+	}
+}
+
+func TestLayoutVariableFields(t *testing.T) {
+	proto := testLayerStack(t, `{"layer7": {"fields": [
+	  {"name": "name_len", "offset": 0, "size": 1, "type": "uint8", "length": {"of": ["field:name"]}},
+	  {"name": "name", "follow": true, "type": "string", "size_from": "name_len", "value": "${host}"},
+	  {"name": "flags", "follow": true, "align": 4, "size": 2, "type": "uint16_be", "value": 258},
+	  {"name": "text", "follow": true, "type": "string", "size_from": "content", "terminator": "\r\n", "value": "abc"},
+	  {"name": "data_len", "follow": true, "size": 2, "pad_to": 8, "type": "uint16_be", "length": {"of": ["field:data"], "adjust": 1}},
+	  {"name": "data", "follow": true, "type": "bytes", "size_from": "data_len", "value": "<<VPN_DATA>>"},
+	  {"name": "tail", "follow": true, "size": 1, "type": "uint8", "value": 255}]}}`)
+
+	tests := []struct {
+		host, data string
+		want       string
+	}{
+		{
+			"example.org", "hi",
+			"0b" + "6578616d706c652e6f7267" + "0102" + "6162630d0a" + "0003" + "000000" + "6869" + "ff",
+		},
+		{
+			"a", "",
+			"01" + "61" + "0000" + "0102" + "6162630d0a" + "0001" + "000000" + "ff",
+		},
+	}
+	for _, tt := range tests {
+		frame, decoded := layoutRoundTrip(t, proto, map[string]interface{}{"host": tt.host}, []byte(tt.data))
+		if want := mustHex(t, tt.want); !bytes.Equal(frame, want) {
+			t.Errorf("host %q: frame %x, want %x", tt.host, frame, want)
+		}
+		for _, f := range decoded.fields {
+			if f.name == "name" && f.value != tt.host || f.name == "text" && f.value != "abc" {
+				t.Errorf("host %q: %s decodes as %v", tt.host, f.name, f.value)
+			}
+		}
+		if n := decodedInt(t, decoded, "layer7", "tail"); n != 255 {
+			t.Errorf("host %q: tail %d", tt.host, n)
+		}
+		checkTruncated(t, proto, frame, len(frame))
+	}
+}
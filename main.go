@@ -1,11 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
 	"time"
 )
 
@@ -17,9 +16,19 @@ var (
 	listenPort = flag.String("port", "2020", "Listen port for client mode")
 	serverAddr = flag.String("server", "", "Server address for client mode (e.g., example.com:443)")
 	vpnServer  = flag.String("vpn-server", "127.0.0.1:4040", "VPN server address for server mode")
+	vpnNetwork = flag.String("vpn-network", "", "VPN traffic network, tcp or udp (default from the pattern's tunnel, else tcp)")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "graph":
+			os.Exit(runGraph(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
 	log.Printf("🚀 Universal Protocol Tunnel v3.2")
@@ -29,18 +38,9 @@ func main() {
 		log.Fatalf("❌ Client mode requires -server parameter")
 	}
 
-	data, err := ioutil.ReadFile(*pattern)
+	config, err := loadConfig(*pattern)
 	if err != nil {
-		log.Fatalf("❌ Failed to read pattern: %v", err)
-	}
-
-	config := &Config{}
-	if err := json.Unmarshal(data, config); err != nil {
-		log.Fatalf("❌ Failed to parse JSON: %v", err)
-	}
-
-	if len(config.Protocols) == 0 {
-		log.Fatalf("❌ No protocols found in config")
+		log.Fatalf("❌ %v", err)
 	}
 
 	tunnel := NewTunnelNode(config, *mode, *listenPort, *serverAddr, *vpnServer)
@@ -0,0 +1,117 @@
+// Package plugin lets other packages add computations and field types to the
+// tunnel. A package registers them from its init function and is linked in
+// with a blank import in the main package:
+//
+//	import _ "example.com/ours/tunnelalgos"
+//
+// The built-in algorithms and types are registered the same way, so a name
+// can only be taken once.
+package plugin
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Params is what a computation gets besides the bytes its scope covers.
+type Params struct {
+	// Algorithm is the name the pattern gave
+	Algorithm string
+	// Options is the computation's pseudo_header object, which doubles as
+	// its parameters (CRC polynomials, custom formulas, ...)
+	Options map[string]interface{}
+	// Key is the computation's key expression, resolved, or the -fpe-key
+	Key []byte
+	// PseudoHeader is the pseudo-header laid out for checksums that cover
+	// one, or nil
+	PseudoHeader []byte
+}
+
+// Computation computes the value of a field over the bytes its scope covers.
+// The result is an integer (uint8 to uint64, or int64), written into the
+// field as its type says, or a []byte digest, of which the field keeps the
+// leftmost bytes.
+type Computation interface {
+	Compute(data []byte, p Params) (interface{}, error)
+}
+
+// ComputationFunc adapts a function to Computation.
+type ComputationFunc func(data []byte, p Params) (interface{}, error)
+
+func (f ComputationFunc) Compute(data []byte, p Params) (interface{}, error) {
+	return f(data, p)
+}
+
+// FieldCodec encodes and decodes a field type.
+type FieldCodec interface {
+	// Encode returns the wire form of a value: an int64, string or []byte
+	// from an expression, or a JSON number. size is the field's declared
+	// size, or 0 when the field is sized by its content.
+	Encode(value interface{}, size int) ([]byte, bool)
+	// Decode reads a received field. Numbers should come back as int64 (or
+	// uint64), text as string, as expressions see them.
+	Decode(raw []byte) (interface{}, bool)
+	// Variable reports whether a field of this type without a size is
+	// sized by its encoding.
+	Variable() bool
+}
+
+// Measurer is implemented by codecs whose encoding delimits itself, such as
+// varints. The receiver uses it to find where a field without a size,
+// size_from or terminator ends.
+type Measurer interface {
+	// Measure returns the length of the field at the start of data
+	Measure(data []byte) (int, bool)
+}
+
+var (
+	mu           sync.RWMutex
+	computations = make(map[string]Computation)
+	codecs       = make(map[string]FieldCodec)
+)
+
+// RegisterComputation makes a computation available to patterns as
+// "algorithm": name. It panics if the name is taken.
+func RegisterComputation(name string, c Computation) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c == nil {
+		panic("plugin: computation " + name + " is nil")
+	}
+	if _, dup := computations[name]; dup {
+		panic(fmt.Sprintf("plugin: computation %q registered twice", name))
+	}
+	computations[name] = c
+}
+
+// RegisterFieldCodec makes a field type available to patterns as
+// "type": name. It panics if the name is taken. The basic types (uint8,
+// uint16/uint32 in either order, bitfield, ipv4_address, ipv6_address,
+// string and bytes) are handled by the tunnel itself and can't be replaced.
+func RegisterFieldCodec(name string, c FieldCodec) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c == nil {
+		panic("plugin: field codec " + name + " is nil")
+	}
+	if _, dup := codecs[name]; dup {
+		panic(fmt.Sprintf("plugin: field codec %q registered twice", name))
+	}
+	codecs[name] = c
+}
+
+// LookupComputation returns the computation registered as name.
+func LookupComputation(name string) (Computation, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := computations[name]
+	return c, ok
+}
+
+// LookupFieldCodec returns the field codec registered as name.
+func LookupFieldCodec(name string) (FieldCodec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
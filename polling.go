@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Polling carries the frames of a session in HTTP POST bodies. A request
+// body is the request's sequence number (uint32), a flags byte and the
+// frames sent, a response body a flags byte and the frames queued for the
+// client; each frame is prefixed with its length (uint32). The client sends
+// one request at a time and repeats it until it is answered, and the server
+// answers a repeat with the response it gave, so a request lost with its
+// connection costs no data.
+//
+// A session is known by a random token in its cookie, which alone lets a
+// request into it.
+const (
+	pollClosed   = 0x1      // the sender ended the session
+	pollToken    = 16       // random bytes in the cookie
+	pollMaxFrame = 16 << 20 // above max_body, a frame goes in a body of its own
+
+	defaultPollMinInterval = 50 * time.Millisecond
+	defaultPollMaxInterval = 2 * time.Second
+	defaultPollMaxBody     = 65536
+	defaultPollIdleTimeout = 60 * time.Second
+	pollRequestTimeout     = 30 * time.Second
+)
+
+// checkPolling validates the polling settings of the tunnel.
+func checkPolling(tunnel *TunnelConfig) error {
+	cfg := tunnel.Polling
+	if cfg == nil {
+		return nil
+	}
+	if tunnel.WebSocket != nil {
+		return errors.New("polling and websocket exclude each other")
+	}
+	if cfg.Path != "" && !strings.HasPrefix(cfg.Path, "/") {
+		return fmt.Errorf("path %q doesn't start with /", cfg.Path)
+	}
+	if cfg.MinInterval < 0 || cfg.MaxInterval < 0 || cfg.MaxBody < 0 || cfg.IdleTimeout < 0 {
+		return errors.New("intervals, max_body and idle_timeout can't be negative")
+	}
+	if cfg.MinInterval > 0 && cfg.MaxInterval > 0 && cfg.MinInterval > cfg.MaxInterval {
+		return fmt.Errorf("min_interval_ms %d is above max_interval_ms %d", cfg.MinInterval, cfg.MaxInterval)
+	}
+	return nil
+}
+
+func pollPath(cfg *PollingConfig) string {
+	if cfg.Path == "" {
+		return "/"
+	}
+	return cfg.Path
+}
+
+func pollCookie(cfg *PollingConfig) string {
+	if cfg.Cookie == "" {
+		return "sid"
+	}
+	return cfg.Cookie
+}
+
+func pollMaxBody(cfg *PollingConfig) int {
+	if cfg.MaxBody > 0 {
+		return cfg.MaxBody
+	}
+	return defaultPollMaxBody
+}
+
+func pollIdleTimeout(cfg *PollingConfig) time.Duration {
+	if cfg.IdleTimeout > 0 {
+		return time.Duration(cfg.IdleTimeout) * time.Second
+	}
+	return defaultPollIdleTimeout
+}
+
+// pollSessionID is the session ID both ends take from a session's token,
+// kept positive for the logs. It is a hash, so frames carrying it give
+// nothing of the token away.
+func pollSessionID(token string) int64 {
+	sum := sha256.Sum256([]byte(token))
+	return int64(binary.BigEndian.Uint64(sum[:8]) >> 1)
+}
+
+// readPollBody reads a request body: the sequence number and flags, then
+// frames of up to twice max bytes, or one larger frame, which a client
+// sends on its own.
+func readPollBody(r io.Reader, max int) ([]byte, error) {
+	body := make([]byte, 9)
+	n, err := io.ReadFull(r, body)
+	switch {
+	case n == 5 && err == io.ErrUnexpectedEOF:
+		return body[:5], nil // no frames
+	case err != nil:
+		return nil, err
+	}
+	limit := 2 * max
+	if first := 4 + int(binary.BigEndian.Uint32(body[5:])); first > limit {
+		if first > 4+pollMaxFrame {
+			return nil, fmt.Errorf("frame of %d bytes", first-4)
+		}
+		limit = first
+	}
+	rest, err := io.ReadAll(io.LimitReader(r, int64(limit-4)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > limit-4 {
+		return nil, errors.New("body too large")
+	}
+	return append(body, rest...), nil
+}
+
+// appendPollFrame appends a frame with its length prefix.
+func appendPollFrame(b, frame []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(frame)))
+	return append(b, frame...)
+}
+
+// takePollFrames removes whole frames from the front of queue, at least one
+// and then as many as fit in max bytes.
+func takePollFrames(queue []byte, max int) (taken, rest []byte) {
+	n := 0
+	for n < len(queue) {
+		size := 4 + int(binary.BigEndian.Uint32(queue[n:]))
+		if n > 0 && n+size > max {
+			break
+		}
+		n += size
+	}
+	return queue[:n:n], queue[n:]
+}
+
+func splitPollFrames(b []byte) ([][]byte, bool) {
+	var frames [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, false
+		}
+		size := binary.BigEndian.Uint32(b)
+		if uint64(len(b)-4) < uint64(size) {
+			return nil, false
+		}
+		frames = append(frames, b[4:4+size])
+		b = b[4+size:]
+	}
+	return frames, true
+}
+
+// pollClient is the client end of a polling session as a net.Conn: Write
+// queues a frame for the next request and Read returns one frame from a
+// response. Requests go out at once while there is data to send, and
+// otherwise at an interval that doubles while nothing comes back, up to
+// max_interval_ms.
+type pollClient struct {
+	t         *TunnelNode
+	cfg       *PollingConfig
+	http      *http.Client
+	url       string
+	host      string
+	token     string
+	sessionID int64
+	remote    net.Addr
+
+	frames    chan []byte // from responses, for Read
+	rest      []byte      // of a frame longer than a Read
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	upstream []byte // frames for the next request
+	closed   bool
+}
+
+// dialPolling starts a polling session with the server. Its requests go
+// over connections of its own, with TLS if the pattern has it, and new ones
+// are made as the network drops them.
+func (t *TunnelNode) dialPolling() *pollClient {
+	cfg := t.config.Tunnel.Polling
+	host := cfg.Host
+	if host == "" && t.config.Tunnel.TLS != nil {
+		host = t.config.Tunnel.TLS.ServerName
+	}
+	if host == "" {
+		host = t.serverAddr
+	}
+
+	token := make([]byte, pollToken)
+	crand.Read(token)
+
+	c := &pollClient{
+		t:      t,
+		cfg:    cfg,
+		url:    "http://" + t.serverAddr + pollPath(cfg),
+		host:   host,
+		token:  hex.EncodeToString(token),
+		remote: &net.TCPAddr{},
+		frames: make(chan []byte, 64),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	c.sessionID = pollSessionID(c.token)
+	c.cond = sync.NewCond(&c.mu)
+	if addr, err := net.ResolveTCPAddr("tcp", t.serverAddr); err == nil {
+		c.remote = addr
+	}
+	c.http = &http.Client{
+		Timeout: pollRequestTimeout,
+		Transport: &http.Transport{
+			// TLS comes from the pattern, so the URL stays http
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				conn, err := d.DialContext(ctx, "tcp", t.serverAddr)
+				if err != nil {
+					return nil, err
+				}
+				secured, err := t.secureConn(conn)
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return secured, nil
+			},
+			DisableCompression:  true,
+			MaxIdleConnsPerHost: 1,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	go c.run()
+	return c
+}
+
+func (c *pollClient) run() {
+	defer c.http.CloseIdleConnections()
+
+	interval := c.minInterval()
+	for seq := uint32(1); ; seq++ {
+		select {
+		case <-c.wake:
+		case <-time.After(interval):
+		case <-c.done:
+		}
+
+		c.mu.Lock()
+		var body []byte
+		body, c.upstream = takePollFrames(c.upstream, pollMaxBody(c.cfg))
+		closing := c.closed
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		flags := byte(0)
+		if closing {
+			flags = pollClosed
+		}
+		req := binary.BigEndian.AppendUint32(nil, seq)
+		req = append(append(req, flags), body...)
+		resp, err := c.exchange(req)
+		if closing {
+			return
+		}
+		if err != nil {
+			log.Printf("❌ Polling session %x lost: %v", c.sessionID, err)
+			c.Close()
+			return
+		}
+
+		frames, ok := splitPollFrames(resp[1:])
+		if !ok {
+			log.Printf("❌ Polling session %x: malformed response", c.sessionID)
+			c.Close()
+			return
+		}
+		for _, frame := range frames {
+			select {
+			case c.frames <- frame:
+			case <-c.done:
+			}
+		}
+		if resp[0]&pollClosed != 0 {
+			c.Close()
+			return
+		}
+
+		// Poll again soon while data flows, less often while it doesn't
+		if len(body) > 0 || len(frames) > 0 {
+			interval = c.minInterval()
+		} else if interval *= 2; interval > c.maxInterval() {
+			interval = c.maxInterval()
+		}
+		c.mu.Lock()
+		pending := len(c.upstream) > 0
+		c.mu.Unlock()
+		if pending || len(frames) > 0 {
+			c.signal()
+		}
+	}
+}
+
+// exchange posts a request body until the server answers it, for up to
+// the idle timeout, and returns the response body.
+func (c *pollClient) exchange(body []byte) ([]byte, error) {
+	deadline := time.Now().Add(pollIdleTimeout(c.cfg))
+	backoff := c.minInterval()
+	for {
+		resp, err := c.post(body)
+		if err == nil {
+			return resp, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		if *verbose {
+			log.Printf("⚠️ Polling session %x: %v, retrying in %v", c.sessionID, err, backoff)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > c.maxInterval() {
+			backoff = c.maxInterval()
+		}
+	}
+}
+
+func (c *pollClient) post(body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = c.host
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for name, value := range c.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	req.AddCookie(&http.Cookie{Name: pollCookie(c.cfg), Value: c.token})
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server answered %s", resp.Status)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty response")
+	}
+	return data, nil
+}
+
+func (c *pollClient) minInterval() time.Duration {
+	if c.cfg.MinInterval > 0 {
+		return time.Duration(c.cfg.MinInterval) * time.Millisecond
+	}
+	return defaultPollMinInterval
+}
+
+func (c *pollClient) maxInterval() time.Duration {
+	if c.cfg.MaxInterval > 0 {
+		return time.Duration(c.cfg.MaxInterval) * time.Millisecond
+	}
+	return defaultPollMaxInterval
+}
+
+func (c *pollClient) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *pollClient) Read(b []byte) (int, error) {
+	if len(c.rest) == 0 {
+		select {
+		case frame := <-c.frames:
+			c.rest = frame
+		case <-c.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// Write queues a frame, waiting while several request bodies' worth are
+// queued already.
+func (c *pollClient) Write(b []byte) (int, error) {
+	if len(b) > pollMaxFrame {
+		return 0, fmt.Errorf("polling: frame of %d bytes", len(b))
+	}
+	c.mu.Lock()
+	for !c.closed && len(c.upstream) >= 4*pollMaxBody(c.cfg) {
+		c.cond.Wait()
+	}
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.upstream = appendPollFrame(c.upstream, b)
+	c.mu.Unlock()
+	c.signal()
+	return len(b), nil
+}
+
+// Close ends the session; the next request tells the server so.
+func (c *pollClient) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *pollClient) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (c *pollClient) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pollClient) SetDeadline(time.Time) error      { return nil }
+func (c *pollClient) SetReadDeadline(time.Time) error  { return nil }
+func (c *pollClient) SetWriteDeadline(time.Time) error { return nil }
+
+// pollServer answers the requests of polling clients, handing each new
+// session to handleServerConnection as if it had been accepted. Sessions
+// are told apart by the token in their cookie, so their requests may come
+// over any connection.
+type pollServer struct {
+	t   *TunnelNode
+	cfg *PollingConfig
+
+	mu    sync.Mutex
+	peers map[string]*pollPeer
+}
+
+// servePolling serves polling clients on the TCP listener, over TLS if the
+// pattern has it.
+func (t *TunnelNode) servePolling() {
+	listener := t.listener
+	if t.tlsConfig != nil {
+		listener = tls.NewListener(listener, t.tlsConfig)
+	}
+	s := &pollServer{t: t, cfg: t.config.Tunnel.Polling, peers: make(map[string]*pollPeer)}
+	srv := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: pollRequestTimeout,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		// Clients poll over HTTP/1.1 whatever ALPN offers
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+	if err := srv.Serve(listener); err != nil && t.ctx.Err() == nil {
+		log.Printf("❌ Polling server stopped: %v", err)
+	}
+}
+
+func (s *pollServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := ""
+	if cookie, err := r.Cookie(pollCookie(s.cfg)); err == nil {
+		if b, err := hex.DecodeString(cookie.Value); err == nil && len(b) == pollToken {
+			token = hex.EncodeToString(b)
+		}
+	}
+	if r.Method != http.MethodPost || r.URL.Path != pollPath(s.cfg) || token == "" {
+		// Anything else gets what any web server would answer
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := readPollBody(r.Body, pollMaxBody(s.cfg))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	seq, flags := binary.BigEndian.Uint32(body), body[4]
+	frames, ok := splitPollFrames(body[5:])
+	if !ok {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	resp := []byte{pollClosed}
+	if peer := s.peer(token, seq, flags, r); peer != nil {
+		if resp = peer.exchange(seq, flags, frames); resp == nil {
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		}
+		peer.setRemote(r.RemoteAddr)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	for name, value := range s.cfg.ResponseHeaders {
+		w.Header().Set(name, value)
+	}
+	w.Write(resp)
+}
+
+// peer finds the session of a request, starting it on its first request.
+// Requests of unknown sessions get nil and are told the session ended.
+func (s *pollServer) peer(token string, seq uint32, flags byte, r *http.Request) *pollPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peer, ok := s.peers[token]; ok {
+		return peer
+	}
+	if seq != 1 || flags&pollClosed != 0 {
+		return nil
+	}
+
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if _, ok := local.(*net.TCPAddr); !ok {
+		local = &net.TCPAddr{}
+	}
+	id := pollSessionID(token)
+	peer := &pollPeer{
+		s:         s,
+		token:     token,
+		sessionID: id,
+		local:     local,
+		remote:    &net.TCPAddr{},
+		frames:    make(chan []byte, 64),
+		closed:    make(chan struct{}),
+		lastPoll:  time.Now(),
+	}
+	peer.cond = sync.NewCond(&peer.mu)
+	peer.setRemote(r.RemoteAddr)
+	s.peers[token] = peer
+	if *verbose {
+		log.Printf("🔗 Polling session %x from %s", id, r.RemoteAddr)
+	}
+	go s.t.handleServerConnection(peer)
+	return peer
+}
+
+func (s *pollServer) remove(peer *pollPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers[peer.token] == peer {
+		delete(s.peers, peer.token)
+	}
+}
+
+// pollPeer is a polling session on the server as a net.Conn: Read returns
+// one frame from a request and Write queues a frame for a response. Reads
+// fail once no request has come for the idle timeout. After Close the
+// session stays until a response has taken what is queued, and tells the
+// client that the session ended.
+type pollPeer struct {
+	s         *pollServer
+	token     string
+	sessionID int64
+	local     net.Addr
+
+	frames    chan []byte // from requests, for Read
+	rest      []byte      // of a frame longer than a Read
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	exchangeMu sync.Mutex // one request at a time, a repeat waits for the original
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	remote     net.Addr
+	downstream []byte // frames for the next response
+	lastPoll   time.Time
+	lastSeq    uint32
+	lastResp   []byte
+}
+
+// exchange takes the frames of request seq and returns the response, or
+// nil if seq is out of order. A repeated request gets the response it got
+// before.
+func (p *pollPeer) exchange(seq uint32, flags byte, frames [][]byte) []byte {
+	p.exchangeMu.Lock()
+	defer p.exchangeMu.Unlock()
+
+	p.mu.Lock()
+	p.lastPoll = time.Now()
+	if seq == p.lastSeq {
+		resp := p.lastResp
+		p.mu.Unlock()
+		return resp
+	}
+	if seq != p.lastSeq+1 {
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	for _, frame := range frames {
+		select {
+		case p.frames <- frame:
+		case <-p.closed:
+		}
+	}
+	if flags&pollClosed != 0 {
+		p.Close()
+	}
+
+	p.mu.Lock()
+	var body []byte
+	body, p.downstream = takePollFrames(p.downstream, pollMaxBody(p.s.cfg))
+	p.cond.Broadcast()
+	resp := []byte{0}
+	if p.isClosed() && len(p.downstream) == 0 {
+		resp[0] = pollClosed
+	}
+	p.lastSeq, p.lastResp = seq, append(resp, body...)
+	p.mu.Unlock()
+
+	if resp[0]&pollClosed != 0 {
+		p.s.remove(p)
+	}
+	return p.lastResp
+}
+
+func (p *pollPeer) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *pollPeer) setRemote(addr string) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remote = tcpAddr
+}
+
+func (p *pollPeer) Read(b []byte) (int, error) {
+	for len(p.rest) == 0 {
+		idle := pollIdleTimeout(p.s.cfg)
+		p.mu.Lock()
+		wait := idle - time.Since(p.lastPoll)
+		p.mu.Unlock()
+		if wait <= 0 {
+			if *verbose {
+				log.Printf("⌛ Polling session %x idle for %v", p.sessionID, idle)
+			}
+			p.Close()
+			return 0, io.EOF
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case frame := <-p.frames:
+			p.rest = frame
+		case <-p.closed:
+			timer.Stop()
+			return 0, io.EOF
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	n := copy(b, p.rest)
+	p.rest = p.rest[n:]
+	return n, nil
+}
+
+// Write queues a frame, waiting while several response bodies' worth are
+// queued already.
+func (p *pollPeer) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.isClosed() && len(p.downstream) >= 4*pollMaxBody(p.s.cfg) {
+		p.cond.Wait()
+	}
+	if p.isClosed() {
+		return 0, net.ErrClosed
+	}
+	p.downstream = appendPollFrame(p.downstream, b)
+	return len(b), nil
+}
+
+func (p *pollPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		// A client that never comes back to collect the rest is forgotten
+		time.AfterFunc(pollIdleTimeout(p.s.cfg), func() { p.s.remove(p) })
+	})
+	return nil
+}
+
+func (p *pollPeer) LocalAddr() net.Addr { return p.local }
+
+func (p *pollPeer) RemoteAddr() net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remote
+}
+
+func (p *pollPeer) SetDeadline(time.Time) error      { return nil }
+func (p *pollPeer) SetReadDeadline(time.Time) error  { return nil }
+func (p *pollPeer) SetWriteDeadline(time.Time) error { return nil }
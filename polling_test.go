@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pollRequest(seq uint32, flags byte, frames ...[]byte) []byte {
+	body := append(binary.BigEndian.AppendUint32(nil, seq), flags)
+	for _, frame := range frames {
+		body = appendPollFrame(body, frame)
+	}
+	return body
+}
+
+func TestTakePollFrames(t *testing.T) {
+	var queue []byte
+	for _, size := range []int{10, 20, 100, 5} {
+		queue = appendPollFrame(queue, make([]byte, size))
+	}
+
+	// Frames are taken whole, and one too large for max on its own
+	tests := []struct {
+		max   int
+		sizes []int
+	}{
+		{1000, []int{10, 20, 100, 5}},
+		{38, []int{10, 20}},
+		{37, []int{10}},
+		{1, []int{10}},
+	}
+	for _, tt := range tests {
+		taken, rest := takePollFrames(queue, tt.max)
+		frames, ok := splitPollFrames(taken)
+		if !ok || len(frames) != len(tt.sizes) {
+			t.Errorf("max %d took %d frames", tt.max, len(frames))
+			continue
+		}
+		for i, frame := range frames {
+			if len(frame) != tt.sizes[i] {
+				t.Errorf("max %d: frame %d has %d bytes, want %d", tt.max, i, len(frame), tt.sizes[i])
+			}
+		}
+		if len(taken)+len(rest) != len(queue) {
+			t.Errorf("max %d left %d of %d bytes", tt.max, len(rest), len(queue)-len(taken))
+		}
+	}
+
+	for _, b := range [][]byte{{0, 0, 0}, {0, 0, 0, 5, 1, 2}} {
+		if _, ok := splitPollFrames(b); ok {
+			t.Errorf("%x splits", b)
+		}
+	}
+}
+
+func TestReadPollBody(t *testing.T) {
+	small := make([]byte, 100)
+	tests := []struct {
+		body []byte
+		ok   bool
+	}{
+		{pollRequest(1, 0), true},
+		{pollRequest(1, 0, small, small), true},
+		// Up to twice max, for a client with a larger max_body
+		{pollRequest(1, 0, small, small, small, small), true},
+		{pollRequest(1, 0, small, small, small, small, small), false},
+		// A frame larger than that goes alone
+		{pollRequest(1, 0, make([]byte, 1000)), true},
+		{pollRequest(1, 0, make([]byte, 1000), []byte{1}), false},
+		{pollRequest(1, 0)[:4], false},
+		{pollRequest(1, 0, small)[:7], false},
+		{append(pollRequest(1, 0), 0xff, 0xff, 0xff, 0xff), false},
+	}
+	for i, tt := range tests {
+		body, err := readPollBody(bytes.NewReader(tt.body), 250)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("body %d of %d bytes: %v", i, len(tt.body), err)
+		}
+		if err == nil && !bytes.Equal(body, tt.body) {
+			t.Errorf("body %d read as %d bytes", i, len(body))
+		}
+	}
+}
+
+func TestPollSessionID(t *testing.T) {
+	a, b := pollSessionID("00112233445566778899aabbccddeeff"), pollSessionID("00112233445566778899aabbccddeefe")
+	if a == b || a <= 0 || b <= 0 || a != pollSessionID("00112233445566778899aabbccddeeff") {
+		t.Errorf("session IDs %x and %x", a, b)
+	}
+}
+
+func TestPollServerRefuses(t *testing.T) {
+	s := &pollServer{cfg: &PollingConfig{Path: "/poll"}, peers: make(map[string]*pollPeer)}
+	token := strings.Repeat("ab", pollToken)
+	tests := []struct {
+		method, path, cookie string
+		body                 []byte
+		status               int
+	}{
+		{"GET", "/poll", token, nil, http.StatusNotFound},
+		{"POST", "/", token, pollRequest(1, 0), http.StatusNotFound},
+		{"POST", "/poll", "", pollRequest(1, 0), http.StatusNotFound},
+		{"POST", "/poll", "1234", pollRequest(1, 0), http.StatusNotFound},
+		{"POST", "/poll", strings.Repeat("zz", pollToken), pollRequest(1, 0), http.StatusNotFound},
+		{"POST", "/poll", token, []byte{1, 2}, http.StatusBadRequest},
+		{"POST", "/poll", token, pollRequest(1, 0, make([]byte, pollMaxFrame+1)), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "sid", Value: tt.cookie})
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with cookie %q: %d, want %d", tt.method, tt.path, tt.cookie, w.Code, tt.status)
+		}
+	}
+
+	// Requests of sessions the server doesn't know are told they ended
+	r := httptest.NewRequest("POST", "/poll", bytes.NewReader(pollRequest(2, 0)))
+	r.AddCookie(&http.Cookie{Name: "sid", Value: token})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), []byte{pollClosed}) {
+		t.Errorf("unknown session answered %d %x", w.Code, w.Body.Bytes())
+	}
+}
+
+func TestPollPeerExchange(t *testing.T) {
+	s := &pollServer{cfg: &PollingConfig{MaxBody: 64}, peers: make(map[string]*pollPeer)}
+	p := &pollPeer{s: s, token: "t", frames: make(chan []byte, 4), closed: make(chan struct{}), lastPoll: time.Now()}
+	p.cond = sync.NewCond(&p.mu)
+	s.peers["t"] = p
+
+	p.Write([]byte("down"))
+	resp := p.exchange(1, 0, [][]byte{[]byte("up")})
+	if want := appendPollFrame([]byte{0}, []byte("down")); !bytes.Equal(resp, want) {
+		t.Fatalf("response %x, want %x", resp, want)
+	}
+	if got := <-p.frames; string(got) != "up" {
+		t.Errorf("request frame %q", got)
+	}
+
+	// A repeat gets the same response and its frames aren't taken again
+	p.Write([]byte("more"))
+	if again := p.exchange(1, 0, [][]byte{[]byte("up")}); !bytes.Equal(again, resp) || len(p.frames) != 0 {
+		t.Errorf("repeat answered %x with %d frames taken", again, len(p.frames))
+	}
+	if p.exchange(3, 0, nil) != nil {
+		t.Error("request 3 answered after 1")
+	}
+
+	// The session ends once the queue is drained
+	p.Close()
+	if resp := p.exchange(2, 0, nil); !bytes.Equal(resp, appendPollFrame([]byte{pollClosed}, []byte("more"))) {
+		t.Errorf("last response %x", resp)
+	}
+	if _, ok := s.peers["t"]; ok {
+		t.Error("ended session still known")
+	}
+}
@@ -1,87 +1,198 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
 	"fmt"
+	"hash"
 	"log"
-	"math/rand"
 	"net"
 	"strconv"
 	"strings"
+
+	"tunnel/plugin"
 )
 
-func (t *TunnelNode) buildPacket(packetType string, proto Protocol, connID string, data []byte) []byte {
+// packetContext carries the per-packet state through the builders.
+type packetContext struct {
+	env   *exprEnv
+	sess  *session
+	proto *Protocol
+	// segment is the number of a data frame of a reliable stream
+	segment *uint64
+}
+
+func (t *TunnelNode) buildPacket(packetType string, proto Protocol, sess *session, data []byte) []byte {
+	return t.build(packetType, &packetContext{env: sess.exprEnv(data), sess: sess, proto: &proto})
+}
+
+// buildSegment builds data frame seq of a session's reliable stream.
+func (t *TunnelNode) buildSegment(proto Protocol, sess *session, seq uint64, data []byte) []byte {
+	return t.build("request", &packetContext{env: sess.exprEnv(data), sess: sess, proto: &proto, segment: &seq})
+}
+
+func (t *TunnelNode) build(packetType string, ctx *packetContext) []byte {
+	proto, sess := *ctx.proto, ctx.sess
 	if *verbose {
-		log.Printf("🔧 DEBUG: Building packet - Type: %s, Protocol: %s, Data size: %d", packetType, proto.Identifier, len(data))
+		log.Printf("🔧 DEBUG: Building packet - Type: %s, Protocol: %s, Data size: %d", packetType, proto.Identifier, len(ctx.env.data))
+	}
+
+	ctx.env.seq = sess.nextFrame()
+
+	if c := t.http2Conn(sess, &proto); c != nil {
+		return c.frames(ctx.proto, ctx.env)
 	}
 
 	if proto.LayerStack != nil {
 		if *verbose {
 			log.Printf("🔧 DEBUG: Using LayerStack")
 		}
-		result := t.buildLayerStack(proto.LayerStack, connID, data)
+		result := t.buildLayerStack(proto.LayerStack, ctx)
 		if *verbose {
 			log.Printf("🔧 DEBUG: LayerStack result size: %d", len(result))
 		}
 		return result
 	}
 
+	frame := proto.FrameStructure
+	if packetType == "response" && frame.ResponseFormat != nil {
+		frame.RequestFormat = frame.ResponseFormat
+	}
+
 	if *verbose {
 		log.Printf("🔧 DEBUG: Using FrameStructure")
 	}
-	result := t.buildFrameStructure(proto.FrameStructure, connID, data)
+	result := t.buildFrameStructure(frame, ctx)
 	if *verbose {
 		log.Printf("🔧 DEBUG: FrameStructure result size: %d", len(result))
 	}
 	return result
 }
 
-func (t *TunnelNode) buildLayerStack(stack *LayerStack, connID string, data []byte) []byte {
-	var packet []byte
-	layers := []*LayerDefinition{stack.Layer2Ethernet, stack.Layer3IPv4, stack.Layer3IPv6, stack.Layer4, stack.Layer5, stack.Layer6, stack.Layer7}
-
-	for _, layer := range layers {
-		if layer != nil {
-			packet = append(packet, t.buildLayer(layer, connID, data)...)
-		}
+// packetNames lists the packet types buildPacket can produce for a protocol,
+// i.e. the valid send_packet values of its state machine.
+func packetNames(proto Protocol) []string {
+	var names []string
+	if proto.LayerStack != nil || proto.FrameStructure.RequestFormat != nil || proto.HTTP2 != nil {
+		names = append(names, "request")
+	}
+	if proto.FrameStructure.ResponseFormat != nil || proto.HTTP2 != nil {
+		names = append(names, "response")
 	}
-	return packet
+	return names
 }
 
-func (t *TunnelNode) buildLayer(layer *LayerDefinition, connID string, data []byte) []byte {
-	size := layer.HeaderSize
-	for _, field := range layer.Fields {
-		if end := field.Offset + field.Size; end > size {
-			size = end
+// buildLayerStack lays out every layer and chunk, leaving out chunks whose
+// condition fails and repeating the repeated ones, then fills the fields in
+// three passes: plain values, lengths, which only depend on the layout, and
+// computations over the assembled frame, ordered so that a checksum covering
+// another computed field runs after it.
+func (t *TunnelNode) buildLayerStack(stack *LayerStack, ctx *packetContext) []byte {
+	layout := &packetLayout{grow: true}
+	place := func(def blockDef, item map[string]interface{}) {
+		// Values are resolved first since variable-length fields are sized
+		// by them
+		values := make([]interface{}, len(def.fields))
+		for i, field := range def.fields {
+			if field.Length != nil || field.Computation != nil {
+				continue
+			}
+			if v, ok := item[field.Name]; ok {
+				values[i] = t.resolveValue(v, ctx.env)
+			} else {
+				values[i] = t.fieldValue(field, ctx)
+			}
 		}
-	}
 
-	packet := make([]byte, size)
-	for _, field := range layer.Fields {
-		t.setField(packet, field, connID, data)
+		layout.addBlock(def, func(field Field, placed []Field) (int, bool) {
+			content := len(encodeField(field, values[len(placed)])) + len(field.Terminator)
+			if field.SizeFrom == "" || field.SizeFrom == "content" {
+				return content, true
+			}
+			ref, ok := layout.lookupField(placed, field.SizeFrom)
+			if !ok {
+				return 0, false
+			}
+			if ref.field.Length != nil {
+				// The length field will be filled in from this one
+				return content, true
+			}
+			if ref.block == nil {
+				return t.toInt(values[ref.index]), true
+			}
+			return t.toInt(ref.block.values[ref.index]), true
+		})
+		layout.blocks[len(layout.blocks)-1].values = values
 	}
 
-	for _, chunk := range layer.Chunks {
-		packet = append(packet, t.buildChunk(chunk, connID, data)...)
+	for _, def := range stackBlocks(stack) {
+		if def.spec == nil {
+			place(def, nil)
+			continue
+		}
+		if !t.chunkPresent(def.spec, layout, ctx.env) {
+			continue
+		}
+		first := len(layout.blocks)
+		defs, items := t.chunkInstances(def, ctx.env)
+		for i := range defs {
+			place(defs[i], items[i])
+		}
+		if def.spec.Repeat != nil {
+			layout.fillRepeatFields(def.spec.Repeat, first)
+		}
 	}
-	return packet
-}
-
-func (t *TunnelNode) buildChunk(chunk Chunk, connID string, data []byte) []byte {
-	size := 0
-	for _, field := range chunk.Fields {
-		if end := field.Offset + field.Size; end > size {
-			size = end
+	layout.payload = byteRange{layout.end, layout.end}
+	if !carriesPayload(stack) {
+		layout.frame = append(layout.frame, t.processVPNData(ctx.env.connID, ctx.env.data)...)
+		layout.payload.end = len(layout.frame)
+	}
+
+	var lengths, computed []layoutField
+	carried := false
+	for i := range layout.blocks {
+		block := &layout.blocks[i]
+		packet := layout.bytes(block)
+		for j, field := range block.fields {
+			switch {
+			case field.Length != nil:
+				lengths = append(lengths, layoutField{block, field})
+			case field.Computation != nil:
+				computed = append(computed, layoutField{block, field})
+			case field.Size > 0:
+				if field.Value == "<<VPN_DATA>>" {
+					layout.coverPayload(layoutField{block, field}.position(), carried)
+					carried = true
+					if n := len(fieldContent(block.values[j])); n > field.Size-len(field.Terminator) {
+						log.Printf("❌ %s.%s: %d payload bytes don't fit in %d; split them with a repeated chunk's split_payload", block.name(), field.Name, n, field.Size-len(field.Terminator))
+					}
+				}
+				if n := len(field.Terminator); n > 0 && n <= field.Size {
+					// The value goes before its terminator
+					field.Size -= n
+					copy(packet[field.Offset+field.Size:], field.Terminator)
+				}
+				t.setValue(packet, field, block.values[j])
+			}
 		}
 	}
 
-	chunkData := make([]byte, size)
-	for _, field := range chunk.Fields {
-		t.setField(chunkData, field, connID, data)
+	for _, f := range lengths {
+		t.setValue(layout.bytes(f.block), f.field, layout.length(f.block, f.field.Length))
 	}
-	return chunkData
+
+	for _, f := range t.computationOrder(layout, computed) {
+		t.applyComputation(layout, f, ctx.env)
+	}
+
+	return layout.frame
 }
 
-func (t *TunnelNode) buildFrameStructure(frame FrameStructure, connID string, data []byte) []byte {
+func (t *TunnelNode) buildFrameStructure(frame FrameStructure, ctx *packetContext) []byte {
 	var result []byte
 
 	if *verbose {
@@ -97,7 +208,7 @@ func (t *TunnelNode) buildFrameStructure(frame FrameStructure, connID string, da
 				if *verbose {
 					log.Printf("🔧 DEBUG: Processing RequestFormat item %d", i)
 				}
-				result = append(result, t.processRequestFormatItem(value, connID, data)...)
+				result = append(result, t.processRequestFormatItem(value, ctx)...)
 			}
 		case map[string]interface{}:
 			// Map format (legacy)
@@ -105,7 +216,7 @@ func (t *TunnelNode) buildFrameStructure(frame FrameStructure, connID string, da
 				if *verbose {
 					log.Printf("🔧 DEBUG: Processing legacy RequestFormat key: %s", key)
 				}
-				result = append(result, t.processRequestFormatItem(value, connID, data)...)
+				result = append(result, t.processRequestFormatItem(value, ctx)...)
 			}
 		default:
 			if *verbose {
@@ -131,20 +242,19 @@ func (t *TunnelNode) buildFrameStructure(frame FrameStructure, connID string, da
 	return result
 }
 
-func (t *TunnelNode) processRequestFormatItem(value interface{}, connID string, data []byte) []byte {
+func (t *TunnelNode) processRequestFormatItem(value interface{}, ctx *packetContext) []byte {
 	var result []byte
 
 	switch v := value.(type) {
 	case string:
 		if v == "<<VPN_DATA>>" {
-			vpnData := t.processVPNData(connID, data)
+			vpnData := t.processVPNData(ctx.env.connID, ctx.env.data)
 			if *verbose {
 				log.Printf("🔧 DEBUG: VPN_DATA processed: %d bytes", len(vpnData))
 			}
 			result = append(result, vpnData...)
 		} else {
-			resolved := t.resolveVars(v, connID)
-			resolved = t.updateDynamicValues(resolved, len(data))
+			resolved := t.renderString(v, ctx.env)
 			if *verbose {
 				displayStr := resolved
 				if len(displayStr) > 50 {
@@ -160,8 +270,7 @@ func (t *TunnelNode) processRequestFormatItem(value interface{}, connID string,
 		}
 		for name, val := range v {
 			if str, ok := val.(string); ok {
-				resolved := t.resolveVars(str, connID)
-				resolved = t.updateDynamicValues(resolved, len(data))
+				resolved := t.renderString(str, ctx.env)
 				headerLine := fmt.Sprintf("%s: %s\r\n", name, resolved)
 				if *verbose {
 					log.Printf("🔧 DEBUG: Header: %s", strings.TrimSpace(headerLine))
@@ -178,140 +287,176 @@ func (t *TunnelNode) processRequestFormatItem(value interface{}, connID string,
 	return result
 }
 
-// اضافه کردن updateDynamicValues function
-func (t *TunnelNode) updateDynamicValues(template string, dataSize int) string {
-	template = strings.ReplaceAll(template, "${DATA_SIZE}", strconv.Itoa(dataSize))
-	template = strings.ReplaceAll(template, "${DATA_LENGTH}", strconv.Itoa(dataSize))
-	return template
-}
-
-func (t *TunnelNode) setField(packet []byte, field Field, connID string, data []byte) {
-	if field.Size == 0 || field.Offset+field.Size > len(packet) {
-		return
-	}
-
-	var value interface{}
+// fieldValue resolves the value of a field that is neither a length nor a
+// computation.
+func (t *TunnelNode) fieldValue(field Field, ctx *packetContext) interface{} {
 	if str, ok := field.Value.(string); ok && str == "<<VPN_DATA>>" {
-		value = t.processVPNData(connID, data)
-	} else if field.Sequence != nil {
-		value = t.getSequence(field, connID)
-	} else if field.Computation != nil {
-		value = t.computeField(field, packet, data)
-	} else if field.Randomize {
-		value = t.getRandom(field)
-	} else {
-		value = t.resolveVars(field.Value, connID)
+		return t.processVPNData(ctx.env.connID, ctx.env.data)
+	}
+	if value, ok := reliabilityValue(field, ctx); ok {
+		return value
+	}
+	if field.Sequence != nil {
+		value := t.getSequence(field, ctx)
+		if isTemplate(field.Value) {
+			// The expression sees the sequence value as "seq"
+			seqEnv := *ctx.env
+			seqEnv.seq = int64(value)
+			return t.resolveValue(field.Value, &seqEnv)
+		}
+		return value
 	}
-
-	t.setValue(packet, field, value)
-}
-
-func (t *TunnelNode) computeField(field Field, packet []byte, data []byte) interface{} {
-	if field.Computation == nil {
-		return 0
+	if field.Randomize || field.RangeValues != nil {
+		return t.getRandom(field, ctx.env)
+	}
+	if values, ok := field.Value.(map[string]interface{}); ok && field.Type == "bitfield" {
+		resolved := make(map[string]interface{}, len(values))
+		for name, v := range values {
+			resolved[name] = t.resolveValue(v, ctx.env)
+		}
+		return resolved
 	}
-	return t.computeUniversalChecksum(field.Computation, packet, data)
+	return t.resolveValue(field.Value, ctx.env)
 }
 
-func (t *TunnelNode) computeUniversalChecksum(comp *ComputationConfig, packet []byte, data []byte) interface{} {
-	start, end := t.parseScope(comp.Scope, packet, data)
-	if start >= end || end > len(packet)+len(data) {
+// computeUniversalChecksum runs a computation over the bytes its scope
+// covers, from the plugin registry. Unregistered CRC names go to the CRC
+// catalogue. An empty scope gets the value of empty input, which for
+// digests and HMACs isn't zero. env resolves keys and pseudo-header
+// addresses.
+func (t *TunnelNode) computeUniversalChecksum(comp *ComputationConfig, targetData []byte, env *exprEnv) interface{} {
+	c, ok := plugin.LookupComputation(comp.Algorithm)
+	if !ok && isCRC(comp.Algorithm) {
+		c, ok = plugin.LookupComputation("crc")
+	}
+	if !ok {
+		log.Printf("❌ Unknown computation %s", comp.Algorithm)
 		return 0
 	}
 
-	combined := append(packet, data...)
-	targetData := combined[start:end]
-
-	switch comp.Algorithm {
-	case "checksum", "checksum_ip", "checksum_tcp", "checksum_udp", "checksum_icmp":
-		return t.computeInternetChecksum(targetData, comp.PseudoHeader)
-	case "crc8", "crc16", "crc32", "crc64":
-		return t.computeCRC(targetData, comp.Algorithm, comp.PseudoHeader)
-	case "xor", "xor8", "xor16", "xor32":
-		return t.computeXOR(targetData, comp.Algorithm)
-	case "sum", "sum8", "sum16", "sum32":
-		return t.computeSum(targetData, comp.Algorithm)
-	case "hash", "md5", "sha1", "sha256":
-		return t.computeHash(targetData, comp.Algorithm)
-	case "custom":
-		return t.computeCustom(targetData, comp.PseudoHeader)
-	default:
-		return t.computeDynamic(targetData, comp)
+	value, err := c.Compute(targetData, plugin.Params{
+		Algorithm:    comp.Algorithm,
+		Options:      comp.PseudoHeader,
+		Key:          t.computationKey(comp, env),
+		PseudoHeader: t.pseudoHeader(comp, targetData, env),
+	})
+	if err != nil {
+		log.Printf("❌ Computation %s failed: %v", comp.Algorithm, err)
+		return 0
 	}
+	return value
 }
 
-func (t *TunnelNode) parseScope(scope string, packet []byte, data []byte) (int, int) {
-	if scope == "" {
-		return 0, len(packet)
-	}
-
-	switch scope {
-	case "header":
-		return 0, len(packet)
-	case "payload", "data":
-		return len(packet), len(packet) + len(data)
-	case "all":
-		return 0, len(packet) + len(data)
-	default:
-		parts := strings.Split(scope, ":")
-		if len(parts) == 2 {
-			start := t.parseInt(parts[0], 0)
-			end := t.parseInt(parts[1], len(packet))
-			if end < 0 {
-				end = len(packet) + len(data) + end
-			}
-			return start, end
+// builtinComputations maps the normalized names of the built-in
+// computations to the names they are registered as.
+var builtinComputations = make(map[string]string)
+
+// algorithmKey normalizes an algorithm name so "SHA-256", "sha_256" and
+// "sha256", or "CRC-16/MODBUS" and "crc16_modbus", are the same.
+func algorithmKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '_', '/', ' ', '.':
+			return -1
 		}
-		return 0, len(packet)
-	}
+		return r
+	}, strings.ToUpper(name))
 }
 
-func (t *TunnelNode) parseInt(s string, defaultVal int) int {
-	if val, err := strconv.Atoi(s); err == nil {
-		return val
+// computationName returns the name an algorithm is registered as: the name
+// itself, or the built-in it spells differently. CRC names are kept, as the
+// CRC catalogue normalizes them.
+func computationName(algorithm string) (string, bool) {
+	if _, ok := plugin.LookupComputation(algorithm); ok {
+		return algorithm, true
+	}
+	if name, ok := builtinComputations[algorithmKey(algorithm)]; ok {
+		return name, true
 	}
-	return defaultVal
+	return algorithm, isCRC(algorithm)
 }
 
-func (t *TunnelNode) computeInternetChecksum(data []byte, pseudoHeader map[string]interface{}) uint16 {
-	sum := uint32(0)
-
-	if pseudoHeader != nil {
-		for key, value := range pseudoHeader {
-			switch key {
-			case "source_ip", "dest_ip":
-				if ip, ok := value.(string); ok {
-					if parsed := net.ParseIP(ip); parsed != nil {
-						ipBytes := parsed.To4()
-						if ipBytes == nil {
-							ipBytes = parsed.To16()
-						}
-						for i := 0; i < len(ipBytes); i += 2 {
-							if i+1 < len(ipBytes) {
-								sum += uint32(ipBytes[i])<<8 + uint32(ipBytes[i+1])
-							} else {
-								sum += uint32(ipBytes[i]) << 8
-							}
-						}
-					}
+// checkComputations resolves the algorithm of every computed field to its
+// registered name, and reports algorithms that name no computation and CRCs
+// that are neither in the catalogue nor given by their parameters.
+func checkComputations(protocols []Protocol) error {
+	for _, proto := range protocols {
+		if proto.LayerStack == nil {
+			continue
+		}
+		for _, def := range stackBlocks(proto.LayerStack) {
+			for _, field := range def.fields {
+				comp := field.Computation
+				if comp == nil {
+					continue
 				}
-			case "protocol", "length", "next_header":
-				if val, ok := t.toUint16(value); ok && val != 0 {
-					sum += uint32(val)
+				where := def.layer
+				if def.chunk != "" {
+					where += "." + def.chunk
 				}
-			default:
-				if val, ok := t.toUint16(value); ok && val != 0 {
-					sum += uint32(val)
+				name, ok := computationName(comp.Algorithm)
+				if !ok {
+					return fmt.Errorf("%s: %s.%s: unknown algorithm %q", proto.Identifier, where, field.Name, comp.Algorithm)
+				}
+				if _, registered := plugin.LookupComputation(name); !registered || name == "crc" {
+					// A CRC, which must be in the catalogue or have its parameters
+					if _, err := crcModelFor(name, comp.PseudoHeader); err != nil {
+						return fmt.Errorf("%s: %s.%s: %v", proto.Identifier, where, field.Name, err)
+					}
 				}
+				comp.Algorithm = name
 			}
 		}
 	}
+	return nil
+}
 
-	for i := 0; i < len(data); i += 2 {
-		if i+1 < len(data) {
-			sum += uint32(data[i])<<8 + uint32(data[i+1])
-		} else {
-			sum += uint32(data[i]) << 8
+// The built-in computations register like any other.
+func init() {
+	builtin := func(f func(data []byte, p plugin.Params) interface{}, names ...string) {
+		for _, name := range names {
+			builtinComputations[algorithmKey(name)] = name
+			plugin.RegisterComputation(name, plugin.ComputationFunc(func(data []byte, p plugin.Params) (interface{}, error) {
+				return f(data, p), nil
+			}))
+		}
+	}
+
+	builtin(func(data []byte, p plugin.Params) interface{} {
+		return computeInternetChecksum(data, p.PseudoHeader)
+	}, "checksum", "checksum_ip", "checksum_tcp", "checksum_udp", "checksum_icmp")
+	builtin(func(data []byte, p plugin.Params) interface{} {
+		return computeXOR(data, p.Algorithm)
+	}, "xor", "xor8", "xor16", "xor32")
+	builtin(func(data []byte, p plugin.Params) interface{} {
+		return computeSum(data, p.Algorithm)
+	}, "sum", "sum8", "sum16", "sum32")
+	builtin(func(data []byte, p plugin.Params) interface{} {
+		return computeHash(data, p.Algorithm)
+	}, "hash", "md5", "sha1", "sha256", "sha512")
+	builtin(func(data []byte, p plugin.Params) interface{} {
+		return computeHMAC(data, p.Algorithm, p.Key)
+	}, "hmac_md5", "hmac_sha1", "hmac_sha256", "hmac_sha512")
+	builtin(func(data []byte, p plugin.Params) interface{} {
+		return computeCustom(data, p.Options)
+	}, "custom")
+	builtinComputations[algorithmKey("crc")] = "crc"
+	plugin.RegisterComputation("crc", plugin.ComputationFunc(func(data []byte, p plugin.Params) (interface{}, error) {
+		return computeCRC(data, p.Algorithm, p.Options)
+	}))
+}
+
+// computeInternetChecksum is the one's complement sum of RFC 1071 over the
+// pseudo-header, if any, and data.
+func computeInternetChecksum(data, pseudoHeader []byte) uint16 {
+	sum := uint32(0)
+	for _, b := range [][]byte{pseudoHeader, data} {
+		for i := 0; i < len(b); i += 2 {
+			if i+1 < len(b) {
+				sum += uint32(b[i])<<8 + uint32(b[i+1])
+			} else {
+				sum += uint32(b[i]) << 8
+			}
 		}
 	}
 
@@ -322,69 +467,149 @@ func (t *TunnelNode) computeInternetChecksum(data []byte, pseudoHeader map[strin
 	return uint16(^sum)
 }
 
-func (t *TunnelNode) computeCRC(data []byte, algorithm string, params map[string]interface{}) interface{} {
-	var poly, init, xorOut uint64
-	var width int
-
-	switch algorithm {
-	case "crc8":
-		width, poly, init, xorOut = 8, 0x07, 0x00, 0x00
-	case "crc16":
-		width, poly, init, xorOut = 16, 0x8005, 0x0000, 0x0000
-	case "crc32":
-		width, poly, init, xorOut = 32, 0xEDB88320, 0xFFFFFFFF, 0xFFFFFFFF
-	case "crc64":
-		width, poly, init, xorOut = 64, 0x42F0E1EBA9EA3693, 0x0000000000000000, 0x0000000000000000
-	}
-
-	if params != nil {
-		if p, ok := params["polynomial"]; ok {
-			if val, err := strconv.ParseUint(fmt.Sprintf("%v", p), 0, 64); err == nil {
-				poly = val
+// pseudoHeader lays out the pseudo-header a checksum covers besides data:
+// source and destination address, protocol and length, in the IPv4 layout of
+// RFC 793 and RFC 768 or the IPv6 one of RFC 8200. checksum_tcp and
+// checksum_udp always have one; other checksums when pseudo_header is set.
+//
+// source_ip and dest_ip default to the addresses of the connection, as the
+// sender sees them, and may be expressions. protocol (or next_header)
+// defaults to 6 for TCP, 17 for UDP and 58 for ICMP, and length to the size
+// of data. "layout" picks "ipv4" or "ipv6"; by default IPv4 is used when both
+// addresses are IPv4.
+func (t *TunnelNode) pseudoHeader(comp *ComputationConfig, data []byte, env *exprEnv) []byte {
+	params := comp.PseudoHeader
+	var proto uint64
+	switch comp.Algorithm {
+	case "checksum_tcp":
+		proto = 6
+	case "checksum_udp":
+		proto = 17
+	case "checksum_icmp":
+		proto = 58
+	}
+	if params == nil && proto != 6 && proto != 17 {
+		return nil
+	}
+
+	src, dst := addrIP(env.src), addrIP(env.dst)
+	address := func(key string, ip *net.IP) {
+		if v, ok := params[key]; ok {
+			if parsed := net.ParseIP(fmt.Sprint(t.resolveValue(v, env))); parsed != nil {
+				*ip = parsed
 			}
 		}
-		if i, ok := params["init"]; ok {
-			if val, err := strconv.ParseUint(fmt.Sprintf("%v", i), 0, 64); err == nil {
-				init = val
-			}
+	}
+	address("source_ip", &src)
+	address("dest_ip", &dst)
+
+	for _, key := range []string{"protocol", "next_header"} {
+		if v, ok := toUint64(params[key]); ok {
+			proto = v
 		}
-		if x, ok := params["xor_out"]; ok {
-			if val, err := strconv.ParseUint(fmt.Sprintf("%v", x), 0, 64); err == nil {
-				xorOut = val
-			}
+	}
+	length := uint64(len(data))
+	if v, ok := toUint64(t.resolveValue(params["length"], env)); ok {
+		length = v
+	}
+
+	layout, _ := params["layout"].(string)
+	if layout == "" {
+		layout = "ipv6"
+		if src.To4() != nil && dst.To4() != nil {
+			layout = "ipv4"
 		}
 	}
+	if layout == "ipv4" {
+		header := make([]byte, 12)
+		copy(header[0:4], src.To4())
+		copy(header[4:8], dst.To4())
+		header[9] = byte(proto)
+		binary.BigEndian.PutUint16(header[10:], uint16(length))
+		return header
+	}
+	header := make([]byte, 40)
+	copy(header[0:16], src.To16())
+	copy(header[16:32], dst.To16())
+	binary.BigEndian.PutUint32(header[32:], uint32(length))
+	header[39] = byte(proto)
+	return header
+}
 
-	crc := init
-	mask := uint64((1 << width) - 1)
+// pseudoHeaderFromConnection reports whether a checksum covers addresses
+// taken from the connection. NAT may have changed those between the peers,
+// so the receiver doesn't hold them against a frame.
+func pseudoHeaderFromConnection(comp *ComputationConfig) bool {
+	switch comp.Algorithm {
+	case "checksum", "checksum_ip", "checksum_tcp", "checksum_udp", "checksum_icmp":
+	default:
+		return false
+	}
+	if comp.PseudoHeader == nil {
+		return comp.Algorithm == "checksum_tcp" || comp.Algorithm == "checksum_udp"
+	}
+	_, src := comp.PseudoHeader["source_ip"]
+	_, dst := comp.PseudoHeader["dest_ip"]
+	return !src || !dst
+}
 
-	for _, b := range data {
-		crc ^= uint64(b)
-		for i := 0; i < 8; i++ {
-			if crc&1 == 1 {
-				crc = (crc >> 1) ^ poly
-			} else {
-				crc >>= 1
+// addrIP is the IP address of a connection endpoint, or 0.0.0.0 when it
+// has none, as with net.Pipe.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				return ip
 			}
 		}
-		crc &= mask
 	}
+	return net.IPv4zero
+}
 
-	result := crc ^ xorOut
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	if addr != nil {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			n, _ := strconv.Atoi(port)
+			return n
+		}
+	}
+	return 0
+}
 
-	switch width {
-	case 8:
-		return uint8(result)
-	case 16:
-		return uint16(result)
-	case 32:
-		return uint32(result)
+// computeCRC computes a CRC from the catalogue in crc.go. The result has the
+// smallest integer type that holds the CRC's width.
+func computeCRC(data []byte, algorithm string, params map[string]interface{}) (interface{}, error) {
+	m, err := crcModelFor(algorithm, params)
+	if err != nil {
+		return nil, err
+	}
+	result := m.checksum(data)
+
+	switch {
+	case m.width <= 8:
+		return uint8(result), nil
+	case m.width <= 16:
+		return uint16(result), nil
+	case m.width <= 32:
+		return uint32(result), nil
 	default:
-		return result
+		return result, nil
 	}
 }
 
-func (t *TunnelNode) computeXOR(data []byte, algorithm string) interface{} {
+func computeXOR(data []byte, algorithm string) interface{} {
 	var result uint64
 
 	switch algorithm {
@@ -416,7 +641,7 @@ func (t *TunnelNode) computeXOR(data []byte, algorithm string) interface{} {
 	}
 }
 
-func (t *TunnelNode) computeSum(data []byte, algorithm string) interface{} {
+func computeSum(data []byte, algorithm string) interface{} {
 	var sum uint64
 
 	switch algorithm {
@@ -448,20 +673,50 @@ func (t *TunnelNode) computeSum(data []byte, algorithm string) interface{} {
 	}
 }
 
-func (t *TunnelNode) computeHash(data []byte, algorithm string) interface{} {
-	switch algorithm {
-	case "hash", "md5":
-		sum := uint32(0)
-		for _, b := range data {
-			sum = sum*31 + uint32(b)
-		}
-		return sum
-	default:
-		return t.computeSum(data, "sum32")
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// computeHash returns the digest of data; "hash" is SHA-256. The field the
+// digest goes into keeps its leftmost bytes.
+func computeHash(data []byte, algorithm string) interface{} {
+	newHash, ok := hashFuncs[algorithm]
+	if !ok {
+		newHash = sha256.New
+	}
+	h := newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func computeHMAC(data []byte, algorithm string, key []byte) interface{} {
+	mac := hmac.New(hashFuncs[strings.TrimPrefix(algorithm, "hmac_")], key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// computationKey resolves the key of an HMAC. It is an expression, so it can
+// come from the pattern or from a session variable; without one, the shared
+// -fpe-key is used.
+func (t *TunnelNode) computationKey(comp *ComputationConfig, env *exprEnv) []byte {
+	if comp.Key == "" {
+		return t.fpeKey
+	}
+	switch key := t.resolveValue(comp.Key, env).(type) {
+	case []byte:
+		return key
+	case string:
+		return []byte(key)
+	case int64:
+		return []byte(strconv.FormatInt(key, 10))
 	}
+	return t.fpeKey
 }
 
-func (t *TunnelNode) computeCustom(data []byte, params map[string]interface{}) interface{} {
+func computeCustom(data []byte, params map[string]interface{}) interface{} {
 	if params == nil {
 		return 0
 	}
@@ -469,44 +724,24 @@ func (t *TunnelNode) computeCustom(data []byte, params map[string]interface{}) i
 	if formula, ok := params["formula"].(string); ok {
 		switch formula {
 		case "two_complement":
-			sum := t.computeSum(data, "sum16").(uint16)
+			sum := computeSum(data, "sum16").(uint16)
 			return uint16(^sum + 1)
 		case "modulo_255":
-			sum := t.computeSum(data, "sum32").(uint32)
+			sum := computeSum(data, "sum32").(uint32)
 			return uint8(sum % 255)
 		case "fletcher16":
-			return t.computeFletcher16(data)
+			return computeFletcher16(data)
 		case "adler32":
-			return t.computeAdler32(data)
+			return computeAdler32(data)
 		default:
-			return t.computeSum(data, "sum16")
+			return computeSum(data, "sum16")
 		}
 	}
 
 	return 0
 }
 
-func (t *TunnelNode) computeDynamic(data []byte, comp *ComputationConfig) interface{} {
-	algorithm := comp.Algorithm
-	params := comp.PseudoHeader
-
-	if strings.Contains(algorithm, "crc") {
-		return t.computeCRC(data, algorithm, params)
-	}
-	if strings.Contains(algorithm, "checksum") || strings.Contains(algorithm, "sum") {
-		return t.computeInternetChecksum(data, params)
-	}
-	if strings.Contains(algorithm, "xor") {
-		return t.computeXOR(data, algorithm)
-	}
-	if strings.Contains(algorithm, "hash") {
-		return t.computeHash(data, algorithm)
-	}
-
-	return t.computeInternetChecksum(data, params)
-}
-
-func (t *TunnelNode) computeFletcher16(data []byte) uint16 {
+func computeFletcher16(data []byte) uint16 {
 	sum1, sum2 := uint16(0), uint16(0)
 	for _, b := range data {
 		sum1 = (sum1 + uint16(b)) % 255
@@ -515,7 +750,7 @@ func (t *TunnelNode) computeFletcher16(data []byte) uint16 {
 	return sum2<<8 | sum1
 }
 
-func (t *TunnelNode) computeAdler32(data []byte) uint32 {
+func computeAdler32(data []byte) uint32 {
 	a, b := uint32(1), uint32(0)
 	for _, c := range data {
 		a = (a + uint32(c)) % 65521
@@ -524,15 +759,12 @@ func (t *TunnelNode) computeAdler32(data []byte) uint32 {
 	return b<<16 | a
 }
 
-func (t *TunnelNode) getRandom(field Field) interface{} {
-	switch field.Type {
-	case "uint8":
-		return uint8(rand.Intn(256))
-	case "uint16_be", "uint16_le":
-		return uint16(rand.Intn(65536))
-	case "uint32_be", "uint32_le":
-		return uint32(rand.Uint32())
-	default:
-		return 0
+// getRandom draws a field's value from its range, or at random for its type.
+func (t *TunnelNode) getRandom(field Field, env *exprEnv) interface{} {
+	if field.RangeValues != nil {
+		if r, err := parseRange(field.RangeValues); err == nil {
+			return t.resolveValue(r.pick(field.Size), env)
+		}
 	}
+	return randomValue(field)
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// buildTestFrame builds a frame of proto's layer stack carrying env's data.
+func buildTestFrame(node *TunnelNode, proto *Protocol, env *exprEnv) []byte {
+	return node.buildLayerStack(proto.LayerStack, &packetContext{env: env, proto: proto})
+}
+
+func TestComputeDigests(t *testing.T) {
+	node := &TunnelNode{}
+	tests := []struct {
+		algorithm string
+		data      string
+		want      string
+	}{
+		{"md5", "abc", "900150983cd24fb0d6963f7d28e17f72"},
+		{"sha1", "abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"sha256", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha512", "abc", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{"hash", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"SHA-256", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha_1", "abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		// Empty input has a digest too
+		{"sha256", "", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"MD5", "", "d41d8cd98f00b204e9800998ecf8427e"},
+	}
+	for _, tt := range tests {
+		name, ok := computationName(tt.algorithm)
+		if !ok {
+			t.Errorf("%s isn't a computation", tt.algorithm)
+			continue
+		}
+		got := node.computeUniversalChecksum(&ComputationConfig{Algorithm: name}, []byte(tt.data), &exprEnv{})
+		if digest, ok := got.([]byte); !ok || !bytes.Equal(digest, mustHex(t, tt.want)) {
+			t.Errorf("%s of %q = %x, want %s", tt.algorithm, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestComputeHMACKeys(t *testing.T) {
+	// RFC 4231, test case 2
+	data := []byte("what do ya want for nothing?")
+	jefe := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+
+	node := &TunnelNode{fpeKey: []byte("Jefe")}
+	env := &exprEnv{vars: map[string]interface{}{"secret": "Jefe", "other": "Jeff"}}
+	tests := []struct {
+		algorithm, key string
+		want           string
+	}{
+		{"hmac_sha256", "Jefe", jefe},
+		{"HMAC_SHA256", "${secret}", jefe},
+		{"hmac-sha256", "", jefe}, // the -fpe-key
+		{"hmac_sha256", "${other}", "b756ec8c1f600eb277ee3f04163f581bd1c7e361f34a0727ad79c844ffc4bb83"},
+		{"hmac_md5", "Jefe", "750c783e6ab0b503eaa86e310a5db738"},
+	}
+	for _, tt := range tests {
+		name, ok := computationName(tt.algorithm)
+		if !ok {
+			t.Errorf("%s isn't a computation", tt.algorithm)
+			continue
+		}
+		got := node.computeUniversalChecksum(&ComputationConfig{Algorithm: name, Key: tt.key}, data, env)
+		if digest, ok := got.([]byte); !ok || !bytes.Equal(digest, mustHex(t, tt.want)) {
+			t.Errorf("%s with key %q = %x, want %s", tt.algorithm, tt.key, got, tt.want)
+		}
+	}
+
+	// A keyed digest of nothing isn't zero
+	got := node.computeUniversalChecksum(&ComputationConfig{Algorithm: "hmac_sha256", Key: "key"}, nil, env)
+	if want := "5d5d139563c95b5967b9bd9a8c9b233a9dedb45072794cd232dc1b74832607d0"; !bytes.Equal(got.([]byte), mustHex(t, want)) {
+		t.Errorf("HMAC of empty data = %x, want %s", got, want)
+	}
+}
+
+func TestFitDigest(t *testing.T) {
+	digest := mustHex(t, "0102030405060708090a")
+	tests := []struct {
+		field Field
+		want  interface{}
+	}{
+		{Field{Type: "uint32_be", Size: 4}, int64(0x01020304)},
+		{Field{Type: "uint16_le", Size: 2}, int64(0x0102)},
+		{Field{Type: "uint8", Size: 1}, int64(0x01)},
+		{Field{Type: "bytes", Size: 3}, mustHex(t, "010203")},
+		{Field{Type: "bytes", Size: 16}, digest},
+	}
+	for _, tt := range tests {
+		got := fitDigest(tt.field, digest)
+		if b, ok := tt.want.([]byte); ok {
+			if g, ok := got.([]byte); !ok || !bytes.Equal(g, b) {
+				t.Errorf("%s of %d bytes holds %x, want %x", tt.field.Type, tt.field.Size, got, b)
+			}
+		} else if got != tt.want {
+			t.Errorf("%s of %d bytes holds %#x, want %#x", tt.field.Type, tt.field.Size, got, tt.want)
+		}
+	}
+}
+
+const computationTestPattern = `{"protocols": [{"identifier": "mac",
+ "layer_stack": {"layer7": {"header_size": 12, "fields": [
+  {"name": "mac", "offset": 0, "size": 8, "type": "bytes",
+   "computation": {"algorithm": "HMAC-SHA256", "scope": "payload", "key": "${secret}"}},
+  {"name": "digest", "offset": 8, "size": 4, "type": "uint32_be",
+   "computation": {"algorithm": "sha-256", "scope": "payload"}}]}},
+ "state_machine": {"initial_state": "s", "variables": {"secret": {"type": "string", "initial": "k1"}},
+  "states": [{"name": "s", "transitions": []}]}}]}`
+
+func TestComputedFieldsVerify(t *testing.T) {
+	config := reliableTestConfig(t, computationTestPattern)
+	if err := checkComputations(config.Protocols); err != nil {
+		t.Fatal(err)
+	}
+	proto := &config.Protocols[0]
+	if mac := proto.LayerStack.Layer7.Fields[0].Computation; mac.Algorithm != "hmac_sha256" {
+		t.Errorf("HMAC-SHA256 resolved to %s", mac.Algorithm)
+	}
+
+	node := &TunnelNode{}
+	env := func(secret string, data []byte) *exprEnv {
+		return &exprEnv{data: data, vars: map[string]interface{}{"secret": secret}}
+	}
+
+	frame := buildTestFrame(node, proto, env("k1", []byte("payload")))
+	if want := mustHex(t, "f55aa6d0d62426dc239f59ed"); !bytes.Equal(frame[:12], want) || len(frame) != 12+7 {
+		t.Errorf("frame %x, want the HMAC and SHA-256 of its payload, %x", frame, want)
+	}
+	decoded, ok := node.decodeLayerStack(proto.LayerStack, frame, env("k1", nil))
+	if !ok || len(decoded.mismatched) != 0 || string(decoded.payload) != "payload" {
+		t.Fatalf("frame decodes as %+v, %v", decoded, ok)
+	}
+
+	tampered := slices.Clone(frame)
+	tampered[len(tampered)-1] ^= 1
+	decoded, ok = node.decodeLayerStack(proto.LayerStack, tampered, env("k1", nil))
+	if !ok || !slices.Equal(decoded.mismatched, []string{"layer7.mac", "layer7.digest"}) {
+		t.Errorf("tampered frame: %v mismatched", decoded.mismatched)
+	}
+
+	decoded, ok = node.decodeLayerStack(proto.LayerStack, frame, env("k2", nil))
+	if !ok || !slices.Equal(decoded.mismatched, []string{"layer7.mac"}) {
+		t.Errorf("wrong key: %v mismatched", decoded.mismatched)
+	}
+
+	// A frame without payload, such as a keepalive, still carries digests
+	frame = buildTestFrame(node, proto, env("k1", nil))
+	if want := mustHex(t, "e6f06a89ac679df9e3b0c442"); !bytes.Equal(frame, want) {
+		t.Errorf("empty frame %x, want %x", frame, want)
+	}
+	if decoded, ok := node.decodeLayerStack(proto.LayerStack, frame, env("k1", nil)); !ok || len(decoded.mismatched) != 0 {
+		t.Errorf("empty frame doesn't verify")
+	}
+}
+
+func TestCheckComputationsRejectsUnknown(t *testing.T) {
+	for _, algorithm := range []string{"sha-257", "hmac_sha3", "checksun"} {
+		config := reliableTestConfig(t, strings.Replace(computationTestPattern, "sha-256", algorithm, 1))
+		if err := checkComputations(config.Protocols); err == nil || !strings.Contains(err.Error(), algorithm) {
+			t.Errorf("%s: error %v", algorithm, err)
+		}
+	}
+}
+
+func TestPseudoHeader(t *testing.T) {
+	node := &TunnelNode{}
+	v4 := &exprEnv{
+		src:  &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000},
+		dst:  &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443},
+		vars: map[string]interface{}{"peer": "192.0.2.7"},
+	}
+	v6 := &exprEnv{
+		src: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000},
+		dst: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53},
+	}
+	tests := []struct {
+		algorithm string
+		params    map[string]interface{}
+		env       *exprEnv
+		want      string
+	}{
+		{"checksum_tcp", nil, v4, "0a000001" + "0a000002" + "0006" + "0014"},
+		{"checksum_udp", nil, v4, "0a000001" + "0a000002" + "0011" + "0014"},
+		{"checksum", nil, v4, ""},
+		{"checksum_icmp", nil, v4, ""},
+		{"checksum", map[string]interface{}{}, v4, "0a000001" + "0a000002" + "0000" + "0014"},
+		{"checksum_udp", nil, v6,
+			"20010db8000000000000000000000001" + "20010db8000000000000000000000002" + "00000014" + "00000011"},
+		{"checksum_icmp", map[string]interface{}{}, v6,
+			"20010db8000000000000000000000001" + "20010db8000000000000000000000002" + "00000014" + "0000003a"},
+		{"checksum_tcp", map[string]interface{}{"source_ip": "${peer}", "dest_ip": "198.51.100.1", "protocol": 17.0, "length": "${1000 + 24}"}, v4,
+			"c0000207" + "c6336401" + "0011" + "0400"},
+		{"checksum_tcp", map[string]interface{}{"layout": "ipv6"}, v4,
+			"00000000000000000000ffff0a000001" + "00000000000000000000ffff0a000002" + "00000014" + "00000006"},
+		// An IPv6 address on one side makes it the IPv6 layout
+		{"checksum_tcp", map[string]interface{}{"dest_ip": "2001:db8::2"}, v4,
+			"00000000000000000000ffff0a000001" + "20010db8000000000000000000000002" + "00000014" + "00000006"},
+	}
+	for _, tt := range tests {
+		comp := &ComputationConfig{Algorithm: tt.algorithm, PseudoHeader: tt.params}
+		if got := node.pseudoHeader(comp, make([]byte, 20), tt.env); !bytes.Equal(got, mustHex(t, tt.want)) {
+			t.Errorf("%s with %v: %x, want %s", tt.algorithm, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestPseudoHeaderFromConnection(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		params    map[string]interface{}
+		want      bool
+	}{
+		{"checksum_tcp", nil, true},
+		{"checksum_udp", map[string]interface{}{"protocol": 17.0}, true},
+		{"checksum_tcp", map[string]interface{}{"source_ip": "10.0.0.1"}, true},
+		{"checksum_tcp", map[string]interface{}{"source_ip": "10.0.0.1", "dest_ip": "10.0.0.2"}, false},
+		{"checksum", nil, false},
+		{"checksum", map[string]interface{}{}, true},
+		{"sha256", nil, false},
+	}
+	for _, tt := range tests {
+		if got := pseudoHeaderFromConnection(&ComputationConfig{Algorithm: tt.algorithm, PseudoHeader: tt.params}); got != tt.want {
+			t.Errorf("%s with %v: %v", tt.algorithm, tt.params, got)
+		}
+	}
+}
+
+func TestPseudoHeaderChecksumVerifies(t *testing.T) {
+	// The receiver sees the addresses swapped, and swaps them back
+	proto := testLayerStack(t, `{"layer4": {"header_size": 4, "fields": [
+	  {"name": "port", "offset": 0, "size": 2, "type": "uint16_be", "value": "${DST_PORT}"},
+	  {"name": "sum", "offset": 2, "size": 2, "type": "uint16_be", "computation": {"algorithm": "checksum_tcp", "scope": "layer4..end"}}]}}`)
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	server := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+	sender := &session{id: "c", local: client, remote: server, variables: map[string]interface{}{}}
+	receiver := &session{id: "s", local: server, remote: client, variables: map[string]interface{}{}}
+
+	node := &TunnelNode{}
+	frame := buildTestFrame(node, proto, sender.exprEnv([]byte("data")))
+	pseudo := mustHex(t, "0a000001"+"0a000002"+"0006"+"0008")
+	if computeInternetChecksum(frame, pseudo) != 0 || !bytes.Equal(frame[:2], []byte{0x01, 0xbb}) {
+		t.Fatalf("frame %x doesn't sum with the pseudo-header of the connection", frame)
+	}
+	decoded, ok := node.decodeLayerStack(proto.LayerStack, frame, receiver.receiveEnv(proto, frame))
+	if !ok || len(decoded.mismatched) != 0 {
+		t.Errorf("frame doesn't verify at the receiver: %v", decoded.mismatched)
+	}
+}
+
+func TestFrameStructureLineEnding(t *testing.T) {
+	config := reliableTestConfig(t, `{"protocols": [{"identifier": "http", "frame_structure": {
+	  "request_format": ["POST /upload HTTP/1.1\r\n", {"Host": "example.org"}, "\r\n", "<<VPN_DATA>>"],
+	  "line_ending": "\r\n"}}]}`)
+	proto := &config.Protocols[0]
+	node := &TunnelNode{}
+	sess, _ := newSessionStore(0, 0).create("http", nil)
+
+	// The payload may end in the line ending itself
+	for _, data := range []string{"", "data", "data\r\n", "\r\n", "\r\n\r\n"} {
+		frame := node.build("request", &packetContext{env: sess.exprEnv([]byte(data)), sess: sess, proto: proto})
+		if !bytes.HasSuffix(frame, []byte(data+"\r\n")) {
+			t.Errorf("frame %q doesn't end in the payload and line ending", frame)
+		}
+		if got, _, ok := node.tryUnwrapWithProtocol(frame, proto, sess); !ok || string(got) != data {
+			t.Errorf("payload %q unwraps as %q, %v", data, got, ok)
+		}
+	}
+}
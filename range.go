@@ -0,0 +1,303 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"tunnel/plugin"
+)
+
+// valueRange is a parsed Field.RangeValues, one of
+//
+//	{"min": 1, "max": 1500}                           a number in [min, max]
+//	["GET", "POST"] or {"choices": [...]}             one of the choices
+//	{"choices": ["a", "b"], "weights": [3, 1]}        a weighted choice
+//	{"charset": "hex", "min_length": 4, "max_length": 8}   a random string
+//	{"bytes": true, "min_length": 4, "max_length": 8}      random bytes
+//
+// Choices may be expressions. Lengths default to the field's size.
+type valueRange struct {
+	numeric  bool
+	min, max int64
+
+	choices []interface{}
+	weights []float64
+
+	charset        string
+	bytes          bool
+	minLen, maxLen int
+}
+
+// charsets are the named charsets; any other charset is taken literally.
+var charsets = map[string]string{
+	"alnum":  "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+	"alpha":  "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"lower":  "abcdefghijklmnopqrstuvwxyz",
+	"upper":  "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"digits": "0123456789",
+	"hex":    "0123456789abcdef",
+	"base64": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/",
+}
+
+func parseRange(v interface{}) (*valueRange, error) {
+	if list, ok := v.([]interface{}); ok {
+		v = map[string]interface{}{"choices": list}
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("range must be an object or a list of choices")
+	}
+
+	r := &valueRange{}
+	number := func(key string) (int64, bool, error) {
+		x, exists := m[key]
+		if !exists {
+			return 0, false, nil
+		}
+		n, ok := rangeInt(x)
+		if !ok {
+			return 0, false, fmt.Errorf("range %s %v is not an integer", key, x)
+		}
+		return n, true, nil
+	}
+
+	min, hasMin, err := number("min")
+	if err != nil {
+		return nil, err
+	}
+	max, hasMax, err := number("max")
+	if err != nil {
+		return nil, err
+	}
+	minLen, _, err := number("min_length")
+	if err != nil {
+		return nil, err
+	}
+	maxLen, hasMaxLen, err := number("max_length")
+	if err != nil {
+		return nil, err
+	}
+	if !hasMaxLen {
+		maxLen = minLen
+	}
+	if minLen < 0 || maxLen < minLen || maxLen > maxExprBytes {
+		return nil, fmt.Errorf("range lengths [%d, %d] are invalid", minLen, maxLen)
+	}
+	r.minLen, r.maxLen = int(minLen), int(maxLen)
+
+	switch {
+	case m["choices"] != nil:
+		choices, ok := m["choices"].([]interface{})
+		if !ok || len(choices) == 0 {
+			return nil, fmt.Errorf("range choices must be a non-empty list")
+		}
+		r.choices = choices
+		if w, exists := m["weights"]; exists {
+			weights, ok := w.([]interface{})
+			if !ok || len(weights) != len(choices) {
+				return nil, fmt.Errorf("range needs one weight per choice")
+			}
+			var total float64
+			for _, x := range weights {
+				f, ok := x.(float64)
+				if !ok || f < 0 {
+					return nil, fmt.Errorf("range weight %v is not a non-negative number", x)
+				}
+				total += f
+				r.weights = append(r.weights, f)
+			}
+			if total == 0 {
+				return nil, fmt.Errorf("range weights are all zero")
+			}
+		}
+	case hasMin || hasMax:
+		if !hasMin || !hasMax || max < min {
+			return nil, fmt.Errorf("range needs min <= max")
+		}
+		r.numeric, r.min, r.max = true, min, max
+	case m["bytes"] == true:
+		r.bytes = true
+	default:
+		charset, _ := m["charset"].(string)
+		if named, ok := charsets[charset]; ok {
+			charset = named
+		}
+		if charset == "" {
+			charset = charsets["alnum"]
+		}
+		r.charset = charset
+	}
+	return r, nil
+}
+
+// rangeInt reads a JSON number or a numeric string such as "0xffff".
+func rangeInt(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return int64(x), x == float64(int64(x))
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(x), 0, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// pick draws a value. size is the field's size, used when the range gives
+// no lengths.
+func (r *valueRange) pick(size int) interface{} {
+	switch {
+	case r.numeric:
+		return randomBetween(r.min, r.max)
+	case r.choices != nil:
+		return r.choices[weightedIndex(r.weights, len(r.choices))]
+	}
+
+	n := r.minLen + mrand.Intn(r.maxLen-r.minLen+1)
+	if r.maxLen == 0 {
+		n = size
+	}
+	if r.bytes {
+		return randomBytes(n)
+	}
+	return randomString(r.charset, n)
+}
+
+// randomBetween returns a number in [lo, hi].
+func randomBetween(lo, hi int64) int64 {
+	span := uint64(hi - lo)
+	if span == ^uint64(0) {
+		return int64(mrand.Uint64())
+	}
+	return lo + int64(mrand.Uint64()%(span+1))
+}
+
+// weightedIndex picks an index below n, in proportion to weights when there
+// are any.
+func weightedIndex(weights []float64, n int) int {
+	if len(weights) == 0 {
+		return mrand.Intn(n)
+	}
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	x := mrand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return len(weights) - 1
+}
+
+func randomString(charset string, n int) string {
+	runes := []rune(charset)
+	out := make([]rune, n)
+	for i := range out {
+		out[i] = runes[mrand.Intn(len(runes))]
+	}
+	return string(out)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	crand.Read(b)
+	return b
+}
+
+// randomDNSName makes a name of lowercase labels that takes size bytes in
+// wire format, or as close to it as names can come.
+func randomDNSName(size int) string {
+	var labels []string
+	for n := min(size, 255) - 1; n >= 2; {
+		l := min(n-1, 63)
+		if n-(l+1) == 1 {
+			l-- // leave room for a last label
+		}
+		labels = append(labels, randomString(charsets["lower"], l))
+		n -= l + 1
+	}
+	return strings.Join(labels, ".")
+}
+
+// randomBelow returns a number below mod, or any number when mod is 0.
+func randomBelow(mod uint64) uint64 {
+	if mod == 0 {
+		return mrand.Uint64()
+	}
+	return mrand.Uint64() % mod
+}
+
+// randomValue draws a value that fits a field of any type: numbers within
+// the field's width, addresses, every range of a bitfield, and random bytes
+// for the rest.
+func randomValue(field Field) interface{} {
+	if _, ok := plugin.LookupFieldCodec(field.Type); ok || strings.HasPrefix(field.Type, "uint") {
+		switch field.Type {
+		case "mac_address":
+			mac := randomBytes(6)
+			mac[0] = mac[0]&^1 | 2 // unicast, locally administered
+			return net.HardwareAddr(mac).String()
+		case "base64", "base64url", "base32", "pstring8", "pstring16", "dns_labels":
+			return randomBytes(field.Size)
+		case "dns_name":
+			return randomDNSName(field.Size)
+		}
+		return randomBelow(fieldModulus(field))
+	}
+
+	switch field.Type {
+	case "ipv4_address":
+		return net.IP(randomBytes(4)).String()
+	case "ipv6_address":
+		return net.IP(randomBytes(16)).String()
+	case "bitfield":
+		values := make(map[string]interface{}, len(field.Bits))
+		for name, bitField := range field.Bits {
+			values[name] = randomBelow(1 << bitField.Size)
+		}
+		return values
+	case "string":
+		return randomString(charsets["alnum"], field.Size)
+	}
+	return randomBytes(field.Size)
+}
+
+// checkRanges parses every range in the patterns so mistakes show up at load.
+func checkRanges(protocols []Protocol) error {
+	check := func(where string, fields []Field) error {
+		for _, field := range fields {
+			if field.RangeValues == nil {
+				continue
+			}
+			if _, err := parseRange(field.RangeValues); err != nil {
+				return fmt.Errorf("%s.%s: %v", where, field.Name, err)
+			}
+		}
+		return nil
+	}
+
+	for _, proto := range protocols {
+		if err := check(proto.Identifier, proto.FrameStructure.Fields); err != nil {
+			return err
+		}
+		if proto.LayerStack == nil {
+			continue
+		}
+		for _, def := range stackBlocks(proto.LayerStack) {
+			where := proto.Identifier + "." + def.layer
+			if def.chunk != "" {
+				where += "." + def.chunk
+			}
+			if err := check(where, def.fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
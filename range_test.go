@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func parseTestRange(t *testing.T, src string) (*valueRange, error) {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(src), &v); err != nil {
+		t.Fatal(err)
+	}
+	return parseRange(v)
+}
+
+func TestRangeErrors(t *testing.T) {
+	for _, src := range []string{
+		`"text"`,
+		`{"min": 5}`,
+		`{"min": 5, "max": 1}`,
+		`{"min": 1.5, "max": 3}`,
+		`{"min": "zero", "max": 3}`,
+		`{"choices": []}`,
+		`{"choices": "a"}`,
+		`{"choices": ["a", "b"], "weights": [1]}`,
+		`{"choices": ["a", "b"], "weights": [1, -1]}`,
+		`{"choices": ["a", "b"], "weights": [0, 0]}`,
+		`{"choices": ["a"], "weights": ["1"]}`,
+		`{"min_length": 4, "max_length": 2}`,
+		`{"min_length": -1}`,
+		`{"bytes": true, "max_length": 100000000}`,
+	} {
+		if _, err := parseTestRange(t, src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
+
+func TestRangeNumbers(t *testing.T) {
+	r, err := parseTestRange(t, `{"min": "0x10", "max": 20}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int64]bool{}
+	for i := 0; i < 2000; i++ {
+		n := r.pick(0).(int64)
+		if n < 16 || n > 20 {
+			t.Fatalf("picked %d outside [16, 20]", n)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 5 {
+		t.Errorf("picked %d distinct values of 5", len(seen))
+	}
+
+	for _, tt := range []struct{ lo, hi int64 }{
+		{-3, -3}, {-5, 5}, {-1 << 63, 1<<63 - 1}, {1<<63 - 2, 1<<63 - 1},
+	} {
+		for i := 0; i < 100; i++ {
+			if n := randomBetween(tt.lo, tt.hi); n < tt.lo || n > tt.hi {
+				t.Fatalf("randomBetween(%d, %d) = %d", tt.lo, tt.hi, n)
+			}
+		}
+	}
+}
+
+func TestRangeChoices(t *testing.T) {
+	r, err := parseTestRange(t, `["GET", "POST"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[interface{}]int{}
+	for i := 0; i < 1000; i++ {
+		counts[r.pick(0)]++
+	}
+	if len(counts) != 2 || counts["GET"] == 0 || counts["POST"] == 0 {
+		t.Errorf("choices picked %v", counts)
+	}
+
+	r, err = parseTestRange(t, `{"choices": ["a", "b", "c"], "weights": [3, 0, 1]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts = map[interface{}]int{}
+	for i := 0; i < 4000; i++ {
+		counts[r.pick(0)]++
+	}
+	if counts["b"] != 0 {
+		t.Errorf("zero weight choice picked %d times", counts["b"])
+	}
+	if ratio := float64(counts["a"]) / float64(counts["c"]); ratio < 2.4 || ratio > 3.7 {
+		t.Errorf("weights 3:1 picked %v", counts)
+	}
+}
+
+func TestRangeStrings(t *testing.T) {
+	tests := []struct {
+		src            string
+		size           int
+		minLen, maxLen int
+		alphabet       string
+	}{
+		{`{"charset": "hex", "min_length": 4, "max_length": 8}`, 0, 4, 8, charsets["hex"]},
+		{`{"charset": "xyz", "min_length": 3}`, 0, 3, 3, "xyz"},
+		{`{"charset": "digits"}`, 6, 6, 6, charsets["digits"]},
+		{`{}`, 5, 5, 5, charsets["alnum"]},
+		{`{"charset": "äö", "min_length": 2}`, 0, 2, 2, "äö"},
+	}
+	for _, tt := range tests {
+		r, err := parseTestRange(t, tt.src)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.src, err)
+		}
+		for i := 0; i < 200; i++ {
+			s := r.pick(tt.size).(string)
+			runes := []rune(s)
+			if len(runes) < tt.minLen || len(runes) > tt.maxLen {
+				t.Fatalf("%s: %q has length %d", tt.src, s, len(runes))
+			}
+			for _, c := range runes {
+				if !strings.ContainsRune(tt.alphabet, c) {
+					t.Fatalf("%s: %q has %q", tt.src, s, c)
+				}
+			}
+		}
+	}
+
+	r, err := parseTestRange(t, `{"bytes": true, "min_length": 2, "max_length": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if b := r.pick(10).([]byte); len(b) < 2 || len(b) > 3 {
+			t.Fatalf("picked %d bytes", len(b))
+		}
+	}
+}
+
+func TestRandomValueFitsField(t *testing.T) {
+	for i := 0; i < 500; i++ {
+		if v := randomValue(Field{Type: "uint8"}).(uint64); v > 0xff {
+			t.Fatalf("uint8 got %d", v)
+		}
+		if v := randomValue(Field{Type: "uint16_be"}).(uint64); v > 0xffff {
+			t.Fatalf("uint16 got %d", v)
+		}
+		if v := randomValue(Field{Type: "quic_varint"}).(uint64); v >= 1<<62 {
+			t.Fatalf("quic_varint got %d", v)
+		}
+
+		bits := randomValue(Field{Type: "bitfield", Bits: map[string]BitField{
+			"flag": {Size: 1}, "nibble": {Size: 4}, "wide": {Size: 64},
+		}}).(map[string]interface{})
+		if bits["flag"].(uint64) > 1 || bits["nibble"].(uint64) > 15 {
+			t.Fatalf("bitfield got %v", bits)
+		}
+
+		mac, err := net.ParseMAC(randomValue(Field{Type: "mac_address"}).(string))
+		if err != nil || mac[0]&1 != 0 || mac[0]&2 == 0 {
+			t.Fatalf("mac_address got %v, %v", mac, err)
+		}
+	}
+
+	if ip := net.ParseIP(randomValue(Field{Type: "ipv4_address"}).(string)); ip == nil || ip.To4() == nil {
+		t.Errorf("ipv4_address got %v", ip)
+	}
+	if s := randomValue(Field{Type: "string", Size: 7}).(string); len(s) != 7 {
+		t.Errorf("string got %q", s)
+	}
+	if b := randomValue(Field{Type: "bytes", Size: 9}).([]byte); len(b) != 9 {
+		t.Errorf("bytes got %x", b)
+	}
+	for _, size := range []int{0, 3, 12, 64, 65, 66, 100, 129, 255} {
+		name := randomValue(Field{Type: "dns_name", Size: size}).(string)
+		wire, ok := builtinCodecs["dns_name"].encode(name, 0)
+		if !ok || size > 0 && len(wire) != size {
+			t.Errorf("dns_name of size %d got %q, %d bytes", size, name, len(wire))
+		}
+	}
+}
+
+func TestCheckRanges(t *testing.T) {
+	protocols := []Protocol{{
+		Identifier: "p",
+		FrameStructure: FrameStructure{Fields: []Field{
+			{Name: "ok", RangeValues: map[string]interface{}{"min": 1.0, "max": 2.0}},
+			{Name: "bad", RangeValues: map[string]interface{}{"min": 3.0, "max": 2.0}},
+		}},
+	}}
+	err := checkRanges(protocols)
+	if err == nil || !strings.Contains(err.Error(), "p.bad") {
+		t.Errorf("checkRanges = %v, want an error naming p.bad", err)
+	}
+}
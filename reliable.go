@@ -0,0 +1,643 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reliable streams carry a byte stream over UDP protocols that declare
+// "reliability". Data frames are numbered in the protocol's seq_field, and
+// every frame acknowledges the next number its sender expects in ack_field,
+// and the frames it holds beyond that in the sack_field bitmap (bit i for
+// ack+1+i). Frames are sent again after a retransmission timeout estimated
+// as in RFC 6298, or sooner once three duplicate acknowledgements or three
+// later frames arriving show them lost, and a Reno congestion window (RFC
+// 5681) limits the frames in flight. Frames without
+// payload, such as pure acknowledgements and keepalives, aren't numbered.
+
+const (
+	defaultReliableWindow = 256
+	defaultMinRTO         = 200 * time.Millisecond
+	defaultMaxRTO         = 60 * time.Second
+	initialRTO            = time.Second
+	rtoGranularity        = time.Millisecond
+	initialWindow         = 10 // frames, as RFC 6928
+	dupAckThreshold       = 3
+	delayedAck            = 20 * time.Millisecond
+)
+
+// segment is a data frame waiting for its acknowledgement.
+type segment struct {
+	seq         uint64
+	data        []byte
+	sentAt      time.Time
+	retransmits int
+	sacked      bool
+	lost        bool // after a timeout, until sent again
+}
+
+// segmentHeader is what a received frame says about the stream.
+type segmentHeader struct {
+	seq, ack, sack uint64
+	seqMod, ackMod uint64
+	sackWidth      int
+}
+
+type reliableStream struct {
+	t              *TunnelNode
+	sess           *session
+	out            *frameWriter
+	window         int
+	minRTO, maxRTO time.Duration
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	closed bool
+	done   chan struct{} // closed with the stream
+
+	// Payloads in order wait in ready for the delivery goroutine
+	ready        chan []byte
+	deliveryOnce sync.Once
+	deliveryErr  error
+
+	// Sending: frames sndUna up to sndNext are in flight
+	sndUna, sndNext   uint64
+	inflight          map[uint64]*segment
+	cwnd, ssthresh    float64
+	dupAcks           int
+	recoveryEnd       uint64 // losses before this frame cut the window once
+	srtt, rttvar, rto time.Duration
+	rtoTimer          *time.Timer
+
+	// Receiving: frames before rcvNext are delivered
+	rcvNext  uint64
+	pending  map[uint64][]byte // received beyond rcvNext
+	unacked  int               // frames delivered since the last acknowledgement
+	ackTimer *time.Timer
+}
+
+// reliableStream returns the session's reliable stream, starting it with
+// proto's settings, if the session runs over UDP and proto asks for one.
+func (t *TunnelNode) reliableStream(sess *session, proto *Protocol) *reliableStream {
+	cfg := proto.Reliability
+	if cfg == nil || sess.transport != "udp" {
+		return nil
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.reliable == nil {
+		s := &reliableStream{
+			t:        t,
+			sess:     sess,
+			out:      sess.machine.out,
+			window:   cfg.Window,
+			minRTO:   time.Duration(cfg.MinRTO) * time.Millisecond,
+			maxRTO:   time.Duration(cfg.MaxRTO) * time.Millisecond,
+			done:     make(chan struct{}),
+			inflight: make(map[uint64]*segment),
+			pending:  make(map[uint64][]byte),
+			cwnd:     initialWindow,
+			ssthresh: math.Inf(1),
+			rto:      initialRTO,
+		}
+		if s.window <= 0 {
+			s.window = defaultReliableWindow
+		}
+		if s.minRTO <= 0 {
+			s.minRTO = defaultMinRTO
+		}
+		if s.maxRTO <= 0 {
+			s.maxRTO = defaultMaxRTO
+		}
+		s.ready = make(chan []byte, s.window)
+		s.cond = sync.NewCond(&s.mu)
+		sess.reliable = s
+	}
+	return sess.reliable
+}
+
+// send queues data as the next frame of the stream, waiting while the
+// window is full, and transmits it.
+func (s *reliableStream) send(data []byte) (int, error) {
+	s.mu.Lock()
+	for !s.closed && s.pipe() >= s.limit() {
+		s.cond.Wait()
+	}
+	if s.closed {
+		s.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	seg := &segment{seq: s.sndNext, data: append([]byte(nil), data...)}
+	s.sndNext++
+	s.inflight[seg.seq] = seg
+	s.mu.Unlock()
+
+	return s.transmit(seg)
+}
+
+// transmit builds a frame for seg with the protocol of the moment and the
+// latest acknowledgement, and writes it.
+func (s *reliableStream) transmit(seg *segment) (int, error) {
+	proto := s.t.selectProtocol(s.sess.transport)
+	frame := s.t.buildSegment(proto, s.sess, seg.seq, seg.data)
+
+	s.mu.Lock()
+	seg.sentAt = time.Now()
+	s.armTimer()
+	s.mu.Unlock()
+	return len(frame), s.out.writeFrame(frame)
+}
+
+// receive takes in a frame's acknowledgement and data, and queues the
+// payloads now in order for deliver. It returns the error deliver failed
+// with, if it has.
+func (s *reliableStream) receive(proto *Protocol, decoded *decodedFrame, data []byte, deliver func([]byte) error) error {
+	s.deliveryOnce.Do(func() { go s.deliver(deliver) })
+
+	hdr, ok := readSegmentHeader(proto.Reliability, decoded)
+	if !ok {
+		return s.err()
+	}
+
+	s.mu.Lock()
+	retransmit := s.onAck(hdr, len(data) == 0)
+
+	// queue passes a payload on unless the queue is full, in which case it
+	// counts as lost
+	queue := func(payload []byte) bool {
+		select {
+		case s.ready <- payload:
+			return true
+		default:
+			return false
+		}
+	}
+
+	ackNow := false
+	if len(data) > 0 {
+		seq := unwrapSerial(hdr.seq, hdr.seqMod, s.rcvNext)
+		switch {
+		case seq < s.rcvNext:
+			// A duplicate: the acknowledgement must have been lost
+			ackNow = true
+		case seq >= s.rcvNext+uint64(s.window):
+			// Beyond the window; the sender will try again
+		case seq == s.rcvNext:
+			if !queue(append([]byte(nil), data...)) {
+				ackNow = true
+				break
+			}
+			filled := len(s.pending) > 0
+			s.rcvNext++
+			for {
+				next, ok := s.pending[s.rcvNext]
+				if !ok || !queue(next) {
+					break
+				}
+				delete(s.pending, s.rcvNext)
+				s.rcvNext++
+			}
+			s.unacked++
+			// Every second frame is acknowledged at once, as is filling a gap
+			ackNow = filled || s.unacked >= 2
+		default:
+			if _, dup := s.pending[seq]; !dup {
+				s.pending[seq] = append([]byte(nil), data...)
+			}
+			ackNow = true
+		}
+	}
+	if !ackNow && s.unacked > 0 && s.ackTimer == nil && !s.closed {
+		s.ackTimer = time.AfterFunc(delayedAck, s.sendAck)
+	}
+	s.mu.Unlock()
+
+	for _, seg := range retransmit {
+		s.transmit(seg)
+	}
+	if ackNow {
+		s.sendAck()
+	}
+	return s.err()
+}
+
+// deliver passes queued payloads on until the stream closes or deliver
+// fails, which ends the session.
+func (s *reliableStream) deliver(deliver func([]byte) error) {
+	for {
+		select {
+		case payload := <-s.ready:
+			s.sess.machine.onData(payload)
+			if err := deliver(payload); err != nil {
+				s.mu.Lock()
+				s.deliveryErr = err
+				s.mu.Unlock()
+				if s.sess.close != nil {
+					s.sess.close()
+				}
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *reliableStream) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deliveryErr
+}
+
+// onAck processes the acknowledgement of a received frame and returns the
+// frames to retransmit at once. Callers hold s.mu.
+func (s *reliableStream) onAck(hdr segmentHeader, pure bool) []*segment {
+	ack := unwrapSerial(hdr.ack, hdr.ackMod, s.sndUna)
+	if ack < s.sndUna || ack > s.sndNext {
+		return nil // old or bogus
+	}
+	for i := 0; i < hdr.sackWidth; i++ {
+		if hdr.sack>>uint(i)&1 == 1 {
+			if seg, ok := s.inflight[ack+1+uint64(i)]; ok {
+				seg.sacked = true
+			}
+		}
+	}
+	if hdr.sack != 0 {
+		s.cond.Broadcast() // frames known to have arrived leave the pipe
+	}
+
+	if ack == s.sndUna {
+		// Duplicate acknowledgements mean frames after a lost one arrive
+		if pure && len(s.inflight) > 0 {
+			s.dupAcks++
+		}
+		return s.lostSegments()
+	}
+
+	// Only frames sent once give RTT samples (Karn's algorithm)
+	var sample *segment
+	for seq := s.sndUna; seq < ack; seq++ {
+		if seg, ok := s.inflight[seq]; ok {
+			if seg.retransmits == 0 {
+				sample = seg
+			}
+			delete(s.inflight, seq)
+		}
+		if s.cwnd < s.ssthresh {
+			s.cwnd++ // slow start
+		} else {
+			s.cwnd += 1 / s.cwnd // congestion avoidance
+		}
+	}
+	s.sndUna = ack
+	s.dupAcks = 0
+	if sample != nil {
+		s.updateRTO(time.Since(sample.sentAt))
+	} else if s.srtt > 0 {
+		// New data got through, so the timer needn't stay backed off
+		s.rto = s.rtoEstimate()
+	}
+	s.restartTimer()
+	s.cond.Broadcast()
+	return s.lostSegments()
+}
+
+// lostSegments finds the frames to count as lost and send again: the first
+// frame in flight after three duplicate acknowledgements, and, as in RFC
+// 6675, any frame with three or more frames after it known to have arrived.
+// Each is retransmitted this way once; after that it is up to the timer,
+// and to the window for frames a timeout left for lost. Losses cut the
+// congestion window once per window of data. Callers hold s.mu.
+func (s *reliableStream) lostSegments() []*segment {
+	var lost []*segment
+	above := 0
+	for seq := s.sndNext; seq > s.sndUna; seq-- {
+		seg, ok := s.inflight[seq-1]
+		if !ok {
+			continue
+		}
+		if seg.sacked {
+			above++
+			continue
+		}
+		first := seq-1 == s.sndUna && s.dupAcks >= dupAckThreshold
+		if seg.retransmits == 0 && (above >= dupAckThreshold || first) {
+			seg.lost = false
+			seg.retransmits++
+			lost = append(lost, seg)
+		}
+	}
+	if len(lost) > 0 && s.sndUna >= s.recoveryEnd {
+		// Fast recovery
+		s.recoveryEnd = s.sndNext
+		s.ssthresh = math.Max(float64(s.pipe())/2, 2)
+		s.cwnd = s.ssthresh
+	}
+	// Frames a timeout left for lost go again in order as the window opens
+	for seq := s.sndUna; seq < s.sndNext && s.pipe() < s.limit(); seq++ {
+		if seg, ok := s.inflight[seq]; ok && seg.lost {
+			seg.lost = false
+			seg.retransmits++
+			lost = append(lost, seg)
+		}
+	}
+	return lost
+}
+
+// updateRTO folds an RTT sample into the estimate (RFC 6298 2.2, 2.3).
+func (s *reliableStream) updateRTO(r time.Duration) {
+	if s.srtt == 0 {
+		s.srtt, s.rttvar = r, r/2
+	} else {
+		diff := s.srtt - r
+		if diff < 0 {
+			diff = -diff
+		}
+		s.rttvar = (3*s.rttvar + diff) / 4
+		s.srtt = (7*s.srtt + r) / 8
+	}
+	s.rto = s.rtoEstimate()
+}
+
+// rtoEstimate is the timeout the RTT estimate gives, within bounds.
+func (s *reliableStream) rtoEstimate() time.Duration {
+	variance := 4 * s.rttvar
+	if variance < rtoGranularity {
+		variance = rtoGranularity
+	}
+	rto := s.srtt + variance
+	if rto < s.minRTO {
+		rto = s.minRTO
+	}
+	if rto > s.maxRTO {
+		rto = s.maxRTO
+	}
+	return rto
+}
+
+// armTimer starts the retransmission timer if frames are in flight and it
+// isn't running. Callers hold s.mu.
+func (s *reliableStream) armTimer() {
+	if s.rtoTimer == nil && len(s.inflight) > 0 && !s.closed {
+		s.rtoTimer = time.AfterFunc(s.rto, s.onTimeout)
+	}
+}
+
+func (s *reliableStream) restartTimer() {
+	if s.rtoTimer != nil {
+		s.rtoTimer.Stop()
+		s.rtoTimer = nil
+	}
+	s.armTimer()
+}
+
+// onTimeout retransmits the first frame not known to have arrived, backs
+// the timer off and collapses the congestion window (RFC 6298 5.4-5.6). The
+// other frames not known to have arrived count as lost, so they leave the
+// pipe and acknowledgements send them again (RFC 6675 5.1).
+func (s *reliableStream) onTimeout() {
+	s.mu.Lock()
+	s.rtoTimer = nil
+	if s.closed || len(s.inflight) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	seg := s.inflight[s.sndUna]
+	for seq := s.sndUna; seq < s.sndNext; seq++ {
+		if next, ok := s.inflight[seq]; ok && !next.sacked {
+			seg = next
+			break
+		}
+	}
+	if seg == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.ssthresh = math.Max(float64(s.pipe())/2, 2)
+	s.cwnd = 1
+	for _, other := range s.inflight {
+		other.lost = !other.sacked && other != seg
+	}
+	s.dupAcks = 0
+	s.recoveryEnd = s.sndNext
+	s.rto *= 2
+	if s.rto > s.maxRTO {
+		s.rto = s.maxRTO
+	}
+	seg.lost = false
+	seg.retransmits++
+	s.mu.Unlock()
+
+	s.transmit(seg)
+}
+
+// sendAck sends a frame without payload, which carries the latest
+// acknowledgement.
+func (s *reliableStream) sendAck() {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return
+	}
+	proto := s.t.selectProtocol(s.sess.transport)
+	s.out.writeFrame(s.t.buildPacket("request", proto, s.sess, nil))
+}
+
+// pipe counts the frames in flight neither known to have arrived nor taken
+// for lost. Callers hold s.mu.
+func (s *reliableStream) pipe() int {
+	n := 0
+	for _, seg := range s.inflight {
+		if !seg.sacked && !seg.lost {
+			n++
+		}
+	}
+	return n
+}
+
+// limit is how many frames may be in flight. Callers hold s.mu.
+func (s *reliableStream) limit() int {
+	n := int(s.cwnd)
+	if n > s.window {
+		n = s.window
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// nextSeq is the number the next data frame will take.
+func (s *reliableStream) nextSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sndNext
+}
+
+// acknowledge returns the number of the next frame expected, for a frame
+// about to carry it, which settles any delayed acknowledgement.
+func (s *reliableStream) acknowledge() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unacked = 0
+	if s.ackTimer != nil {
+		s.ackTimer.Stop()
+		s.ackTimer = nil
+	}
+	return s.rcvNext
+}
+
+// sackBits maps the frames held beyond the next one expected.
+func (s *reliableStream) sackBits(width int) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sack uint64
+	for i := 0; i < width; i++ {
+		if _, ok := s.pending[s.rcvNext+1+uint64(i)]; ok {
+			sack |= 1 << uint(i)
+		}
+	}
+	return sack
+}
+
+func (s *reliableStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		close(s.done)
+	}
+	s.closed = true
+	if s.rtoTimer != nil {
+		s.rtoTimer.Stop()
+	}
+	if s.ackTimer != nil {
+		s.ackTimer.Stop()
+	}
+	s.cond.Broadcast()
+}
+
+// reliabilityValue fills the fields a protocol's reliability names from the
+// session's stream.
+func reliabilityValue(field Field, ctx *packetContext) (interface{}, bool) {
+	cfg := ctx.proto.Reliability
+	if cfg == nil {
+		return nil, false
+	}
+	stream := ctx.sess.stream()
+	if stream == nil {
+		return nil, false
+	}
+
+	mod := fieldModulus(field)
+	switch field.Name {
+	case cfg.SeqField:
+		if ctx.segment != nil {
+			return wrap(*ctx.segment, mod), true
+		}
+		return wrap(stream.nextSeq(), mod), true
+	case cfg.AckField:
+		return wrap(stream.acknowledge(), mod), true
+	case cfg.SackField:
+		return stream.sackBits(modulusBits(mod)), true
+	}
+	return nil, false
+}
+
+// readSegmentHeader reads the reliability fields of a decoded frame.
+func readSegmentHeader(cfg *ReliabilityConfig, decoded *decodedFrame) (segmentHeader, bool) {
+	var hdr segmentHeader
+	if decoded == nil {
+		return hdr, false
+	}
+	hasSeq, hasAck := false, false
+	for _, df := range decoded.fields {
+		v, ok := toUint64(df.value)
+		if !ok {
+			continue
+		}
+		mod := fieldModulus(df.field)
+		switch df.name {
+		case cfg.SeqField:
+			hdr.seq, hdr.seqMod, hasSeq = v, mod, true
+		case cfg.AckField:
+			hdr.ack, hdr.ackMod, hasAck = v, mod, true
+		case cfg.SackField:
+			hdr.sack, hdr.sackWidth = v, modulusBits(mod)
+		}
+	}
+	return hdr, hasSeq && hasAck
+}
+
+// unwrapSerial turns a counter read modulo mod back into the full number
+// closest to near.
+func unwrapSerial(v, mod, near uint64) uint64 {
+	if mod == 0 {
+		return v
+	}
+	d := (v%mod + mod - near%mod) % mod
+	if d >= mod/2 && near >= mod-d {
+		return near - (mod - d)
+	}
+	return near + d
+}
+
+// modulusBits is the width in bits of a power-of-two modulus; 0 stands for
+// 2^64.
+func modulusBits(mod uint64) int {
+	if mod == 0 {
+		return 64
+	}
+	return bits.Len64(mod) - 1
+}
+
+// checkReliability validates the reliability settings of a protocol.
+func checkReliability(proto *Protocol) error {
+	cfg := proto.Reliability
+	if protocolTransport(proto) != "udp" {
+		return fmt.Errorf("reliability needs the udp transport")
+	}
+	if proto.LayerStack == nil {
+		return fmt.Errorf("reliability needs a layer stack")
+	}
+	window := uint64(cfg.Window)
+	if cfg.Window <= 0 {
+		window = defaultReliableWindow
+	}
+
+	fields := map[string]Field{}
+	for _, def := range stackBlocks(proto.LayerStack) {
+		for _, field := range def.fields {
+			fields[field.Name] = field
+		}
+	}
+	if cfg.SeqField == "" || cfg.AckField == "" {
+		return fmt.Errorf("reliability needs seq_field and ack_field")
+	}
+	for _, name := range []string{cfg.SeqField, cfg.AckField, cfg.SackField} {
+		if name == "" {
+			continue
+		}
+		field, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("reliability field %q names no layer stack field", name)
+		}
+		if field.Sequence != nil || field.Length != nil || field.Computation != nil {
+			return fmt.Errorf("reliability field %q can't have its own sequence, length or computation", name)
+		}
+		mod := fieldModulus(field)
+		if mod != 0 && mod&(mod-1) != 0 {
+			return fmt.Errorf("reliability field %q must be a binary integer", name)
+		}
+		if name != cfg.SackField && mod != 0 && mod < 2*window {
+			return fmt.Errorf("reliability field %q is too narrow for a window of %d", name, window)
+		}
+	}
+	return nil
+}
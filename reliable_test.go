@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnwrapSerial(t *testing.T) {
+	tests := []struct {
+		v, mod, near, want uint64
+	}{
+		{5, 256, 3, 5},
+		{2, 256, 250, 258},
+		{250, 256, 260, 250},
+		{255, 256, 256, 255},
+		{250, 256, 3, 250}, // never below zero
+		{3, 256, 3 + 5*256, 3 + 5*256},
+		{127 + 256, 256, 0, 127},
+		{7, 0, 100, 7},
+	}
+	for _, tt := range tests {
+		if got := unwrapSerial(tt.v, tt.mod, tt.near); got != tt.want {
+			t.Errorf("unwrapSerial(%d, %d, %d) = %d, want %d", tt.v, tt.mod, tt.near, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		mod  uint64
+		want int
+	}{{0, 64}, {2, 1}, {256, 8}, {1 << 32, 32}} {
+		if got := modulusBits(tt.mod); got != tt.want {
+			t.Errorf("modulusBits(%d) = %d, want %d", tt.mod, got, tt.want)
+		}
+	}
+}
+
+// testStream is a stream with n frames in flight whose timer never fires
+// during a test.
+func testStream(t *testing.T, n int) *reliableStream {
+	s := &reliableStream{
+		window:   defaultReliableWindow,
+		minRTO:   time.Hour,
+		maxRTO:   time.Hour,
+		done:     make(chan struct{}),
+		inflight: make(map[uint64]*segment),
+		pending:  make(map[uint64][]byte),
+		cwnd:     initialWindow,
+		ssthresh: math.Inf(1),
+		rto:      time.Hour,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < n; i++ {
+		s.inflight[s.sndNext] = &segment{seq: s.sndNext, sentAt: time.Now()}
+		s.sndNext++
+	}
+	t.Cleanup(s.close)
+	return s
+}
+
+func ackHeader(ack, sack uint64) segmentHeader {
+	return segmentHeader{ack: ack, sack: sack, ackMod: 256, seqMod: 256, sackWidth: 8}
+}
+
+func TestReliableAck(t *testing.T) {
+	s := testStream(t, 4)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lost := s.onAck(ackHeader(2, 0), false); len(lost) != 0 {
+		t.Errorf("ack 2 lost %d frames", len(lost))
+	}
+	if s.sndUna != 2 || len(s.inflight) != 2 {
+		t.Errorf("after ack 2: sndUna %d, %d in flight", s.sndUna, len(s.inflight))
+	}
+	if s.cwnd != initialWindow+2 {
+		t.Errorf("slow start cwnd %v, want %d", s.cwnd, initialWindow+2)
+	}
+	if s.srtt == 0 || s.rto < s.minRTO {
+		t.Errorf("RTT sample gave srtt %v, rto %v", s.srtt, s.rto)
+	}
+
+	// Acknowledgements beyond what was sent are ignored
+	s.onAck(ackHeader(9, 0), false)
+	if s.sndUna != 2 {
+		t.Errorf("bogus ack moved sndUna to %d", s.sndUna)
+	}
+
+	// Counters wrap with their field
+	s.sndUna, s.sndNext = 254, 258
+	s.inflight = map[uint64]*segment{}
+	for seq := uint64(254); seq < 258; seq++ {
+		s.inflight[seq] = &segment{seq: seq, retransmits: 1}
+	}
+	s.onAck(ackHeader(1, 0), false)
+	if s.sndUna != 257 || len(s.inflight) != 1 {
+		t.Errorf("wrapped ack 1: sndUna %d, %d in flight", s.sndUna, len(s.inflight))
+	}
+}
+
+func TestReliableFastRetransmit(t *testing.T) {
+	s := testStream(t, 6)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Data frames carrying the same acknowledgement aren't duplicates
+	s.onAck(ackHeader(0, 0), false)
+	for i := 1; i < dupAckThreshold; i++ {
+		if lost := s.onAck(ackHeader(0, 0), true); len(lost) != 0 {
+			t.Fatalf("dup ack %d lost %d frames", i, len(lost))
+		}
+	}
+	lost := s.onAck(ackHeader(0, 0), true)
+	if len(lost) != 1 || lost[0].seq != 0 || lost[0].retransmits != 1 {
+		t.Fatalf("third dup ack lost %v", lost)
+	}
+	if s.ssthresh != 3 || s.cwnd != 3 || s.recoveryEnd != 6 {
+		t.Errorf("fast recovery: ssthresh %v, cwnd %v, recoveryEnd %d", s.ssthresh, s.cwnd, s.recoveryEnd)
+	}
+	// After that it is up to the timer
+	if lost := s.onAck(ackHeader(0, 0), true); len(lost) != 0 {
+		t.Errorf("fourth dup ack lost %d frames", len(lost))
+	}
+}
+
+func TestReliableSackLoss(t *testing.T) {
+	s := testStream(t, 5)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Frames 1 to 3 arrived
+	lost := s.onAck(ackHeader(0, 0b111), false)
+	if len(lost) != 1 || lost[0].seq != 0 {
+		t.Fatalf("sack of 1-3 lost %v", lost)
+	}
+	if !s.inflight[3].sacked || s.inflight[4].sacked {
+		t.Errorf("sacked flags wrong: 3 %v, 4 %v", s.inflight[3].sacked, s.inflight[4].sacked)
+	}
+	if got := s.pipe(); got != 2 {
+		t.Errorf("pipe %d, want 2", got)
+	}
+
+	// Two frames after one aren't enough
+	s = testStream(t, 4)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lost := s.onAck(ackHeader(0, 0b110), false); len(lost) != 0 {
+		t.Errorf("sack of 2-3 lost %v", lost)
+	}
+}
+
+func TestReliableLimit(t *testing.T) {
+	s := testStream(t, 4)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inflight[1].lost = true
+	s.inflight[2].sacked = true
+	if got := s.pipe(); got != 2 {
+		t.Errorf("pipe %d, want 2", got)
+	}
+	for _, tt := range []struct {
+		cwnd   float64
+		window int
+		want   int
+	}{{10, 256, 10}, {2.7, 256, 2}, {0.5, 256, 1}, {300, 256, 256}, {20, 8, 8}} {
+		s.cwnd, s.window = tt.cwnd, tt.window
+		if got := s.limit(); got != tt.want {
+			t.Errorf("limit with cwnd %v, window %d = %d, want %d", tt.cwnd, tt.window, got, tt.want)
+		}
+	}
+
+	// Frames a timeout left for lost go again as the window allows
+	s.cwnd, s.window = 2, 256
+	s.inflight[3].lost = true
+	lost := s.lostSegments()
+	if len(lost) != 1 || lost[0].seq != 1 || s.inflight[3].retransmits != 0 {
+		t.Errorf("window of 2 resent %v", lost)
+	}
+}
+
+func TestReliableSackBits(t *testing.T) {
+	s := testStream(t, 0)
+	s.rcvNext = 10
+	for _, seq := range []uint64{11, 13, 18, 19} {
+		s.pending[seq] = nil
+	}
+	if got := s.sackBits(8); got != 0b10000101 {
+		t.Errorf("sackBits(8) = %b", got)
+	}
+	if got := s.sackBits(2); got != 0b01 {
+		t.Errorf("sackBits(2) = %b", got)
+	}
+}
+
+const reliableTestPattern = `{"protocols": [{"identifier": "reludp", "transport": "udp",
+ "reliability": {"seq_field": "seq", "ack_field": "ack", "sack_field": "sack", "window": 64, "min_rto_ms": 20},
+ "layer_stack": {"layer7": {"header_size": 10, "fields": [
+  {"name": "seq", "offset": 0, "size": 4, "type": "uint32_be"},
+  {"name": "ack", "offset": 4, "size": 4, "type": "uint32_be"},
+  {"name": "sack", "offset": 8, "size": 2, "type": "uint16_be"}]}},
+ "state_machine": {"initial_state": "s", "states": [{"name": "s", "transitions": []}]}}]}`
+
+func reliableTestConfig(t *testing.T, pattern string) *Config {
+	t.Helper()
+	config := &Config{}
+	if err := json.Unmarshal([]byte(pattern), config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestCheckReliability(t *testing.T) {
+	config := reliableTestConfig(t, reliableTestPattern)
+	if err := checkReliability(&config.Protocols[0]); err != nil {
+		t.Fatalf("valid protocol: %v", err)
+	}
+
+	tests := []struct {
+		change func(*Protocol)
+		want   string
+	}{
+		{func(p *Protocol) { p.Transport = "tcp" }, "udp transport"},
+		{func(p *Protocol) { p.LayerStack = nil }, "layer stack"},
+		{func(p *Protocol) { p.Reliability.AckField = "" }, "seq_field and ack_field"},
+		{func(p *Protocol) { p.Reliability.SackField = "nosuch" }, "names no layer stack field"},
+		{func(p *Protocol) { p.LayerStack.Layer7.Fields[0].Type = "ascii_decimal" }, "binary integer"},
+		{func(p *Protocol) { p.LayerStack.Layer7.Fields[1].Sequence = &SequenceConfig{} }, "own sequence"},
+		{func(p *Protocol) { p.LayerStack.Layer7.Fields[0].Type = "uint8"; p.Reliability.Window = 200 }, "too narrow"},
+		{func(p *Protocol) { p.Reliability.Window = 1<<31 + 1 }, "too narrow"},
+	}
+	for _, tt := range tests {
+		proto := reliableTestConfig(t, reliableTestPattern).Protocols[0]
+		tt.change(&proto)
+		if err := checkReliability(&proto); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("error %v, want %q", err, tt.want)
+		}
+	}
+}
+
+// lossyLink is one end of an in-memory datagram link. Every drop-th frame
+// written is lost, as are frames the other end has no room for.
+type lossyLink struct {
+	in, peer chan []byte
+	drop     int
+	done     chan struct{}
+
+	mu     sync.Mutex
+	writes int
+	once   sync.Once
+}
+
+func newLossyLinks(drop int) (*lossyLink, *lossyLink) {
+	ab, ba := make(chan []byte, 256), make(chan []byte, 256)
+	done := make(chan struct{})
+	return &lossyLink{in: ba, peer: ab, drop: drop, done: done},
+		&lossyLink{in: ab, peer: ba, drop: drop, done: done}
+}
+
+func (l *lossyLink) Read(b []byte) (int, error) {
+	select {
+	case frame := <-l.in:
+		return copy(b, frame), nil
+	case <-l.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (l *lossyLink) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	l.writes++
+	lost := l.writes%l.drop == 0
+	l.mu.Unlock()
+	if !lost {
+		select {
+		case l.peer <- append([]byte(nil), b...):
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (l *lossyLink) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *lossyLink) LocalAddr() net.Addr                { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (l *lossyLink) RemoteAddr() net.Addr               { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2} }
+func (l *lossyLink) SetDeadline(t time.Time) error      { return nil }
+func (l *lossyLink) SetReadDeadline(t time.Time) error  { return nil }
+func (l *lossyLink) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestReliableStreamOverLossyLink(t *testing.T) {
+	config := reliableTestConfig(t, reliableTestPattern)
+	client := NewTunnelNode(config, "client", "", "", "")
+	server := NewTunnelNode(config, "server", "", "", "")
+	defer client.Close()
+	defer server.Close()
+
+	clientLink, serverLink := newLossyLinks(7)
+	defer clientLink.Close()
+	clientOut := &frameWriter{conn: clientLink}
+	clientSess, _, err := client.openSession("client", clientOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.closeSession(clientSess)
+	serverSess, _, err := server.openSession("server", &frameWriter{conn: serverLink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.closeSession(serverSess)
+
+	var mu sync.Mutex
+	var received []byte
+	done := make(chan struct{})
+	want := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	receive := func(node *TunnelNode, link *lossyLink, sess *session) {
+		buffer := make([]byte, 65536)
+		for {
+			n, err := link.Read(buffer)
+			if err != nil {
+				return
+			}
+			node.receiveFrame(buffer[:n], sess, func(payload []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received = append(received, payload...)
+				if len(received) == len(want) {
+					close(done)
+				}
+				return nil
+			})
+		}
+	}
+	go receive(server, serverLink, serverSess)
+	go receive(client, clientLink, clientSess)
+
+	clientSess.machine.start(config.Protocols[0])
+	for sent := 0; sent < len(want); sent += 1000 {
+		if _, err := client.sendData(clientOut, clientSess, want[sent:sent+1000]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("received %d of %d bytes", len(received), len(want))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.Equal(received, want) {
+		t.Errorf("payload arrived out of order or damaged")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sequence algorithms:
+//
+//	linear     start, start+increment, ... (the default; increment defaults to 1)
+//	fibonacci  start, increment, and then the sum of the previous two
+//	random     linear from a random initial value, like a TCP ISN
+//	timestamp  a clock in "unit" (s, ms, us; ms by default) since the epoch,
+//	           or since the session started when start is given, plus start
+//	bytes      advances by the payload bytes of each frame, like TCP
+//
+// "start": "random" draws the initial value of linear, fibonacci and bytes
+// counters. Counters wrap at the width of their field and are kept per
+// session and direction, so the receiver checks each frame against its own
+// copy. Over UDP, frames may be lost or arrive out of order, so a counter
+// may also skip ahead or fall behind by up to sequenceWindow frames.
+
+// sequenceWindow is how many frames a counter of a datagram session may skip,
+// for frames lost on the way or sent again by the reliable layer, or fall
+// behind, for frames reordered.
+const sequenceWindow = 1024
+
+// sequenceState is one direction of a counter.
+type sequenceState struct {
+	started bool
+	next    uint64
+	after   uint64 // the term after next, for fibonacci
+	last    uint64 // the last timestamp received
+}
+
+// sequenceKey names the counter of a field in one direction.
+func sequenceKey(proto *Protocol, field Field, dir string) string {
+	return dir + ":" + proto.Identifier + ":" + field.Name
+}
+
+// sequenceStart returns the first term of a counter.
+func (t *TunnelNode) sequenceStart(cfg *SequenceConfig, mod uint64) (uint64, bool) {
+	if s, ok := cfg.Start.(string); cfg.Algorithm == "random" || ok && strings.EqualFold(s, "random") {
+		return randomBelow(mod), true
+	}
+	v, _ := toUint64(cfg.Start)
+	return wrap(v, mod), false
+}
+
+func (t *TunnelNode) sequenceIncrement(cfg *SequenceConfig) uint64 {
+	if cfg.Increment == nil {
+		return 1
+	}
+	v, _ := toUint64(cfg.Increment)
+	return v
+}
+
+// sequenceClock reads the timestamp of a "timestamp" counter.
+func sequenceClock(cfg *SequenceConfig, sess *session, start uint64, mod uint64) uint64 {
+	unit := time.Millisecond
+	switch cfg.Unit {
+	case "s":
+		unit = time.Second
+	case "us":
+		unit = time.Microsecond
+	}
+	if cfg.Start == nil {
+		return wrap(uint64(time.Now().UnixNano()/int64(unit)), mod)
+	}
+	return wrap(start+uint64(time.Since(sess.createdAt)/unit), mod)
+}
+
+// wrap reduces a counter to the values its field holds; mod 0 is 2^64.
+func wrap(v, mod uint64) uint64 {
+	if mod == 0 {
+		return v
+	}
+	return v % mod
+}
+
+// getSequence returns the value a field sends in this frame and advances the
+// sending counter.
+func (t *TunnelNode) getSequence(field Field, ctx *packetContext) uint64 {
+	cfg := field.Sequence
+	mod := fieldModulus(field)
+
+	sess := ctx.sess
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	key := sequenceKey(ctx.proto, field, "tx")
+	st, exists := sess.sequences[key]
+	if !exists {
+		st = &sequenceState{}
+		st.next, _ = t.sequenceStart(cfg, mod)
+		st.after = wrap(t.sequenceIncrement(cfg), mod)
+		sess.sequences[key] = st
+	}
+
+	if cfg.Algorithm == "timestamp" {
+		return sequenceClock(cfg, sess, st.next, mod)
+	}
+	current := st.next
+	t.advanceSequence(cfg, st, current, len(ctx.env.data), mod)
+	return current
+}
+
+// advanceSequence moves a counter past the value it just sent or received.
+func (t *TunnelNode) advanceSequence(cfg *SequenceConfig, st *sequenceState, value uint64, payload int, mod uint64) {
+	st.started = true
+	switch cfg.Algorithm {
+	case "fibonacci":
+		st.next, st.after = st.after, wrap(value+st.after, mod)
+	case "bytes":
+		st.next = wrap(value+uint64(payload), mod)
+	default:
+		st.next = wrap(value+t.sequenceIncrement(cfg), mod)
+	}
+}
+
+// checkSequences compares the counters of a received frame with the ones
+// the session expects, and advances them if they all match. It returns the
+// fields that don't. Counters shaped by an expression can't be checked; a
+// random initial value is taken from the first frame, and timestamps only
+// have to move forward.
+func (t *TunnelNode) checkSequences(proto *Protocol, sess *session, decoded *decodedFrame, payload int) []string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	type update struct {
+		key   string
+		state sequenceState
+	}
+	var mismatched []string
+	var updates []update
+	for _, df := range decoded.fields {
+		field := df.field
+		cfg := field.Sequence
+		if cfg == nil || isTemplate(field.Value) {
+			continue
+		}
+		value, ok := toUint64(df.value)
+		if !ok {
+			mismatched = append(mismatched, df.layer+"."+df.name)
+			continue
+		}
+		mod := fieldModulus(field)
+		value = wrap(value, mod)
+
+		key := sequenceKey(proto, field, "rx")
+		var st sequenceState
+		random := false
+		if existing, ok := sess.sequences[key]; ok {
+			st = *existing
+		} else {
+			st.next, random = t.sequenceStart(cfg, mod)
+			st.after = wrap(t.sequenceIncrement(cfg), mod)
+		}
+
+		switch {
+		case cfg.Algorithm == "timestamp":
+			// Timestamps may not go back by more than half their range
+			if st.started && wrap(value-st.last, mod) > (mod-1)/2 {
+				mismatched = append(mismatched, df.layer+"."+df.name)
+				continue
+			}
+			st.started, st.last = true, value
+		case !st.started && random:
+			t.advanceSequence(cfg, &st, value, payload, mod)
+		case value == st.next:
+			t.advanceSequence(cfg, &st, value, payload, mod)
+		case sess.transport == "udp" && t.skipSequence(cfg, &st, value, mod):
+			// Frames were lost; the counter carries on from this one
+			t.advanceSequence(cfg, &st, value, payload, mod)
+		case sess.transport == "udp" && t.lateSequence(cfg, &st, value, mod):
+			continue // a reordered frame, behind the counter
+		default:
+			mismatched = append(mismatched, fmt.Sprintf("%s.%s (%d, expected %d)", df.layer, df.name, value, st.next))
+			continue
+		}
+		updates = append(updates, update{key, st})
+	}
+
+	if len(mismatched) == 0 {
+		for _, u := range updates {
+			st := u.state
+			sess.sequences[u.key] = &st
+		}
+	}
+	return mismatched
+}
+
+// sequenceSpan is how far a counter moves over sequenceWindow frames, or 0
+// when that isn't known, kept to half the counter's range.
+func (t *TunnelNode) sequenceSpan(cfg *SequenceConfig, mod uint64) uint64 {
+	var span uint64
+	switch cfg.Algorithm {
+	case "", "linear", "random":
+		span = sequenceWindow * t.sequenceIncrement(cfg)
+	case "bytes":
+		span = sequenceWindow * 65536 // the most a frame carries
+	}
+	return min(span, (mod-1)/2)
+}
+
+// skipSequence reports whether value is a later term of st's counter within
+// the window, and if so moves st to it.
+func (t *TunnelNode) skipSequence(cfg *SequenceConfig, st *sequenceState, value, mod uint64) bool {
+	if cfg.Algorithm == "fibonacci" {
+		next := *st
+		for i := 0; i < sequenceWindow; i++ {
+			t.advanceSequence(cfg, &next, next.next, 0, mod)
+			if next.next == value {
+				*st = next
+				return true
+			}
+		}
+		return false
+	}
+	return wrap(value-st.next, mod) <= t.sequenceSpan(cfg, mod)
+}
+
+// lateSequence reports whether value is an earlier term of st's counter
+// within the window.
+func (t *TunnelNode) lateSequence(cfg *SequenceConfig, st *sequenceState, value, mod uint64) bool {
+	return st.started && wrap(st.next-value, mod) <= t.sequenceSpan(cfg, mod)
+}
+
+// isTemplate reports whether a value is an expression.
+func isTemplate(value interface{}) bool {
+	s, ok := value.(string)
+	return ok && strings.Contains(s, "${")
+}
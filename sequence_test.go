@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func sequenceFrame(field Field, value uint64) *decodedFrame {
+	return &decodedFrame{fields: []decodedField{{layer: "hdr", name: field.Name, value: value, field: field}}}
+}
+
+func TestCheckSequencesStrictOverTCP(t *testing.T) {
+	var node TunnelNode
+	proto := &Protocol{Identifier: "p"}
+	field := Field{Name: "seq", Type: "uint16_be", Sequence: &SequenceConfig{Start: 10.0}}
+	sess := &session{transport: "tcp", sequences: map[string]*sequenceState{}}
+
+	for _, v := range []uint64{10, 11, 12} {
+		if bad := node.checkSequences(proto, sess, sequenceFrame(field, v), 0); len(bad) > 0 {
+			t.Fatalf("%d rejected: %v", v, bad)
+		}
+	}
+	for _, v := range []uint64{14, 12} {
+		if bad := node.checkSequences(proto, sess, sequenceFrame(field, v), 0); len(bad) == 0 {
+			t.Errorf("%d accepted after 12", v)
+		}
+	}
+}
+
+func TestCheckSequencesWindowOverUDP(t *testing.T) {
+	var node TunnelNode
+	proto := &Protocol{Identifier: "p"}
+	tests := []struct {
+		name   string
+		field  Field
+		values []uint64
+		ok     []bool
+	}{
+		{
+			"linear",
+			Field{Name: "seq", Type: "uint32_be", Sequence: &SequenceConfig{Increment: 2.0}},
+			[]uint64{0, 2, 8, 4, 10, 10 + 2*sequenceWindow, 10 + 2*sequenceWindow + 2 + 2*sequenceWindow + 2, 6},
+			[]bool{true, true, true, true, true, true, false, false},
+		},
+		{
+			"wrapping",
+			Field{Name: "seq", Type: "uint16_be", Sequence: &SequenceConfig{Start: 65530.0}},
+			[]uint64{65530, 65531, 3, 65535, 4, 30000},
+			[]bool{true, true, true, true, true, false},
+		},
+		{
+			// 0, 1, 1, 2, 3, 5, 8, 13, 21
+			"fibonacci",
+			Field{Name: "seq", Type: "uint32_be", Sequence: &SequenceConfig{Algorithm: "fibonacci", Start: 0.0, Increment: 1.0}},
+			[]uint64{0, 1, 3, 8, 13, 4},
+			[]bool{true, true, true, true, true, false},
+		},
+		{
+			"small field",
+			Field{Name: "seq", Type: "uint8", Sequence: &SequenceConfig{}},
+			[]uint64{0, 1, 100, 229},
+			[]bool{true, true, true, false},
+		},
+	}
+	for _, tt := range tests {
+		sess := &session{transport: "udp", sequences: map[string]*sequenceState{}}
+		for i, v := range tt.values {
+			bad := node.checkSequences(proto, sess, sequenceFrame(tt.field, v), 0)
+			if ok := len(bad) == 0; ok != tt.ok[i] {
+				t.Errorf("%s: frame %d with %d: accepted %v, want %v (%v)", tt.name, i, v, ok, tt.ok[i], bad)
+			}
+		}
+	}
+}
+
+func TestCheckSequencesBytesOverUDP(t *testing.T) {
+	var node TunnelNode
+	proto := &Protocol{Identifier: "p"}
+	field := Field{Name: "seq", Type: "uint32_be", Sequence: &SequenceConfig{Algorithm: "bytes", Start: 1000.0}}
+	sess := &session{transport: "udp", sequences: map[string]*sequenceState{}}
+
+	steps := []struct {
+		value   uint64
+		payload int
+		ok      bool
+	}{
+		{1000, 100, true},
+		{1100, 50, true},
+		{1400, 10, true}, // 1150 to 1400 lost
+		{1150, 250, true},
+		{1410, 0, true},
+		{1410 + sequenceWindow*65536 + 1, 0, false},
+	}
+	for _, s := range steps {
+		bad := node.checkSequences(proto, sess, sequenceFrame(field, s.value), s.payload)
+		if ok := len(bad) == 0; ok != s.ok {
+			t.Errorf("bytes %d: accepted %v, want %v (%v)", s.value, ok, s.ok, bad)
+		}
+	}
+}
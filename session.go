@@ -0,0 +1,258 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const sessionShards = 16
+
+// session holds everything the tunnel tracks for one connection. It is
+// created when the connection starts and removed from the store when it ends.
+type session struct {
+	id        string
+	createdAt time.Time
+	lastSeen  int64 // unix nanoseconds, atomic
+	close     func()
+	deleted   atomic.Bool
+
+	// local and remote are the addresses of the connection carrying the
+	// session, when it has IP addresses
+	local, remote net.Addr
+	// transport is the network of that connection, "tcp" or "udp", or empty
+	// when it is neither, as in the simulator
+	transport string
+	// sessionID tells UDP and polling peers apart regardless of their
+	// address; the server takes it from the client
+	sessionID int64
+
+	mu        sync.Mutex
+	variables map[string]interface{}
+	sequences map[string]*sequenceState
+	frames    int64
+	machine   *stateMachine
+	reliable  *reliableStream
+	h2        *http2Conn
+}
+
+func (s *session) touch() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+func (s *session) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastSeen))
+}
+
+// exprEnv snapshots the session variables for evaluating expressions.
+func (s *session) exprEnv(data []byte) *exprEnv {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := make(map[string]interface{}, len(s.variables))
+	for name, v := range s.variables {
+		vars[name] = v
+	}
+	return &exprEnv{connID: s.id, sessionID: s.sessionID, data: data, vars: vars, src: s.local, dst: s.remote}
+}
+
+// receiveEnv is the environment for checking a frame received with proto,
+// with the addresses seen from the sender. Variables the session hasn't set
+// read as the protocol's initial values, since the first frame arrives
+// before the state machine starts.
+func (s *session) receiveEnv(proto *Protocol, data []byte) *exprEnv {
+	env := s.exprEnv(data)
+	env.src, env.dst = env.dst, env.src
+	for name, v := range proto.StateMachine.Variables {
+		if _, ok := env.vars[name]; !ok {
+			env.vars[name] = v.Initial
+		}
+	}
+	return env
+}
+
+// stream returns the session's reliable stream, if it has started one.
+func (s *session) stream() *reliableStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reliable
+}
+
+func (s *session) http2() *http2Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.h2
+}
+
+func (s *session) setVariables(vars map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.variables = vars
+}
+
+func (s *session) updateVariable(name string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.variables[name] = value
+}
+
+// nextFrame counts the frames built for the session; it is exposed to
+// expressions as "seq" for fields without their own sequence.
+func (s *session) nextFrame() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.frames
+	s.frames++
+	return current
+}
+
+type sessionShard struct {
+	mu       sync.RWMutex
+	sessions map[string]*session
+}
+
+// sessionStore maps connection IDs to sessions. Sessions are spread over
+// shards so unrelated connections don't contend on one lock, and each
+// session has its own lock for its state. With a limit, no more than that
+// many sessions exist at once.
+type sessionStore struct {
+	shards [sessionShards]sessionShard
+	ttl    time.Duration
+	limit  int
+	active atomic.Int64
+}
+
+func newSessionStore(ttl time.Duration, limit int) *sessionStore {
+	store := &sessionStore{ttl: ttl, limit: limit}
+	for i := range store.shards {
+		store.shards[i].sessions = make(map[string]*session)
+	}
+	return store
+}
+
+func (st *sessionStore) shard(id string) *sessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &st.shards[h.Sum32()%sessionShards]
+}
+
+// create registers a new session. close is called if the session expires.
+// A session with the same ID, left by a connection that is ending, is
+// replaced.
+func (st *sessionStore) create(id string, close func()) (*session, error) {
+	if n := st.active.Add(1); st.limit > 0 && n > int64(st.limit) {
+		st.active.Add(-1)
+		return nil, fmt.Errorf("%d sessions already active", st.limit)
+	}
+
+	now := time.Now()
+	sess := &session{
+		id:        id,
+		createdAt: now,
+		lastSeen:  now.UnixNano(),
+		close:     close,
+		sessionID: randomSessionID(),
+		variables: make(map[string]interface{}),
+		sequences: make(map[string]*sequenceState),
+	}
+
+	shard := st.shard(id)
+	shard.mu.Lock()
+	shard.sessions[id] = sess
+	shard.mu.Unlock()
+	return sess, nil
+}
+
+// randomSessionID draws a session ID. Servers route datagrams by it, so it
+// comes from crypto/rand and takes 64 bits, of which as many travel as the
+// session field holds.
+func randomSessionID() int64 {
+	var b [8]byte
+	crand.Read(b[:])
+	return int64(binary.BigEndian.Uint64(b[:]))
+}
+
+func (st *sessionStore) get(id string) (*session, bool) {
+	shard := st.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	sess, ok := shard.sessions[id]
+	return sess, ok
+}
+
+// delete removes a session unless a newer one has taken its ID. It counts
+// once per session, however often it is called.
+func (st *sessionStore) delete(sess *session) {
+	if !sess.deleted.CompareAndSwap(false, true) {
+		return
+	}
+	st.active.Add(-1)
+	shard := st.shard(sess.id)
+	shard.mu.Lock()
+	if shard.sessions[sess.id] == sess {
+		delete(shard.sessions, sess.id)
+	}
+	shard.mu.Unlock()
+}
+
+func (st *sessionStore) count() int {
+	return int(st.active.Load())
+}
+
+// expire removes sessions idle for longer than the TTL and closes them.
+func (st *sessionStore) expire(now time.Time) {
+	if st.ttl <= 0 {
+		return
+	}
+
+	var expired []*session
+	for i := range st.shards {
+		shard := &st.shards[i]
+		shard.mu.Lock()
+		for id, sess := range shard.sessions {
+			if now.Sub(sess.idleSince()) > st.ttl {
+				delete(shard.sessions, id)
+				expired = append(expired, sess)
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	for _, sess := range expired {
+		if *verbose {
+			log.Printf("⌛ Session %s expired after %v idle", sess.id, st.ttl)
+		}
+		if sess.close != nil {
+			sess.close()
+		}
+	}
+}
+
+// runJanitor expires idle sessions until done is closed.
+func (st *sessionStore) runJanitor(done <-chan struct{}) {
+	if st.ttl <= 0 {
+		return
+	}
+
+	interval := st.ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			st.expire(now)
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionStoreLimit(t *testing.T) {
+	st := newSessionStore(0, 10)
+
+	var created atomic.Int64
+	var wg sync.WaitGroup
+	sessions := make(chan *session, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sess, err := st.create(fmt.Sprintf("conn-%d", i), nil); err == nil {
+				created.Add(1)
+				sessions <- sess
+			}
+		}()
+	}
+	wg.Wait()
+	close(sessions)
+	if created.Load() != 10 || st.count() != 10 {
+		t.Fatalf("%d sessions created, %d active; want 10", created.Load(), st.count())
+	}
+
+	// Ending a session makes room for another
+	st.delete(<-sessions)
+	if _, err := st.create("late", nil); err != nil {
+		t.Errorf("create after delete: %v", err)
+	}
+	if _, err := st.create("later", nil); err == nil {
+		t.Error("11th session created")
+	}
+}
+
+func TestSessionStoreDelete(t *testing.T) {
+	st := newSessionStore(0, 0)
+	old, _ := st.create("conn", nil)
+	newer, _ := st.create("conn", nil)
+
+	// The ending connection's delete leaves its successor in place
+	st.delete(old)
+	if sess, ok := st.get("conn"); !ok || sess != newer {
+		t.Errorf("delete of the old session removed the newer one")
+	}
+	if st.count() != 1 {
+		t.Errorf("%d active after deleting one of two", st.count())
+	}
+
+	// However often it is called, from however many goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			st.delete(newer)
+		}()
+		go func() {
+			defer wg.Done()
+			st.delete(old)
+		}()
+	}
+	wg.Wait()
+	if _, ok := st.get("conn"); ok || st.count() != 0 {
+		t.Errorf("%d active after deleting both", st.count())
+	}
+}
+
+func TestSessionStoreExpire(t *testing.T) {
+	st := newSessionStore(time.Minute, 0)
+	var closed []string
+	idle, _ := st.create("idle", func() { closed = append(closed, "idle") })
+	st.create("busy", func() { closed = append(closed, "busy") })
+	atomic.StoreInt64(&idle.lastSeen, time.Now().Add(-2*time.Minute).UnixNano())
+
+	st.expire(time.Now())
+	if len(closed) != 1 || closed[0] != "idle" {
+		t.Errorf("expire closed %v", closed)
+	}
+	if _, ok := st.get("idle"); ok {
+		t.Error("expired session still stored")
+	}
+	if _, ok := st.get("busy"); !ok {
+		t.Error("busy session expired")
+	}
+
+	// The expired session counts until its connection deletes it
+	if st.count() != 2 {
+		t.Errorf("%d active before the delete", st.count())
+	}
+	st.delete(idle)
+	if st.count() != 1 {
+		t.Errorf("%d active after the delete", st.count())
+	}
+
+	// Without a TTL nothing expires
+	st = newSessionStore(0, 0)
+	st.create("idle", func() { t.Error("session without a TTL expired") })
+	st.expire(time.Now().Add(time.Hour))
+}
+
+func TestSessionStoreConcurrent(t *testing.T) {
+	st := newSessionStore(time.Millisecond, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// IDs repeat, as they do when a peer reconnects from the same address
+			sess, err := st.create(fmt.Sprintf("conn-%d", i%20), nil)
+			if err != nil {
+				return
+			}
+			sess.updateVariable("n", i)
+			sess.touch()
+			st.get(sess.id)
+			st.expire(time.Now())
+			st.delete(sess)
+		}()
+	}
+	wg.Wait()
+	if st.count() != 0 {
+		t.Errorf("%d active after every session ended", st.count())
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runSimulate implements the "simulate" subcommand: it runs the client and
+// server roles of a protocol against each other over net.Pipe, sends a sample
+// payload through and echoes it back, and prints an annotated transcript.
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	patternFile := fs.String("pattern", "llm.json", "Protocol pattern file")
+	protocolID := fs.String("protocol", "", "Protocol to simulate (default: first in pattern)")
+	payloadText := fs.String("payload", "hello from nyx-core", "Sample payload")
+	payloadHex := fs.String("payload-hex", "", "Sample payload as hex, overrides -payload")
+	linger := fs.Duration("linger", 0, "Keep the session open after the round trip to observe timer triggers")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for each direction of the round trip")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	payload := []byte(*payloadText)
+	if *payloadHex != "" {
+		var err error
+		if payload, err = hex.DecodeString(*payloadHex); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Invalid -payload-hex: %v\n", err)
+			return 2
+		}
+	}
+	if len(payload) == 0 {
+		fmt.Fprintf(os.Stderr, "❌ Payload must not be empty\n")
+		return 2
+	}
+
+	config, err := loadConfig(*patternFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	var proto *Protocol
+	for i := range config.Protocols {
+		if *protocolID == "" || config.Protocols[i].Identifier == *protocolID {
+			proto = &config.Protocols[i]
+			break
+		}
+	}
+	if proto == nil {
+		fmt.Fprintf(os.Stderr, "❌ Protocol %q not found in %s\n", *protocolID, *patternFile)
+		return 1
+	}
+
+	// Both roles only know the simulated protocol
+	simConfig := *config
+	simConfig.Protocols = []Protocol{*proto}
+
+	sim := &simulation{proto: *proto, out: os.Stdout, started: time.Now()}
+	if !sim.run(&simConfig, payload, *timeout, *linger) {
+		return 1
+	}
+	return 0
+}
+
+type simulation struct {
+	proto   Protocol
+	out     io.Writer
+	started time.Time
+
+	mu     sync.Mutex
+	frames int
+}
+
+func (s *simulation) printf(role, format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.started).Seconds() * 1000
+	fmt.Fprintf(s.out, "%9.3fms [%s] %s\n", elapsed, role, fmt.Sprintf(format, args...))
+}
+
+func (s *simulation) run(config *Config, payload []byte, timeout, linger time.Duration) bool {
+	client := NewTunnelNode(config, "client", "", "", "")
+	server := NewTunnelNode(config, "server", "", "", "")
+	defer client.Close()
+	defer server.Close()
+	client.trace = func(format string, args ...interface{}) { s.printf("client", format, args...) }
+	server.trace = func(format string, args ...interface{}) { s.printf("server", format, args...) }
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	clientOut := &frameWriter{conn: clientConn}
+	serverOut := &frameWriter{conn: serverConn}
+	// Each node's store holds only this session, so neither can be refused
+	clientSession, clientClosed, _ := client.openSession("client_sim", clientOut)
+	serverSession, serverClosed, _ := server.openSession("server_sim", serverOut)
+	defer client.closeSession(clientSession)
+	defer server.closeSession(serverSession)
+
+	fmt.Fprintf(s.out, "== simulate %s (%s), %d byte payload\n", s.proto.Identifier, s.proto.Transport, len(payload))
+
+	toServer := make(chan []byte, 64)
+	toClient := make(chan []byte, 64)
+	go s.receive("server", "C→S", server, serverConn, serverSession, toServer)
+	go s.receive("client", "S→C", client, clientConn, clientSession, toClient)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		// Sessions closed by a state machine end the simulation early
+		select {
+		case <-clientClosed:
+		case <-serverClosed:
+		case <-finished:
+		}
+		clientConn.Close()
+	}()
+
+	clientSession.machine.start(s.proto)
+
+	// Client -> server
+	if err := clientOut.writeFrame(client.wrapData(payload, clientSession)); err != nil {
+		s.printf("client", "❌ write failed: %v", err)
+		return false
+	}
+	clientSession.machine.onData(payload)
+
+	received, ok := collectPayload(toServer, len(payload), timeout)
+	if !s.check("server", payload, received, ok) {
+		return false
+	}
+
+	// Server -> client, echoing what the VPN server would have sent back
+	if err := serverOut.writeFrame(server.wrapData(received, serverSession)); err != nil {
+		s.printf("server", "❌ write failed: %v", err)
+		return false
+	}
+	serverSession.machine.onData(received)
+
+	echoed, ok := collectPayload(toClient, len(payload), timeout)
+	if !s.check("client", payload, echoed, ok) {
+		return false
+	}
+
+	if linger > 0 {
+		time.Sleep(linger)
+	}
+
+	s.mu.Lock()
+	fmt.Fprintf(s.out, "✅ Payload round-tripped through %s in %d frames\n", s.proto.Identifier, s.frames)
+	s.mu.Unlock()
+	return true
+}
+
+func (s *simulation) check(role string, want, got []byte, complete bool) bool {
+	if !complete {
+		s.printf(role, "❌ timed out after %d of %d payload bytes", len(got), len(want))
+		return false
+	}
+	if !bytes.Equal(want, got) {
+		s.printf(role, "❌ payload mismatch\n      want %s\n      got  %s", hexPreview(want), hexPreview(got))
+		return false
+	}
+	s.printf(role, "payload intact (%d bytes)", len(got))
+	return true
+}
+
+// receive reads frames from one end of the pipe, prints them and hands the
+// unwrapped payload to the state machine and the collector.
+func (s *simulation) receive(role, direction string, node *TunnelNode, conn net.Conn, sess *session, delivered chan<- []byte) {
+	buffer := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		frame := append([]byte{}, buffer[:n]...)
+
+		s.mu.Lock()
+		s.frames++
+		number := s.frames
+		s.mu.Unlock()
+
+		payload, proto, _ := node.unwrapFrame(frame, sess)
+		lines := []string{fmt.Sprintf("%s frame #%d (%d bytes)", direction, number, len(frame))}
+		if proto == nil {
+			lines = append(lines, "    ⚠️ not recognized by any protocol")
+		} else {
+			lines = append(lines, describeFrame(node, proto, sess, frame)...)
+		}
+		lines = append(lines, fmt.Sprintf("    payload (%d bytes) %s", len(payload), hexPreview(payload)))
+		s.printf(role, "%s", strings.Join(lines, "\n"))
+
+		if proto != nil {
+			sess.machine.start(*proto)
+			sess.machine.onData(payload)
+		}
+		if len(payload) > 0 {
+			delivered <- payload
+		}
+	}
+}
+
+func collectPayload(delivered <-chan []byte, want int, timeout time.Duration) ([]byte, bool) {
+	var got []byte
+	deadline := time.After(timeout)
+	for len(got) < want {
+		select {
+		case chunk := <-delivered:
+			got = append(got, chunk...)
+		case <-deadline:
+			return got, false
+		}
+	}
+	return got, true
+}
+
+// describeFrame lists the fields of a frame, one per line.
+func describeFrame(t *TunnelNode, proto *Protocol, sess *session, frame []byte) []string {
+	var lines []string
+
+	if proto.HTTP2 != nil {
+		return describeHTTP2(frame)
+	}
+	if proto.LayerStack != nil {
+		decoded, ok := t.decodeLayerStack(proto.LayerStack, frame, sess.receiveEnv(proto, frame))
+		if !ok {
+			return []string{"    ⚠️ frame shorter than the layer stack"}
+		}
+		for _, field := range decoded.fields {
+			name := field.layer + "." + field.name
+			line := fmt.Sprintf("    %-28s @%-4d %s", name, field.offset, hex.EncodeToString(field.raw))
+			switch v := field.value.(type) {
+			case int64, uint64:
+				line += fmt.Sprintf(" = %d", v)
+			case string:
+				line += fmt.Sprintf(" = %q", v)
+			case map[string]interface{}:
+				line += fmt.Sprintf(" = %v", v)
+			}
+			lines = append(lines, line)
+		}
+		for _, name := range decoded.mismatched {
+			lines = append(lines, fmt.Sprintf("    ⚠️ %s does not verify", name))
+		}
+		return lines
+	}
+
+	headerEnd := findBytes(frame, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		return nil
+	}
+	for i, line := range strings.Split(string(frame[:headerEnd]), "\r\n") {
+		name, value := "start-line", line
+		if i > 0 {
+			if idx := strings.Index(line, ":"); idx != -1 {
+				name, value = line[:idx], strings.TrimSpace(line[idx+1:])
+			}
+		}
+		lines = append(lines, fmt.Sprintf("    %-28s %q = %s", name, value, hex.EncodeToString([]byte(value))))
+	}
+	return lines
+}
+
+func hexPreview(data []byte) string {
+	const limit = 48
+	if len(data) > limit {
+		return hex.EncodeToString(data[:limit]) + "…"
+	}
+	return hex.EncodeToString(data)
+}
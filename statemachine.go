@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// frameWriter serializes frame writes on a tunnel connection, which is shared
+// by the transfer goroutine and the state machine.
+type frameWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *frameWriter) writeFrame(frame []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.conn.Write(frame)
+	return err
+}
+
+// stateMachine runs a protocol's StateMachine for one connection. Data
+// triggers fire on payloads in either direction; "timeout", "interval" and
+// "idle" triggers run on timers that are stopped when the state is left or
+// the session ends.
+type stateMachine struct {
+	t            *TunnelNode
+	sess         *session
+	out          *frameWriter
+	closeSession func()
+
+	mu         sync.Mutex
+	proto      *Protocol
+	states     map[string]*State
+	current    string
+	generation int
+	timers     []*time.Timer
+	idleTimers []idleTimer
+	stopped    bool
+	regexps    map[string]*regexp.Regexp
+}
+
+type idleTimer struct {
+	timer    *time.Timer
+	duration time.Duration
+}
+
+type machineAction struct {
+	sendPacket string
+	delay      time.Duration
+	close      bool
+}
+
+func newStateMachine(t *TunnelNode, sess *session, out *frameWriter, closeSession func()) *stateMachine {
+	return &stateMachine{
+		t:            t,
+		sess:         sess,
+		out:          out,
+		closeSession: closeSession,
+		regexps:      make(map[string]*regexp.Regexp),
+	}
+}
+
+// start binds the machine to a protocol and enters its initial state. Only
+// the first call has an effect.
+func (m *stateMachine) start(proto Protocol) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.proto != nil || m.stopped {
+		return
+	}
+	m.proto = &proto
+	m.states = make(map[string]*State)
+	for i := range proto.StateMachine.States {
+		m.states[proto.StateMachine.States[i].Name] = &proto.StateMachine.States[i]
+	}
+
+	vars := make(map[string]interface{})
+	for name, v := range proto.StateMachine.Variables {
+		vars[name] = v.Initial
+	}
+	m.sess.setVariables(vars)
+
+	if _, exists := m.states[proto.StateMachine.InitialState]; exists {
+		m.enter(proto.StateMachine.InitialState)
+	}
+}
+
+func (m *stateMachine) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stopped = true
+	m.stopTimers()
+}
+
+func (m *stateMachine) onData(data []byte) {
+	// Keepalives and other empty frames don't count as activity
+	if len(data) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	if m.proto == nil || m.stopped || m.current == "" {
+		m.mu.Unlock()
+		return
+	}
+
+	for _, idle := range m.idleTimers {
+		idle.timer.Reset(idle.duration)
+	}
+
+	var action *machineAction
+	for _, tr := range m.states[m.current].Transitions {
+		if tr.Trigger.Type != "" && tr.Trigger.Type != "data" {
+			continue
+		}
+		if m.matches(tr.Trigger.Conditions, data) {
+			action = m.fire(tr)
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	m.perform(action)
+}
+
+func (m *stateMachine) matches(cond Conditions, data []byte) bool {
+	pattern := cond.DataPattern
+	if pattern == "" {
+		return true
+	}
+
+	switch cond.MatchType {
+	case "exact":
+		return string(data) == pattern
+	case "prefix":
+		return bytes.HasPrefix(data, []byte(pattern))
+	case "suffix":
+		return bytes.HasSuffix(data, []byte(pattern))
+	case "regex":
+		re, ok := m.regexps[pattern]
+		if !ok {
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				log.Printf("❌ Invalid data_pattern %q: %v", pattern, err)
+			}
+			m.regexps[pattern] = re
+		}
+		return re != nil && re.Match(data)
+	default: // "contains"
+		return bytes.Contains(data, []byte(pattern))
+	}
+}
+
+// enter switches to a state and arms its timer triggers. Timers left over
+// from the previous state are stopped, and the generation check discards any
+// that already fired.
+func (m *stateMachine) enter(name string) {
+	m.stopTimers()
+	m.generation++
+	if *verbose && m.current != "" {
+		log.Printf("🔀 %s: %s -> %s", m.sess.id, m.current, name)
+	}
+	if m.current == "" {
+		m.t.tracef("state %s", name)
+	} else {
+		m.t.tracef("state %s -> %s", m.current, name)
+	}
+	m.current = name
+
+	gen := m.generation
+	for _, tr := range m.states[name].Transitions {
+		tr := tr
+		d, ok := triggerDuration(tr.Trigger)
+		if !ok {
+			continue
+		}
+
+		switch tr.Trigger.Type {
+		case "timeout":
+			m.timers = append(m.timers, time.AfterFunc(d, func() { m.onTimer(gen, tr) }))
+		case "interval":
+			var timer *time.Timer
+			timer = time.AfterFunc(d, func() {
+				if m.onTimer(gen, tr) {
+					timer.Reset(d)
+				}
+			})
+			m.timers = append(m.timers, timer)
+		case "idle":
+			timer := time.AfterFunc(d, func() { m.onTimer(gen, tr) })
+			m.idleTimers = append(m.idleTimers, idleTimer{timer: timer, duration: d})
+		}
+	}
+}
+
+// onTimer fires a timer transition and reports whether the machine is still
+// in the state that armed it.
+func (m *stateMachine) onTimer(gen int, tr Transition) bool {
+	m.mu.Lock()
+	if m.stopped || gen != m.generation {
+		m.mu.Unlock()
+		return false
+	}
+	action := m.fire(tr)
+	still := gen == m.generation && !m.stopped
+	m.mu.Unlock()
+
+	m.perform(action)
+	return still
+}
+
+func (m *stateMachine) stopTimers() {
+	for _, timer := range m.timers {
+		timer.Stop()
+	}
+	for _, idle := range m.idleTimers {
+		idle.timer.Stop()
+	}
+	m.timers = nil
+	m.idleTimers = nil
+}
+
+// fire applies a transition's variable updates and state change. Network
+// actions are returned so they can be performed without holding the lock.
+func (m *stateMachine) fire(tr Transition) *machineAction {
+	if len(tr.Action.VariableUpdates) > 0 {
+		env := m.sess.exprEnv(nil)
+		for name, value := range tr.Action.VariableUpdates {
+			if v := m.t.resolveValue(value, env); v != nil {
+				m.sess.updateVariable(name, v)
+			}
+		}
+	}
+
+	if next := tr.Action.NextState; next != "" && next != m.current {
+		if _, exists := m.states[next]; exists {
+			m.enter(next)
+		} else {
+			log.Printf("❌ %s: undefined next_state %q", m.sess.id, next)
+		}
+	}
+
+	return &machineAction{
+		sendPacket: tr.Action.SendPacket,
+		delay:      time.Duration(tr.Action.DelayMicroseconds) * time.Microsecond,
+		close:      tr.Action.Close,
+	}
+}
+
+func (m *stateMachine) perform(action *machineAction) {
+	if action == nil {
+		return
+	}
+
+	run := func() {
+		if action.sendPacket != "" {
+			frame := m.t.buildPacket(action.sendPacket, *m.proto, m.sess, nil)
+			m.t.tracef("send_packet %s (%d bytes)", action.sendPacket, len(frame))
+			if err := m.out.writeFrame(frame); err != nil {
+				if *verbose {
+					log.Printf("❌ %s: failed to send %s: %v", m.sess.id, action.sendPacket, err)
+				}
+				return
+			}
+			if *verbose {
+				log.Printf("📨 %s: sent %s (%d bytes)", m.sess.id, action.sendPacket, len(frame))
+			}
+		}
+		if action.close {
+			if *verbose {
+				log.Printf("🔚 %s: closed by state machine", m.sess.id)
+			}
+			m.t.tracef("close")
+			m.closeSession()
+		}
+	}
+
+	if action.delay > 0 {
+		// A delayed action outlives the state that fired it, but not the
+		// session
+		time.AfterFunc(action.delay, func() {
+			m.mu.Lock()
+			stopped := m.stopped
+			m.mu.Unlock()
+			if !stopped {
+				run()
+			}
+		})
+	} else {
+		run()
+	}
+}
+
+// triggerDuration parses the duration of a timer trigger.
+func triggerDuration(trigger Trigger) (time.Duration, bool) {
+	if !isTimerTrigger(trigger.Type) {
+		return 0, false
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(trigger.Duration))
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+func isTimerTrigger(triggerType string) bool {
+	return triggerType == "timeout" || triggerType == "interval" || triggerType == "idle"
+}
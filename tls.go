@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// setupTLS prepares the TLS settings of the node's role when the pattern
+// asks for TLS. Only TCP protocols run over it.
+func (t *TunnelNode) setupTLS() error {
+	cfg := t.config.Tunnel.TLS
+	if cfg == nil {
+		return nil
+	}
+	var err error
+	if t.mode == "client" {
+		t.tlsConfig, err = clientTLSConfig(cfg, t.serverAddr)
+	} else {
+		t.tlsConfig, err = serverTLSConfig(cfg)
+	}
+	return err
+}
+
+func clientTLSConfig(cfg *TLSConfig, serverAddr string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: cfg.ServerName,
+		NextProtos: cfg.ALPN,
+		MinVersion: tls.VersionTLS12,
+	}
+	if conf.ServerName == "" {
+		if host, _, err := net.SplitHostPort(serverAddr); err == nil {
+			conf.ServerName = host
+		}
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if cfg.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.PinSHA256) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range cfg.PinSHA256 {
+			if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("pin %q isn't a base64 SHA-256 hash", pin)
+			}
+			pins[pin] = true
+		}
+		// A pinned key is trust enough unless CAs are given as well
+		conf.InsecureSkipVerify = cfg.CAFile == ""
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			if pin := publicKeyPin(state.PeerCertificates[0]); !pins[pin] {
+				return fmt.Errorf("server key %s isn't pinned", pin)
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+func serverTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	conf := &tls.Config{
+		NextProtos: cfg.ALPN,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	var cert tls.Certificate
+	var err error
+	if cfg.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	} else {
+		cert, err = selfSignedCertificate(cfg.ServerName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("server certificate: %v", err)
+	}
+	conf.Certificates = []tls.Certificate{cert}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("server certificate: %v", err)
+	}
+	log.Printf("🔐 TLS certificate for %v, pin_sha256 %s", leaf.DNSNames, publicKeyPin(leaf))
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// selfSignedCertificate makes a certificate for name, localhost by default,
+// valid for a year. Its key changes with every start, so clients pinning it
+// must be updated.
+func selfSignedCertificate(name string) (tls.Certificate, error) {
+	if name == "" {
+		name = "localhost"
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// publicKeyPin is the base64 SHA-256 hash of a certificate's public key, as
+// pin_sha256 lists it.
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s holds no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// secureConn runs the TLS handshake of the node's role over a TCP tunnel
+// connection, or returns it as it is when the pattern has no TLS.
+func (t *TunnelNode) secureConn(conn net.Conn) (net.Conn, error) {
+	if t.tlsConfig == nil {
+		return conn, nil
+	}
+	var tlsConn *tls.Conn
+	if t.mode == "client" {
+		tlsConn = tls.Client(conn, t.tlsConfig)
+	} else {
+		tlsConn = tls.Server(conn, t.tlsConfig)
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	if *verbose {
+		state := tlsConn.ConnectionState()
+		log.Printf("🔐 TLS with %s: %s, ALPN %q", conn.RemoteAddr(), tls.VersionName(state.Version), state.NegotiatedProtocol)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsTestNode makes a node of mode whose pattern runs over TLS with cfg.
+func tlsTestNode(t *testing.T, mode string, cfg *TLSConfig) *TunnelNode {
+	t.Helper()
+	config := reliableTestConfig(t, udpTestPattern)
+	config.Protocols[0].Transport = "tcp"
+	config.Tunnel.TLS = cfg
+	node := NewTunnelNode(config, mode, "", "tunnel.test:443", "")
+	t.Cleanup(node.Close)
+	return node
+}
+
+// tlsHandshake runs the handshakes of client and server over a pipe and
+// returns their errors.
+func tlsHandshake(client, server *TunnelNode) (clientErr, serverErr error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := server.secureConn(b)
+		if err == nil {
+			// TLS 1.3 clients learn of a rejected certificate on reading
+			_, err = conn.Write([]byte("ok"))
+		}
+		done <- err
+		b.Close()
+	}()
+	conn, err := client.secureConn(a)
+	if err == nil {
+		_, err = conn.Read(make([]byte, 2))
+	}
+	a.Close()
+	return err, <-done
+}
+
+// serverPin is the pin_sha256 of the certificate a server node presents.
+func serverPin(t *testing.T, server *TunnelNode) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(server.tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKeyPin(leaf)
+}
+
+func TestTLSPinning(t *testing.T) {
+	server := tlsTestNode(t, "server", &TLSConfig{ServerName: "tunnel.test", ALPN: []string{"h2"}})
+	pin := serverPin(t, server)
+
+	client := tlsTestNode(t, "client", &TLSConfig{PinSHA256: []string{strings.Repeat("A", 43) + "=", pin}, ALPN: []string{"h2"}})
+	if client.tlsConfig.ServerName != "tunnel.test" {
+		t.Errorf("SNI %q, want the host of -server", client.tlsConfig.ServerName)
+	}
+	if clientErr, serverErr := tlsHandshake(client, server); clientErr != nil || serverErr != nil {
+		t.Errorf("pinned key: %v, %v", clientErr, serverErr)
+	}
+
+	// Another key, or none pinned, isn't trusted
+	other := tlsTestNode(t, "server", &TLSConfig{ServerName: "tunnel.test"})
+	if clientErr, _ := tlsHandshake(client, other); clientErr == nil || !strings.Contains(clientErr.Error(), "isn't pinned") {
+		t.Errorf("key not pinned: %v", clientErr)
+	}
+	unpinned := tlsTestNode(t, "client", &TLSConfig{})
+	if clientErr, _ := tlsHandshake(unpinned, server); clientErr == nil {
+		t.Error("self-signed server trusted without a pin")
+	}
+
+	for _, pin := range []string{"not base64!", "AAAA"} {
+		if _, err := clientTLSConfig(&TLSConfig{PinSHA256: []string{pin}}, ""); err == nil {
+			t.Errorf("pin %q accepted", pin)
+		}
+	}
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	a, err := selfSignedCertificate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(a.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "localhost" || leaf.VerifyHostname("localhost") != nil {
+		t.Errorf("certificate for %v", leaf.DNSNames)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		t.Errorf("valid from %v to %v", leaf.NotBefore, leaf.NotAfter)
+	}
+
+	// Every start makes a new key
+	b, _ := selfSignedCertificate("")
+	other, _ := x509.ParseCertificate(b.Certificate[0])
+	if publicKeyPin(leaf) == publicKeyPin(other) {
+		t.Error("two certificates share a key")
+	}
+}
+
+// testCA is a certificate authority that issues client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// writePEM writes the CA's certificate into dir and returns its path.
+func (ca *testCA) writePEM(t *testing.T, dir string) string {
+	t.Helper()
+	file := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// issue writes a client certificate and its key into dir and returns their
+// paths.
+func (ca *testCA) issue(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	server := tlsTestNode(t, "server", &TLSConfig{ServerName: "tunnel.test", ClientCAFile: ca.writePEM(t, t.TempDir())})
+	if server.tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("client auth %v", server.tlsConfig.ClientAuth)
+	}
+	pin := serverPin(t, server)
+
+	certFile, keyFile := ca.issue(t, t.TempDir())
+	client := tlsTestNode(t, "client", &TLSConfig{PinSHA256: []string{pin}, ClientCertFile: certFile, ClientKeyFile: keyFile})
+	if clientErr, serverErr := tlsHandshake(client, server); clientErr != nil || serverErr != nil {
+		t.Errorf("client certificate of the CA: %v, %v", clientErr, serverErr)
+	}
+
+	// Clients without a certificate, or with one of another CA, are refused
+	anonymous := tlsTestNode(t, "client", &TLSConfig{PinSHA256: []string{pin}})
+	if _, serverErr := tlsHandshake(anonymous, server); serverErr == nil {
+		t.Error("client without a certificate accepted")
+	}
+	certFile, keyFile = newTestCA(t).issue(t, t.TempDir())
+	stranger := tlsTestNode(t, "client", &TLSConfig{PinSHA256: []string{pin}, ClientCertFile: certFile, ClientKeyFile: keyFile})
+	if _, serverErr := tlsHandshake(stranger, server); serverErr == nil {
+		t.Error("client certificate of another CA accepted")
+	}
+
+	// Files that hold no certificates are reported
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, nil, 0o600)
+	if _, err := serverTLSConfig(&TLSConfig{ClientCAFile: empty}); err == nil || !strings.Contains(err.Error(), "no PEM certificates") {
+		t.Errorf("empty client_ca_file: %v", err)
+	}
+	if _, err := clientTLSConfig(&TLSConfig{ClientCertFile: empty, ClientKeyFile: empty}, ""); err == nil {
+		t.Error("empty client certificate accepted")
+	}
+}
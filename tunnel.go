@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,18 +26,24 @@ type TunnelNode struct {
 	vpnServerAddr string
 	fpeKey        []byte
 
-	// State management
-	states    map[string]map[string]interface{}
-	variables map[string]map[string]interface{}
-	sequences map[string]map[string]interface{}
+	// Per-connection state
+	sessions *sessionStore
+
+	// Expressions compiled from the pattern, keyed by their source string
+	templates map[string]*template
 
 	// Network components
-	listener net.Listener
-	ctx      context.Context
-	cancel   context.CancelFunc
+	listener   net.Listener
+	packetConn net.PacketConn // the UDP socket of server mode
+	tlsConfig  *tls.Config    // of the node's role, nil without TLS
+	ctx        context.Context
+	cancel     context.CancelFunc
 
 	// Protocol rotation
 	protocolIndex uint64 // atomic counter for round-robin
+
+	// Optional observer of state machine activity, used by the simulator
+	trace func(format string, args ...interface{})
 }
 
 func NewTunnelNode(cfg *Config, mode, listenPort, serverAddr, vpnServerAddr string) *TunnelNode {
@@ -47,9 +56,7 @@ func NewTunnelNode(cfg *Config, mode, listenPort, serverAddr, vpnServerAddr stri
 		listenPort:    listenPort,
 		serverAddr:    serverAddr,
 		vpnServerAddr: vpnServerAddr,
-		states:        make(map[string]map[string]interface{}),
-		variables:     make(map[string]map[string]interface{}),
-		sequences:     make(map[string]map[string]interface{}),
+		sessions:      newSessionStore(time.Duration(cfg.Tunnel.SessionTTL)*time.Second, cfg.Tunnel.MaxSessions),
 		ctx:           ctx,
 		cancel:        cancel,
 		protocolIndex: 0,
@@ -62,10 +69,43 @@ func NewTunnelNode(cfg *Config, mode, listenPort, serverAddr, vpnServerAddr stri
 		node.fpeKey = []byte("defaultkey123456")
 	}
 
+	templates, err := compileProtocolTemplates(cfg.Protocols)
+	if err != nil {
+		log.Fatalf("❌ Invalid expression in pattern: %v", err)
+	}
+	node.templates = templates
+
+	if err := checkLayerStacks(cfg.Protocols); err != nil {
+		log.Fatalf("❌ Invalid layer stack: %v", err)
+	}
+	if err := checkComputations(cfg.Protocols); err != nil {
+		log.Fatalf("❌ Invalid computation: %v", err)
+	}
+	if err := checkRanges(cfg.Protocols); err != nil {
+		log.Fatalf("❌ Invalid range: %v", err)
+	}
+	if err := checkTransports(cfg.Protocols); err != nil {
+		log.Fatalf("❌ Invalid transport: %v", err)
+	}
+	if err := node.setupTLS(); err != nil {
+		log.Fatalf("❌ Invalid TLS settings: %v", err)
+	}
+	if err := checkHTTP2(cfg.Protocols); err != nil {
+		log.Fatalf("❌ Invalid HTTP/2 settings: %v", err)
+	}
+	if err := checkWebSocket(cfg.Tunnel.WebSocket); err != nil {
+		log.Fatalf("❌ Invalid WebSocket settings: %v", err)
+	}
+	if err := checkPolling(&cfg.Tunnel); err != nil {
+		log.Fatalf("❌ Invalid polling settings: %v", err)
+	}
+
 	return node
 }
 
 func (t *TunnelNode) Start() {
+	go t.sessions.runJanitor(t.ctx.Done())
+
 	if t.mode == "client" {
 		t.startClientMode()
 	} else {
@@ -74,6 +114,12 @@ func (t *TunnelNode) Start() {
 }
 
 func (t *TunnelNode) startClientMode() {
+	if t.vpnNetwork() == "udp" {
+		// Each VPN peer gets a session of its own, as a TCP connection would
+		t.serveUDP("Client", t.handleClientConnection, false)
+		return
+	}
+
 	var err error
 	t.listener, err = net.Listen("tcp", ":"+t.listenPort)
 	if err != nil {
@@ -99,8 +145,15 @@ func (t *TunnelNode) startClientMode() {
 }
 
 func (t *TunnelNode) startServerMode() {
-	// For server mode, we listen on the same port that clients will connect to
-	// This creates the server side of the tunnel
+	// For server mode, we listen on the same port that clients will connect to,
+	// over TCP and UDP as the protocols' transports require
+	if t.usesTransport("udp") {
+		t.serveUDP("Server", t.handleServerConnection, true)
+		if !t.usesTransport("tcp") {
+			return
+		}
+	}
+
 	var err error
 	t.listener, err = net.Listen("tcp", ":"+t.listenPort)
 	if err != nil {
@@ -109,6 +162,11 @@ func (t *TunnelNode) startServerMode() {
 
 	log.Printf("✅ Server listening on port %s", t.listenPort)
 
+	if t.config.Tunnel.Polling != nil {
+		go t.servePolling()
+		return
+	}
+
 	go func() {
 		for {
 			conn, err := t.listener.Accept()
@@ -120,7 +178,15 @@ func (t *TunnelNode) startServerMode() {
 				continue
 			}
 
-			go t.handleServerConnection(conn)
+			go func() {
+				wrapped, err := t.wrapConn(conn)
+				if err != nil {
+					log.Printf("❌ Handshake with %s failed: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				t.handleServerConnection(wrapped)
+			}()
 		}
 	}()
 }
@@ -132,20 +198,62 @@ func (t *TunnelNode) handleClientConnection(clientConn net.Conn) {
 		log.Printf("🔗 Client connection from %s", clientConn.RemoteAddr())
 	}
 
-	// Connect to the tunnel server
-	serverConn, err := net.Dial("tcp", t.serverAddr)
-	if err != nil {
-		log.Printf("❌ Failed to connect to server %s: %v", t.serverAddr, err)
+	// Connect to the tunnel server over the transport of the protocol the
+	// session starts with; it rotates among protocols of that transport
+	proto := t.selectProtocol("")
+	network := protocolTransport(&proto)
+	polling := network == "tcp" && t.config.Tunnel.Polling != nil
+	var serverConn net.Conn
+	var err error
+	if polling {
+		// The session polls over HTTP connections of its own
+		serverConn = t.dialPolling()
+	} else if serverConn, err = net.Dial(network, t.serverAddr); err != nil {
+		log.Printf("❌ Failed to connect to server %s over %s: %v", t.serverAddr, network, err)
 		return
 	}
+	if network == "tcp" && !polling {
+		wrapped, err := t.wrapConn(serverConn)
+		if err != nil {
+			log.Printf("❌ Handshake with server %s failed: %v", t.serverAddr, err)
+			serverConn.Close()
+			return
+		}
+		serverConn = wrapped
+	}
 	defer serverConn.Close()
 
+	out := &frameWriter{conn: serverConn}
+	sess, closed, err := t.openSession(fmt.Sprintf("client_%s", clientConn.RemoteAddr().String()), out)
+	if err != nil {
+		log.Printf("❌ Refusing connection from %s: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+	defer t.closeSession(sess)
+	sess.machine.start(proto)
+	t.reliableStream(sess, &proto)
+	if t.http2Conn(sess, &proto) != nil {
+		// The request goes out before any data, so the server can speak first
+		out.writeFrame(t.buildPacket("request", proto, sess, nil))
+	}
+
 	// Start bidirectional data transfer
-	go t.transferClientToServer(clientConn, serverConn)
-	go t.transferServerToClient(serverConn, clientConn)
+	done := make(chan struct{}, 2)
+	go func() {
+		t.transferClientToServer(clientConn, out, sess)
+		done <- struct{}{}
+	}()
+	go func() {
+		t.transferServerToClient(serverConn, clientConn, sess)
+		done <- struct{}{}
+	}()
 
-	// Wait for connections to close
-	<-t.ctx.Done()
+	// The session ends when either side closes
+	select {
+	case <-done:
+	case <-closed:
+	case <-t.ctx.Done():
+	}
 }
 
 func (t *TunnelNode) handleServerConnection(tunnelConn net.Conn) {
@@ -156,24 +264,103 @@ func (t *TunnelNode) handleServerConnection(tunnelConn net.Conn) {
 	}
 
 	// Connect to the VPN server
-	vpnConn, err := net.Dial("tcp", t.vpnServerAddr)
+	vpnConn, err := net.Dial(t.vpnNetwork(), t.vpnServerAddr)
 	if err != nil {
 		log.Printf("❌ Failed to connect to VPN server %s: %v", t.vpnServerAddr, err)
 		return
 	}
 	defer vpnConn.Close()
 
+	// The state machine starts once the first frame tells us which protocol is in use
+	out := &frameWriter{conn: tunnelConn}
+	connID := fmt.Sprintf("server_%s", tunnelConn.RemoteAddr().String())
+	if peer, ok := tunnelConn.(*pollPeer); ok {
+		// Polling sessions may share the address of a proxy
+		connID = fmt.Sprintf("server_poll_%x", peer.sessionID)
+	}
+	sess, closed, err := t.openSession(connID, out)
+	if err != nil {
+		log.Printf("❌ Refusing connection from %s: %v", tunnelConn.RemoteAddr(), err)
+		return
+	}
+	defer t.closeSession(sess)
+
 	// Start bidirectional data transfer
-	go t.transferTunnelToVPN(tunnelConn, vpnConn)
-	go t.transferVPNToTunnel(vpnConn, tunnelConn)
+	done := make(chan struct{}, 2)
+	go func() {
+		t.transferTunnelToVPN(tunnelConn, vpnConn, sess)
+		done <- struct{}{}
+	}()
+	go func() {
+		t.transferVPNToTunnel(vpnConn, out, sess)
+		done <- struct{}{}
+	}()
 
-	// Wait for connections to close
-	<-t.ctx.Done()
+	// The session ends when either side closes
+	select {
+	case <-done:
+	case <-closed:
+	case <-t.ctx.Done():
+	}
 }
 
-func (t *TunnelNode) transferClientToServer(clientConn, serverConn net.Conn) {
-	buffer := make([]byte, 65536)
-	connID := fmt.Sprintf("client_%s", clientConn.RemoteAddr().String())
+// wrapConn runs the TLS and WebSocket handshakes the pattern asks for over a
+// TCP connection between tunnel client and server.
+func (t *TunnelNode) wrapConn(conn net.Conn) (net.Conn, error) {
+	conn, err := t.secureConn(conn)
+	if err != nil || t.config.Tunnel.WebSocket == nil {
+		return conn, err
+	}
+	if t.mode == "client" {
+		return t.dialWebSocket(conn)
+	}
+	return t.acceptWebSocket(conn)
+}
+
+// openSession registers a session for a new connection. The returned channel
+// is closed when the state machine or the session TTL ends the session.
+// It fails when max_sessions are active already.
+func (t *TunnelNode) openSession(connID string, out *frameWriter) (*session, <-chan struct{}, error) {
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+	closeFn := func() { closeOnce.Do(func() { close(closed) }) }
+
+	sess, err := t.sessions.create(connID, closeFn)
+	if err != nil {
+		return nil, nil, err
+	}
+	sess.local, sess.remote = out.conn.LocalAddr(), out.conn.RemoteAddr()
+	sess.transport = connTransport(out.conn)
+	switch peer := out.conn.(type) {
+	case *datagramConn:
+		if peer.sessionID != 0 {
+			sess.sessionID = peer.sessionID
+		}
+	case *pollClient:
+		sess.sessionID = peer.sessionID
+	case *pollPeer:
+		sess.sessionID = peer.sessionID
+	}
+	sess.machine = newStateMachine(t, sess, out, closeFn)
+	return sess, closed, nil
+}
+
+func (t *TunnelNode) closeSession(sess *session) {
+	sess.machine.stop()
+	if stream := sess.stream(); stream != nil {
+		stream.close()
+	}
+	if c := sess.http2(); c != nil {
+		c.close()
+	}
+	t.sessions.delete(sess)
+	if *verbose {
+		log.Printf("🔌 Session %s ended, %d active", sess.id, t.sessions.count())
+	}
+}
+
+func (t *TunnelNode) transferClientToServer(clientConn net.Conn, out *frameWriter, sess *session) {
+	buffer := make([]byte, t.readSize(sess))
 
 	for {
 		n, err := clientConn.Read(buffer)
@@ -184,26 +371,40 @@ func (t *TunnelNode) transferClientToServer(clientConn, serverConn net.Conn) {
 			return
 		}
 
-		// Wrap the data in the fake protocol
-		wrappedData := t.wrapData(buffer[:n], connID)
-
-		// Send to server
-		if _, err := serverConn.Write(wrappedData); err != nil {
+		// Wrap the data in the fake protocol and send it to the server
+		sess.touch()
+		wrapped, err := t.sendData(out, sess, buffer[:n])
+		if err != nil {
 			if *verbose {
 				log.Printf("❌ Server write error: %v", err)
 			}
 			return
 		}
+		sess.machine.onData(buffer[:n])
 
 		if *verbose {
-			log.Printf("📤 Client->Server: %d bytes wrapped to %d bytes", n, len(wrappedData))
+			log.Printf("📤 Client->Server: %d bytes wrapped to %d bytes", n, wrapped)
 		}
 	}
 }
 
-func (t *TunnelNode) transferServerToClient(serverConn, clientConn net.Conn) {
+func (t *TunnelNode) transferServerToClient(serverConn, clientConn net.Conn, sess *session) {
 	buffer := make([]byte, 65536)
 
+	// Send unwrapped data to the client
+	deliver := func(data []byte) error {
+		if _, err := clientConn.Write(data); err != nil {
+			if *verbose {
+				log.Printf("❌ Client write error: %v", err)
+			}
+			return err
+		}
+		if *verbose {
+			log.Printf("📥 Server->Client: %d bytes unwrapped", len(data))
+		}
+		return nil
+	}
+
 	for {
 		n, err := serverConn.Read(buffer)
 		if err != nil {
@@ -214,26 +415,29 @@ func (t *TunnelNode) transferServerToClient(serverConn, clientConn net.Conn) {
 		}
 
 		// Unwrap the data from the fake protocol
-		unwrappedData := t.unwrapData(buffer[:n])
+		sess.touch()
+		if err := t.receiveFrame(buffer[:n], sess, deliver); err != nil {
+			return
+		}
+	}
+}
 
-		// Send to client
-		if len(unwrappedData) > 0 {
-			if _, err := clientConn.Write(unwrappedData); err != nil {
-				if *verbose {
-					log.Printf("❌ Client write error: %v", err)
-				}
-				return
-			}
+func (t *TunnelNode) transferTunnelToVPN(tunnelConn, vpnConn net.Conn, sess *session) {
+	buffer := make([]byte, 65536)
 
+	// Send unwrapped data to the VPN server, one datagram per frame on UDP
+	deliver := func(data []byte) error {
+		if _, err := vpnConn.Write(data); err != nil {
 			if *verbose {
-				log.Printf("📥 Server->Client: %d bytes unwrapped to %d bytes", n, len(unwrappedData))
+				log.Printf("❌ VPN write error: %v", err)
 			}
+			return err
 		}
+		if *verbose {
+			log.Printf("📥 Tunnel->VPN: %d bytes unwrapped", len(data))
+		}
+		return nil
 	}
-}
-
-func (t *TunnelNode) transferTunnelToVPN(tunnelConn, vpnConn net.Conn) {
-	buffer := make([]byte, 65536)
 
 	for {
 		n, err := tunnelConn.Read(buffer)
@@ -244,140 +448,219 @@ func (t *TunnelNode) transferTunnelToVPN(tunnelConn, vpnConn net.Conn) {
 			return
 		}
 
-		// Unwrap the data from the fake protocol
-		unwrappedData := t.unwrapData(buffer[:n])
-
-		// Send to VPN server
-		if len(unwrappedData) > 0 {
-			if _, err := vpnConn.Write(unwrappedData); err != nil {
-				if *verbose {
-					log.Printf("❌ VPN write error: %v", err)
-				}
-				return
-			}
-
-			if *verbose {
-				log.Printf("📥 Tunnel->VPN: %d bytes unwrapped to %d bytes", n, len(unwrappedData))
-			}
+		// Unwrap the data from the fake protocol; the first frame tells
+		// which protocol is in use
+		sess.touch()
+		if err := t.receiveFrame(buffer[:n], sess, deliver); err != nil {
+			return
 		}
 	}
 }
 
-func (t *TunnelNode) transferVPNToTunnel(vpnConn, tunnelConn net.Conn) {
-	buffer := make([]byte, 65536)
-	connID := fmt.Sprintf("server_%s", tunnelConn.RemoteAddr().String())
+func (t *TunnelNode) transferVPNToTunnel(vpnConn net.Conn, out *frameWriter, sess *session) {
+	buffer := make([]byte, t.readSize(sess))
+	datagrams := t.vpnNetwork() == "udp"
 
 	for {
+		if datagrams {
+			// A UDP backend never closes; its socket goes when it falls silent
+			vpnConn.SetReadDeadline(time.Now().Add(t.udpIdleTimeout()))
+		}
 		n, err := vpnConn.Read(buffer)
 		if err != nil {
-			if err != io.EOF && *verbose {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if *verbose {
+					log.Printf("⌛ VPN socket of session %s idle for %v", sess.id, t.udpIdleTimeout())
+				}
+			} else if err != io.EOF && *verbose {
 				log.Printf("❌ VPN read error: %v", err)
 			}
 			return
 		}
 
-		// Wrap the data in the fake protocol
-		wrappedData := t.wrapData(buffer[:n], connID)
-
-		// Send to tunnel
-		if _, err := tunnelConn.Write(wrappedData); err != nil {
+		// Wrap the data in the fake protocol and send it to the tunnel
+		sess.touch()
+		wrapped, err := t.sendData(out, sess, buffer[:n])
+		if err != nil {
 			if *verbose {
 				log.Printf("❌ Tunnel write error: %v", err)
 			}
 			return
 		}
+		sess.machine.onData(buffer[:n])
 
 		if *verbose {
-			log.Printf("📤 VPN->Tunnel: %d bytes wrapped to %d bytes", n, len(wrappedData))
+			log.Printf("📤 VPN->Tunnel: %d bytes wrapped to %d bytes", n, wrapped)
 		}
 	}
 }
 
-func (t *TunnelNode) wrapData(data []byte, connID string) []byte {
+// sendData wraps data in frames and writes them to out, through the session's
+// reliable stream if it has one. It returns the number of bytes framed.
+func (t *TunnelNode) sendData(out *frameWriter, sess *session, data []byte) (int, error) {
+	proto := t.selectProtocol(sess.transport)
+	if stream := t.reliableStream(sess, &proto); stream != nil {
+		return stream.send(data)
+	}
+	if c := t.http2Conn(sess, &proto); c != nil {
+		return c.send(data)
+	}
+	frame := t.wrapData(data, sess)
+	return len(frame), out.writeFrame(frame)
+}
+
+// receiveFrame unwraps a frame and passes its payload to deliver, one call
+// per frame so datagrams keep their boundaries, and starts the state machine
+// on the protocol that recognized it. A reliable stream passes payloads on
+// once they are in order, from a goroutine of its own, so it keeps taking
+// acknowledgements while deliver blocks.
+func (t *TunnelNode) receiveFrame(frame []byte, sess *session, deliver func([]byte) error) error {
+	data, proto, decoded := t.unwrapFrame(frame, sess)
+	if proto != nil {
+		if peer, ok := sess.machine.out.conn.(*datagramConn); ok && peer.sessionID != 0 && peer.acceptRemote() && *verbose {
+			log.Printf("🔀 UDP session %s moved to %s", sess.id, peer.RemoteAddr())
+		}
+		sess.machine.start(*proto)
+		if stream := t.reliableStream(sess, proto); stream != nil {
+			return stream.receive(proto, decoded, data, deliver)
+		}
+		sess.machine.onData(data)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return deliver(data)
+}
+
+func (t *TunnelNode) wrapData(data []byte, sess *session) []byte {
 	// انتخاب رندوم پروتکل
-	selectedProtocol := t.selectRandomProtocol()
+	selectedProtocol := t.selectProtocol(sess.transport)
 
 	if *verbose {
-		log.Printf("🎲 Using protocol: %s for connection %s (%d bytes)", selectedProtocol.Identifier, connID, len(data))
+		log.Printf("🎲 Using protocol: %s for connection %s (%d bytes)", selectedProtocol.Identifier, sess.id, len(data))
 	}
 
-	// Update connection ID with protocol info for better variable resolution
-	enhancedConnID := fmt.Sprintf("%s_%s", connID, selectedProtocol.Identifier)
-
 	// Use the existing buildPacket function from protocol.go
-	return t.buildPacket("request", selectedProtocol, enhancedConnID, data)
+	return t.buildPacket("request", selectedProtocol, sess, data)
 }
 
-func (t *TunnelNode) unwrapData(wrappedData []byte) []byte {
+// unwrapFrame extracts the payload of a frame and reports the protocol that
+// recognized it. Frames no protocol recognizes are returned as-is with a nil
+// protocol. A recognized frame may carry an empty payload, e.g. a keepalive.
+func (t *TunnelNode) unwrapFrame(wrappedData []byte, sess *session) ([]byte, *Protocol, *decodedFrame) {
 	// Try to unwrap with all protocols (since we don't know which one was used)
-	for _, protocol := range t.protocols {
-		if extracted := t.tryUnwrapWithProtocol(wrappedData, protocol); len(extracted) > 0 {
-			return extracted
+	for i := range t.protocols {
+		if sess.transport != "" && protocolTransport(&t.protocols[i]) != sess.transport {
+			continue
+		}
+		if c := t.http2Conn(sess, &t.protocols[i]); c != nil {
+			// The frames of any HTTP/2 protocol make up one connection
+			return t.extractVPNDataFromHTTP2(c, wrappedData, &t.protocols[i])
+		}
+		if extracted, decoded, ok := t.tryUnwrapWithProtocol(wrappedData, &t.protocols[i], sess); ok {
+			return extracted, &t.protocols[i], decoded
 		}
 	}
 
 	// If no protocol could unwrap it, return as-is (fallback)
-	return wrappedData
+	return wrappedData, nil, nil
 }
 
 // امتحان unwrap با یک پروتکل مشخص
-func (t *TunnelNode) tryUnwrapWithProtocol(wrappedData []byte, protocol Protocol) []byte {
+func (t *TunnelNode) tryUnwrapWithProtocol(wrappedData []byte, protocol *Protocol, sess *session) ([]byte, *decodedFrame, bool) {
 	if protocol.FrameStructure.RequestFormat != nil {
-		return t.extractVPNDataFromFrame(wrappedData)
+		data, ok := t.extractVPNDataFromFrame(wrappedData)
+		if ok && protocol.FrameStructure.LineEnding != "" {
+			// The line ending follows the payload, which may end in anything
+			data = bytes.TrimSuffix(data, []byte(protocol.FrameStructure.LineEnding))
+		}
+		return data, nil, ok
 	} else if protocol.LayerStack != nil {
-		return t.extractVPNDataFromLayers(wrappedData, protocol)
+		return t.extractVPNDataFromLayers(wrappedData, protocol, sess)
 	}
-	return wrappedData
+	return nil, nil, false
 }
 
-func (t *TunnelNode) extractVPNDataFromFrame(data []byte) []byte {
+func (t *TunnelNode) extractVPNDataFromFrame(data []byte) ([]byte, bool) {
 	// Look for the end of headers (double CRLF) and extract body
 	headerEnd := []byte("\r\n\r\n")
 	if idx := findBytes(data, headerEnd); idx != -1 {
-		bodyStart := idx + len(headerEnd)
-		if bodyStart < len(data) {
-			vpnData := data[bodyStart:]
-			if *verbose {
-				log.Printf("🔧 DEBUG: Extracted VPN data: %d bytes from %d total bytes", len(vpnData), len(data))
-			}
-			return vpnData
+		vpnData := data[idx+len(headerEnd):]
+		if *verbose {
+			log.Printf("🔧 DEBUG: Extracted VPN data: %d bytes from %d total bytes", len(vpnData), len(data))
 		}
+		return vpnData, true
 	}
 
-	// Fallback: if no proper HTTP structure found, try to find VPN data pattern
-	// Look for common VPN handshake patterns or return original data
 	if *verbose {
-		log.Printf("🔧 DEBUG: No HTTP structure found, returning original data: %d bytes", len(data))
+		log.Printf("🔧 DEBUG: No HTTP structure found in %d bytes", len(data))
 	}
-	return data
+	return nil, false
 }
 
-func (t *TunnelNode) extractVPNDataFromLayers(data []byte, protocol Protocol) []byte {
-	// Calculate total header size from all layers
-	headerSize := 0
-	if protocol.LayerStack != nil {
-		if protocol.LayerStack.Layer4 != nil {
-			headerSize += protocol.LayerStack.Layer4.HeaderSize
+// extractVPNDataFromHTTP2 feeds bytes to the session's HTTP/2 connection.
+// An HTTP/2 error ends the session.
+func (t *TunnelNode) extractVPNDataFromHTTP2(c *http2Conn, data []byte, protocol *Protocol) ([]byte, *Protocol, *decodedFrame) {
+	vpnData, proto, err := c.receive(data)
+	if err != nil {
+		log.Printf("❌ HTTP/2 error in session %s: %v", c.sess.id, err)
+		c.sess.close()
+	}
+	if proto == nil {
+		proto = protocol
+	}
+	return vpnData, proto, nil
+}
+
+func (t *TunnelNode) extractVPNDataFromLayers(data []byte, protocol *Protocol, sess *session) ([]byte, *decodedFrame, bool) {
+	decoded, ok := t.decodeLayerStack(protocol.LayerStack, data, sess.receiveEnv(protocol, data))
+	if !ok {
+		if *verbose {
+			log.Printf("🔧 DEBUG: Data too small (%d bytes) for layer stack of %s", len(data), protocol.Identifier)
 		}
-		if protocol.LayerStack.Layer7 != nil {
-			headerSize += protocol.LayerStack.Layer7.HeaderSize
+		return nil, nil, false
+	}
+	if len(decoded.mismatched) > 0 {
+		if *verbose {
+			log.Printf("⚠️ %s: %s does not verify, frame rejected", protocol.Identifier, strings.Join(decoded.mismatched, ", "))
 		}
+		return nil, nil, false
 	}
 
-	if len(data) > headerSize {
-		encryptedVPNData := data[headerSize:]
-		// Reverse FPE to get original VPN data
-		vpnData := t.reverseFPE(encryptedVPNData)
-		if *verbose {
-			log.Printf("🔧 DEBUG: Extracted VPN data from layers: %d bytes (header: %d bytes, FPE decrypted)", len(vpnData), headerSize)
+	encryptedVPNData := decoded.payload
+	if carriesPayload(protocol.LayerStack) {
+		// A payload split over several fields is joined in order
+		encryptedVPNData = nil
+		for _, field := range decoded.fields {
+			if field.field.Value != "<<VPN_DATA>>" {
+				continue
+			}
+			if data, ok := field.value.([]byte); ok {
+				encryptedVPNData = append(encryptedVPNData, data...)
+			} else {
+				encryptedVPNData = append(encryptedVPNData, field.raw...)
+			}
 		}
-		return vpnData
 	}
 
+	// Reverse FPE to get original VPN data
+	vpnData := t.reverseFPE(encryptedVPNData)
+	if mismatched := t.checkSequences(protocol, sess, decoded, len(vpnData)); len(mismatched) > 0 {
+		if *verbose {
+			log.Printf("⚠️ %s: sequence %s out of order, frame rejected", protocol.Identifier, strings.Join(mismatched, ", "))
+		}
+		return nil, nil, false
+	}
 	if *verbose {
-		log.Printf("🔧 DEBUG: Data too small (%d bytes) for header size (%d bytes)", len(data), headerSize)
+		log.Printf("🔧 DEBUG: Extracted VPN data from layers: %d bytes (header: %d bytes, FPE decrypted)", len(vpnData), len(data)-len(decoded.payload))
+	}
+	return vpnData, decoded, true
+}
+
+func (t *TunnelNode) tracef(format string, args ...interface{}) {
+	if t.trace != nil {
+		t.trace(format, args...)
 	}
-	return data
 }
 
 func (t *TunnelNode) Close() {
@@ -387,6 +670,9 @@ func (t *TunnelNode) Close() {
 	if t.listener != nil {
 		t.listener.Close()
 	}
+	if t.packetConn != nil {
+		t.packetConn.Close()
+	}
 }
 
 // Helper function to find bytes in a slice
@@ -406,9 +692,19 @@ func findBytes(data, pattern []byte) int {
 	return -1
 }
 
-// Protocol rotation and selection logic
-func (t *TunnelNode) selectRandomProtocol() Protocol {
-	if len(t.protocols) == 0 {
+// selectProtocol picks the protocol of the next frame among those of a
+// transport, or among all of them when transport is empty.
+func (t *TunnelNode) selectProtocol(transport string) Protocol {
+	protocols := t.protocols
+	if transport != "" {
+		protocols = nil
+		for _, proto := range t.protocols {
+			if protocolTransport(&proto) == transport {
+				protocols = append(protocols, proto)
+			}
+		}
+	}
+	if len(protocols) == 0 {
 		return Protocol{Identifier: "fallback"}
 	}
 
@@ -419,17 +715,17 @@ func (t *TunnelNode) selectRandomProtocol() Protocol {
 
 	switch rotationMode {
 	case "round_robin":
-		index := atomic.AddUint64(&t.protocolIndex, 1) % uint64(len(t.protocols))
-		return t.protocols[index]
+		index := atomic.AddUint64(&t.protocolIndex, 1) % uint64(len(protocols))
+		return protocols[index]
 	case "time_based":
 		interval := int64(60)
 		if t.config.Tunnel.RotationInterval > 0 {
 			interval = int64(t.config.Tunnel.RotationInterval)
 		}
-		index := (time.Now().Unix() / interval) % int64(len(t.protocols))
-		return t.protocols[index]
+		index := (time.Now().Unix() / interval) % int64(len(protocols))
+		return protocols[index]
 	default: // "random"
-		index := rand.Intn(len(t.protocols))
-		return t.protocols[index]
+		index := rand.Intn(len(protocols))
+		return protocols[index]
 	}
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUDPIdleTimeout = 120 * time.Second
+	defaultUDPPayloadSize = 1200
+)
+
+// protocolTransport is the network a protocol's frames travel over.
+func protocolTransport(proto *Protocol) string {
+	if strings.EqualFold(proto.Transport, "udp") {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// checkTransports validates the transport, session field and reliability
+// of every protocol.
+func checkTransports(protocols []Protocol) error {
+	reliable, unreliable := "", ""
+	for _, proto := range protocols {
+		switch strings.ToLower(proto.Transport) {
+		case "", "tcp", "udp":
+		default:
+			return fmt.Errorf("%s: transport %q is neither tcp nor udp", proto.Identifier, proto.Transport)
+		}
+		if proto.Reliability != nil {
+			if err := checkReliability(&proto); err != nil {
+				return fmt.Errorf("%s: %v", proto.Identifier, err)
+			}
+			reliable = proto.Identifier
+		} else if protocolTransport(&proto) == "udp" {
+			unreliable = proto.Identifier
+		}
+		// UDP sessions rotate among all UDP protocols, so they must agree
+		if reliable != "" && unreliable != "" {
+			return fmt.Errorf("%s has reliability and %s doesn't; UDP protocols need it alike", reliable, unreliable)
+		}
+		if proto.SessionField == "" {
+			continue
+		}
+		found := false
+		if proto.LayerStack != nil {
+			for _, def := range stackBlocks(proto.LayerStack) {
+				for _, field := range def.fields {
+					found = found || field.Name == proto.SessionField
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: session_field %q names no layer stack field", proto.Identifier, proto.SessionField)
+		}
+	}
+	return nil
+}
+
+// usesTransport reports whether any protocol travels over network.
+func (t *TunnelNode) usesTransport(network string) bool {
+	for i := range t.protocols {
+		if protocolTransport(&t.protocols[i]) == network {
+			return true
+		}
+	}
+	return false
+}
+
+// connTransport is the network of a tunnel connection as sessions record
+// it: "tcp", "udp", or empty for in-memory connections.
+func connTransport(conn net.Conn) string {
+	switch conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		return "tcp"
+	case *net.UDPAddr:
+		return "udp"
+	}
+	return ""
+}
+
+// vpnNetwork is the network VPN traffic comes and goes over: "udp" for
+// datagram VPNs such as WireGuard, or "tcp".
+func (t *TunnelNode) vpnNetwork() string {
+	network := *vpnNetwork
+	if network == "" {
+		network = t.config.Tunnel.VPNNetwork
+	}
+	if strings.EqualFold(network, "udp") {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// udpIdleTimeout is how long UDP peers and backend sockets may stay silent.
+func (t *TunnelNode) udpIdleTimeout() time.Duration {
+	if idle := time.Duration(t.config.Tunnel.UDPIdleTimeout) * time.Second; idle > 0 {
+		return idle
+	}
+	return defaultUDPIdleTimeout
+}
+
+// readSize is how much a session reads at once to wrap into one frame. On
+// UDP every frame is a datagram, so payloads are kept small enough not to
+// fragment, unless they are datagrams of a UDP VPN, which keep their size.
+func (t *TunnelNode) readSize(sess *session) int {
+	if sess.transport != "udp" || t.vpnNetwork() == "udp" {
+		return 65536
+	}
+	if n := t.config.Tunnel.UDPPayloadSize; n > 0 {
+		return n
+	}
+	return defaultUDPPayloadSize
+}
+
+// udpServer demultiplexes the datagrams of one UDP socket into a connection
+// per peer, handled as if it had been accepted. Tunnel clients are told
+// apart by the session ID their frames carry in a protocol's session_field,
+// so a client keeps its session when its address changes; other peers, and
+// clients without one, by their address.
+type udpServer struct {
+	t          *TunnelNode
+	conn       net.PacketConn
+	idle       time.Duration
+	handle     func(net.Conn)
+	sessionIDs bool
+
+	mu    sync.Mutex
+	peers map[string]*datagramConn
+}
+
+// serveUDP listens on the node's port and hands each new peer to handle.
+// With sessionIDs the datagrams are tunnel frames that may carry one.
+func (t *TunnelNode) serveUDP(role string, handle func(net.Conn), sessionIDs bool) {
+	conn, err := net.ListenPacket("udp", ":"+t.listenPort)
+	if err != nil {
+		log.Fatalf("❌ Failed to listen on UDP port %s: %v", t.listenPort, err)
+	}
+	t.packetConn = conn
+
+	srv := &udpServer{
+		t:          t,
+		conn:       conn,
+		idle:       t.udpIdleTimeout(),
+		handle:     handle,
+		sessionIDs: sessionIDs,
+		peers:      make(map[string]*datagramConn),
+	}
+
+	log.Printf("✅ %s listening on UDP port %s", role, t.listenPort)
+	go srv.serve()
+}
+
+func (s *udpServer) serve() {
+	buffer := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			if s.t.ctx.Err() != nil {
+				return // Context cancelled
+			}
+			log.Printf("❌ UDP read error: %v", err)
+			continue
+		}
+		frame := append([]byte(nil), buffer[:n]...)
+
+		key := "addr:" + addr.String()
+		var id int64
+		hasID := false
+		if s.sessionIDs {
+			id, hasID = s.t.datagramSessionID(frame)
+		}
+		if hasID {
+			key = fmt.Sprintf("id:%d", id)
+		}
+
+		s.mu.Lock()
+		peer, exists := s.peers[key]
+		if !exists {
+			peer = newDatagramConn(s.conn, addr, s.idle)
+			if hasID {
+				peer.sessionID = id
+			}
+			peer.onClose = func() {
+				s.mu.Lock()
+				if s.peers[key] == peer {
+					delete(s.peers, key)
+				}
+				s.mu.Unlock()
+			}
+			s.peers[key] = peer
+		}
+		s.mu.Unlock()
+
+		if !exists {
+			if *verbose {
+				log.Printf("🔗 UDP session %s from %s", key, addr)
+			}
+			go s.handle(peer)
+		}
+		peer.deliver(frame, addr)
+	}
+}
+
+// datagramSessionID reads the session ID a frame carries in the
+// session_field of the first UDP protocol that decodes it.
+func (t *TunnelNode) datagramSessionID(frame []byte) (int64, bool) {
+	for i := range t.protocols {
+		proto := &t.protocols[i]
+		if proto.SessionField == "" || proto.LayerStack == nil || protocolTransport(proto) != "udp" {
+			continue
+		}
+		probe := &session{}
+		decoded, ok := t.decodeLayerStack(proto.LayerStack, frame, probe.receiveEnv(proto, frame))
+		if !ok || len(decoded.mismatched) > 0 {
+			continue
+		}
+		for _, df := range decoded.fields {
+			if df.name != proto.SessionField {
+				continue
+			}
+			if id, ok := toUint64(df.value); ok {
+				return int64(id), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// datagramConn is one client of a udpServer as a net.Conn: each Read returns
+// one datagram and each Write sends one to the client's address. A client
+// known by its session ID moves to the address of a datagram once its
+// session has accepted the frame, see acceptRemote. Reads fail once no
+// datagram has arrived for the idle timeout, which ends the session.
+// Deadlines aren't supported.
+type datagramConn struct {
+	conn      net.PacketConn
+	idle      time.Duration
+	frames    chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+	sessionID int64 // 0 when the client is known by its address
+
+	mu     sync.Mutex
+	remote net.Addr
+	from   net.Addr // of the datagram Read last returned
+}
+
+type datagram struct {
+	data []byte
+	from net.Addr
+}
+
+func newDatagramConn(conn net.PacketConn, remote net.Addr, idle time.Duration) *datagramConn {
+	return &datagramConn{
+		conn:   conn,
+		idle:   idle,
+		frames: make(chan datagram, 64),
+		closed: make(chan struct{}),
+		remote: remote,
+		from:   remote,
+	}
+}
+
+// deliver queues a datagram for Read, dropping it if the reader is behind as
+// the network would.
+func (c *datagramConn) deliver(frame []byte, from net.Addr) {
+	select {
+	case c.frames <- datagram{frame, from}:
+	case <-c.closed:
+	default:
+		if *verbose {
+			log.Printf("⚠️ UDP session %s is behind, datagram dropped", c.RemoteAddr())
+		}
+	}
+}
+
+// acceptRemote points the connection at the address the datagram Read last
+// returned came from, once the session has accepted its frame, so forged
+// datagrams can't redirect the session. It reports whether it changed.
+func (c *datagramConn) acceptRemote() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote.String() == c.from.String() {
+		return false
+	}
+	c.remote = c.from
+	return true
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	timer := time.NewTimer(c.idle)
+	defer timer.Stop()
+
+	select {
+	case d := <-c.frames:
+		c.mu.Lock()
+		c.from = d.from
+		c.mu.Unlock()
+		return copy(b, d.data), nil
+	case <-c.closed:
+		return 0, io.EOF
+	case <-timer.C:
+		if *verbose {
+			log.Printf("⌛ UDP session %s idle for %v", c.RemoteAddr(), c.idle)
+		}
+		return 0, io.EOF
+	}
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.conn.WriteTo(b, c.RemoteAddr())
+}
+
+func (c *datagramConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *datagramConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+func (c *datagramConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+func (c *datagramConn) SetDeadline(time.Time) error      { return nil }
+func (c *datagramConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *datagramConn) SetWriteDeadline(time.Time) error { return nil }
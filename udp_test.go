@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const udpTestPattern = `{"protocols": [{"identifier": "dgram", "transport": "udp", "session_field": "sid",
+ "layer_stack": {"layer7": {"header_size": 10, "fields": [
+  {"name": "sid", "offset": 0, "size": 8, "type": "uint64_be", "value": "${SESSION_ID}"},
+  {"name": "sum", "offset": 8, "size": 2, "type": "uint16_be", "computation": {"algorithm": "checksum", "scope": "all"}}]}},
+ "state_machine": {"initial_state": "s", "states": [{"name": "s", "transitions": []}]}}]}`
+
+func TestCheckTransports(t *testing.T) {
+	if err := checkTransports(reliableTestConfig(t, udpTestPattern).Protocols); err != nil {
+		t.Fatalf("valid protocol: %v", err)
+	}
+
+	tests := []struct {
+		change func([]Protocol) []Protocol
+		want   string
+	}{
+		{func(p []Protocol) []Protocol { p[0].Transport = "sctp"; return p }, "neither tcp nor udp"},
+		{func(p []Protocol) []Protocol { p[0].SessionField = "nosuch"; return p }, "names no layer stack field"},
+		{func(p []Protocol) []Protocol { p[0].LayerStack = nil; return p }, "names no layer stack field"},
+		{func(p []Protocol) []Protocol {
+			return append(p, reliableTestConfig(t, reliableTestPattern).Protocols[0])
+		}, "need it alike"},
+	}
+	for _, tt := range tests {
+		protocols := tt.change(reliableTestConfig(t, udpTestPattern).Protocols)
+		if err := checkTransports(protocols); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("error %v, want %q", err, tt.want)
+		}
+	}
+}
+
+func TestDatagramConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	moved := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	c := newDatagramConn(pc, peer.LocalAddr(), 50*time.Millisecond)
+	ended := false
+	c.onClose = func() { ended = true }
+
+	// Each Read returns one datagram, however small the buffer
+	c.deliver([]byte("first"), peer.LocalAddr())
+	c.deliver([]byte("second"), moved)
+	buf := make([]byte, 3)
+	if n, _ := c.Read(buf); string(buf[:n]) != "fir" {
+		t.Errorf("read %q", buf[:n])
+	}
+	buf = make([]byte, 64)
+	if n, _ := c.Read(buf); string(buf[:n]) != "second" {
+		t.Errorf("read %q", buf[:n])
+	}
+
+	// The datagram from another address doesn't move the connection until
+	// it is accepted
+	if c.RemoteAddr().String() != peer.LocalAddr().String() {
+		t.Errorf("moved to %s on reading", c.RemoteAddr())
+	}
+	if !c.acceptRemote() || c.RemoteAddr().String() != moved.String() || c.acceptRemote() {
+		t.Errorf("accepted, remote %s", c.RemoteAddr())
+	}
+
+	// Writes go to the remote address as datagrams
+	c.remote = peer.LocalAddr()
+	c.Write([]byte("reply"))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := peer.ReadFrom(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("peer got %q, %v", buf[:n], err)
+	}
+
+	// A silent peer ends, and a closed one stays closed
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Errorf("idle read: %v", err)
+	}
+	c.Close()
+	c.Close()
+	if !ended {
+		t.Error("onClose not called")
+	}
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Errorf("read after close: %v", err)
+	}
+	if _, err := c.Write([]byte("x")); err != net.ErrClosed {
+		t.Errorf("write after close: %v", err)
+	}
+	c.deliver([]byte("late"), moved) // doesn't block
+}
+
+// echoServer accepts TCP connections on loopback and sends back what they
+// send.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// udpTestClient is a tunnel client session speaking to a UDP server from
+// sockets of its own choosing.
+type udpTestClient struct {
+	t      *testing.T
+	node   *TunnelNode
+	sess   *session
+	server net.Addr
+}
+
+func newUDPTestClient(t *testing.T, pattern string, server net.Addr) *udpTestClient {
+	node := NewTunnelNode(reliableTestConfig(t, pattern), "client", "", "", "")
+	t.Cleanup(node.Close)
+	sock := udpSocket(t)
+	sess, _, err := node.openSession("client", &frameWriter{conn: &datagramConn{conn: sock, remote: server}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.closeSession(sess) })
+	return &udpTestClient{t: t, node: node, sess: sess, server: server}
+}
+
+func udpSocket(t *testing.T) net.PacketConn {
+	t.Helper()
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	return sock
+}
+
+// send wraps data into a frame and sends it from sock.
+func (c *udpTestClient) send(sock net.PacketConn, data []byte) {
+	if _, err := sock.WriteTo(c.node.wrapData(data, c.sess), c.server); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive returns the payload of the next frame sock receives, or nil if
+// none comes within wait.
+func (c *udpTestClient) receive(sock net.PacketConn, wait time.Duration) []byte {
+	buf := make([]byte, 65536)
+	sock.SetReadDeadline(time.Now().Add(wait))
+	n, _, err := sock.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	data, proto, _ := c.node.unwrapFrame(buf[:n], c.sess)
+	if proto == nil {
+		c.t.Errorf("unrecognized frame %x", buf[:n])
+	}
+	return data
+}
+
+// udpTestServer starts a tunnel server on a UDP port of its own, in front
+// of the VPN server at vpn, and returns its loopback address.
+func udpTestServer(t *testing.T, pattern, vpn string) (*TunnelNode, net.Addr) {
+	t.Helper()
+	server := NewTunnelNode(reliableTestConfig(t, pattern), "server", "0", "", vpn)
+	t.Cleanup(server.Close)
+	server.serveUDP("Server", server.handleServerConnection, true)
+	port := server.packetConn.LocalAddr().(*net.UDPAddr).Port
+	return server, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestUDPSessionMigration(t *testing.T) {
+	server, addr := udpTestServer(t, udpTestPattern, echoServer(t))
+	client := newUDPTestClient(t, udpTestPattern, addr)
+
+	first := udpSocket(t)
+	client.send(first, []byte("one"))
+	if got := client.receive(first, time.Second); string(got) != "one" {
+		t.Fatalf("echo %q", got)
+	}
+
+	// The client's address changes; its session ID keeps the session
+	second := udpSocket(t)
+	client.send(second, []byte("two"))
+	if got := client.receive(second, time.Second); string(got) != "two" {
+		t.Fatalf("echo after moving %q", got)
+	}
+	client.send(second, []byte("three"))
+	if got := client.receive(second, time.Second); string(got) != "three" {
+		t.Errorf("echo %q", got)
+	}
+	if got := client.receive(first, 50*time.Millisecond); got != nil {
+		t.Errorf("old address still gets %q", got)
+	}
+	if n := server.sessions.count(); n != 1 {
+		t.Errorf("%d server sessions", n)
+	}
+
+	// Another client gets a session of its own
+	other := newUDPTestClient(t, udpTestPattern, addr)
+	other.send(first, []byte("six"))
+	if got := other.receive(first, time.Second); string(got) != "six" {
+		t.Errorf("echo to another client %q", got)
+	}
+	if n := server.sessions.count(); n != 2 {
+		t.Errorf("%d server sessions", n)
+	}
+}
+
+func TestUDPReadSize(t *testing.T) {
+	config := reliableTestConfig(t, udpTestPattern)
+	node := NewTunnelNode(config, "client", "", "", "")
+	defer node.Close()
+	sess := &session{transport: "udp"}
+	if n := node.readSize(sess); n != defaultUDPPayloadSize {
+		t.Errorf("UDP read size %d", n)
+	}
+	config.Tunnel.UDPPayloadSize = 500
+	if n := node.readSize(sess); n != 500 {
+		t.Errorf("UDP read size %d with udp_payload_size 500", n)
+	}
+	if n := node.readSize(&session{transport: "tcp"}); n != 65536 {
+		t.Errorf("TCP read size %d", n)
+	}
+}
+
+// udpEchoServer sends back every datagram it receives on loopback, and
+// reports the address of each sender it hasn't seen before.
+func udpEchoServer(t *testing.T) (string, <-chan net.Addr) {
+	t.Helper()
+	sock := udpSocket(t)
+	senders := make(chan net.Addr, 16)
+	go func() {
+		seen := make(map[string]bool)
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := sock.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !seen[from.String()] {
+				seen[from.String()] = true
+				senders <- from
+			}
+			sock.WriteTo(buf[:n], from)
+		}
+	}()
+	return sock.LocalAddr().String(), senders
+}
+
+func TestUDPVPNBackend(t *testing.T) {
+	pattern := strings.TrimSuffix(udpTestPattern, "}") + `, "tunnel": {"vpn_network": "udp", "udp_idle_timeout": 1}}`
+	vpn, senders := udpEchoServer(t)
+	server, addr := udpTestServer(t, pattern, vpn)
+	client := newUDPTestClient(t, pattern, addr)
+	sock := udpSocket(t)
+
+	// Datagrams keep their boundaries, and their size past udp_payload_size
+	datagrams := [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 3000), []byte("c")}
+	for _, d := range datagrams {
+		client.send(sock, d)
+	}
+	for _, want := range datagrams {
+		if got := client.receive(sock, time.Second); !bytes.Equal(got, want) {
+			t.Errorf("echo of %d bytes: %d bytes", len(want), len(got))
+		}
+	}
+
+	// Each session has a socket of its own towards the VPN server
+	other := newUDPTestClient(t, pattern, addr)
+	other.send(udpSocket(t), []byte("d"))
+	first, second := <-senders, <-senders
+	if first.String() == second.String() {
+		t.Errorf("both sessions send from %s", first)
+	}
+
+	// Sessions end once they fall silent
+	deadline := time.Now().Add(3 * time.Second)
+	for server.sessions.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := server.sessions.count(); n != 0 {
+		t.Errorf("%d sessions after the idle timeout", n)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPutBits(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		pos      int
+		bits     int
+		value    uint64
+		msbFirst bool
+		want     []byte
+	}{
+		// IPv4 version and IHL, numbered as in RFC 791
+		{"version", 1, 0, 4, 4, true, []byte{0x40}},
+		{"ihl", 1, 4, 4, 5, true, []byte{0x05}},
+		// TCP data offset and flags across two bytes, as in RFC 9293
+		{"data offset", 2, 0, 4, 5, true, []byte{0x50, 0x00}},
+		{"syn+ack", 2, 10, 6, 0x12, true, []byte{0x00, 0x12}},
+		{"msb crossing", 2, 6, 4, 0xf, true, []byte{0x03, 0xc0}},
+		{"lsb low", 1, 0, 3, 5, false, []byte{0x05}},
+		{"lsb crossing", 2, 6, 4, 0xf, false, []byte{0xc0, 0x03}},
+		{"lsb 12 bits", 2, 4, 12, 0xabc, false, []byte{0xc0, 0xab}},
+		{"wide", 8, 1, 62, 1<<62 - 1, true, []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}},
+		{"truncated value", 1, 0, 4, 0x1f, true, []byte{0xf0}},
+		{"past the end", 1, 6, 4, 0xf, false, []byte{0xc0}},
+	}
+	for _, tt := range tests {
+		buf := make([]byte, tt.size)
+		putBits(buf, tt.pos, tt.bits, tt.value, tt.msbFirst)
+		if !bytes.Equal(buf, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, buf, tt.want)
+		}
+	}
+}
+
+func TestBitsRoundTrip(t *testing.T) {
+	for _, msbFirst := range []bool{false, true} {
+		for pos := 0; pos < 24; pos++ {
+			for size := 1; pos+size <= 32; size++ {
+				value := uint64(0x5a5a5a5a) & (1<<size - 1)
+				buf := bytes.Repeat([]byte{0xff}, 4)
+				putBits(buf, pos, size, value, msbFirst)
+				if got := getBits(buf, pos, size, msbFirst); got != value {
+					t.Fatalf("msb %v pos %d size %d: read %#x, wrote %#x", msbFirst, pos, size, got, value)
+				}
+				// Bits outside the range are left alone
+				putBits(buf, pos, size, 1<<size-1, msbFirst)
+				if !bytes.Equal(buf, []byte{0xff, 0xff, 0xff, 0xff}) {
+					t.Fatalf("msb %v pos %d size %d: touched other bits: %x", msbFirst, pos, size, buf)
+				}
+			}
+		}
+	}
+}
+
+func TestBitfieldField(t *testing.T) {
+	field := Field{
+		Type:     "bitfield",
+		Offset:   1,
+		Size:     2,
+		BitOrder: "msb",
+		Bits: map[string]BitField{
+			"offset": {Position: 0, Size: 4, Value: 5},
+			"flags":  {Position: 10, Size: 6},
+		},
+	}
+	packet := make([]byte, 4)
+	var node TunnelNode
+	node.setBitfield(packet, field, map[string]interface{}{"flags": int64(0x18)})
+	if want := []byte{0, 0x50, 0x18, 0}; !bytes.Equal(packet, want) {
+		t.Fatalf("packet %x, want %x", packet, want)
+	}
+
+	v, ok := decodeValue(field, packet[1:3])
+	values, _ := v.(map[string]interface{})
+	if !ok || values["offset"] != int64(5) || values["flags"] != int64(0x18) {
+		t.Errorf("decoded %#v, want offset 5 and flags 0x18", v)
+	}
+
+	// A bitfield beyond the packet is left out
+	node.setBitfield(packet[:2], field, nil)
+	if want := []byte{0, 0x50}; !bytes.Equal(packet[:2], want) {
+		t.Errorf("short packet %x, want %x", packet[:2], want)
+	}
+}
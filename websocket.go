@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket framing as RFC 6455 defines it
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+	wsCloseTooBig   = 1009
+
+	wsMaxMessage          = 16 << 20
+	defaultWSPingInterval = 30 * time.Second
+)
+
+// checkWebSocket validates the WebSocket settings of the tunnel.
+func checkWebSocket(cfg *WebSocketConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Path != "" && !strings.HasPrefix(cfg.Path, "/") {
+		return fmt.Errorf("path %q doesn't start with /", cfg.Path)
+	}
+	for name := range cfg.Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Accept":
+			return fmt.Errorf("header %s is set by the handshake", name)
+		}
+	}
+	return nil
+}
+
+func websocketPath(cfg *WebSocketConfig) string {
+	if cfg.Path == "" {
+		return "/"
+	}
+	return cfg.Path
+}
+
+func websocketPingInterval(cfg *WebSocketConfig) time.Duration {
+	if cfg.PingInterval > 0 {
+		return time.Duration(cfg.PingInterval) * time.Second
+	}
+	return defaultWSPingInterval
+}
+
+// websocketAccept is the Sec-WebSocket-Accept answering key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dialWebSocket upgrades a connection to the tunnel server, which may be a
+// reverse proxy in front of it, to a WebSocket.
+func (t *TunnelNode) dialWebSocket(conn net.Conn) (net.Conn, error) {
+	cfg := t.config.Tunnel.WebSocket
+	host := cfg.Host
+	if host == "" && t.config.Tunnel.TLS != nil {
+		host = t.config.Tunnel.TLS.ServerName
+	}
+	if host == "" {
+		host = t.serverAddr
+	}
+
+	nonce := make([]byte, 16)
+	crand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	var req strings.Builder
+	fmt.Fprintf(&req, "GET %s HTTP/1.1\r\n", websocketPath(cfg))
+	fmt.Fprintf(&req, "Host: %s\r\n", host)
+	for name, value := range cfg.Headers {
+		fmt.Fprintf(&req, "%s: %s\r\n", name, value)
+	}
+	req.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&req, "Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, req.String()); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket: server answered %s", resp.Status)
+	}
+	if !headerHasToken(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, errors.New("websocket: server didn't accept the upgrade")
+	}
+	return newWSConn(conn, br, true, websocketPingInterval(cfg)), nil
+}
+
+// acceptWebSocket answers the upgrade request of a tunnel client. Other
+// requests, and requests for another path, get a plain 404 as from any web
+// server.
+func (t *TunnelNode) acceptWebSocket(conn net.Conn) (net.Conn, error) {
+	cfg := t.config.Tunnel.WebSocket
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %v", err)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || req.URL.Path != websocketPath(cfg) ||
+		!headerHasToken(req.Header, "Connection", "upgrade") ||
+		!headerHasToken(req.Header, "Upgrade", "websocket") || key == "" {
+		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nContent-Length: 9\r\nConnection: close\r\n\r\nNot Found")
+		return nil, fmt.Errorf("websocket: no upgrade in %s %s", req.Method, req.URL.Path)
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		io.WriteString(conn, "HTTP/1.1 426 Upgrade Required\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\n\r\n")
+		return nil, fmt.Errorf("websocket: version %q", req.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	var resp strings.Builder
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&resp, "Sec-WebSocket-Accept: %s\r\n", websocketAccept(key))
+	for name, value := range cfg.ResponseHeaders {
+		fmt.Fprintf(&resp, "%s: %s\r\n", name, value)
+	}
+	resp.WriteString("\r\n")
+	if _, err := io.WriteString(conn, resp.String()); err != nil {
+		return nil, err
+	}
+	return newWSConn(conn, br, false, websocketPingInterval(cfg)), nil
+}
+
+// headerHasToken reports whether a comma-separated header holds token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn carries a tunnel connection over WebSocket: each Write sends one
+// binary message and each Read returns one message, or as much of it as
+// fits, so frames keep their boundaries. Pings are answered as they arrive
+// and sent every ping interval, which keeps proxies from timing out.
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // clients mask their frames, servers must not
+
+	wmu       sync.Mutex // one frame written at a time
+	closeSent bool       // no frames may follow a close frame
+	rest      []byte     // of a message longer than a Read
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, client bool, ping time.Duration) *wsConn {
+	c := &wsConn{Conn: conn, br: br, client: client, closed: make(chan struct{})}
+	go c.keepAlive(ping)
+	return c
+}
+
+func (c *wsConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.writeFrame(wsPing, nil) != nil {
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if len(c.rest) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.rest = message
+	}
+	n := copy(b, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// readMessage returns the next data message, reassembled from its
+// fragments, and handles the control frames before and between them.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// Echo the status code and end the connection
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, c.fail(wsCloseProtocol, "new message inside a fragmented one")
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, c.fail(wsCloseProtocol, "continuation without a message")
+			}
+		default:
+			return nil, c.fail(wsCloseProtocol, fmt.Sprintf("unknown opcode %#x", opcode))
+		}
+		if len(message)+len(payload) > wsMaxMessage {
+			return nil, c.fail(wsCloseTooBig, "message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		err = c.fail(wsCloseProtocol, "reserved bits set")
+		return
+	}
+	if masked == c.client {
+		// Client frames are masked and server frames aren't (RFC 6455 5.1)
+		err = c.fail(wsCloseProtocol, "wrong masking")
+		return
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (length > 125 || !fin) {
+		err = c.fail(wsCloseProtocol, "bad control frame")
+		return
+	}
+	if length > wsMaxMessage {
+		err = c.fail(wsCloseTooBig, "frame too big")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame sends payload as one final frame, masked when the client
+// sends it, unless a close frame has gone out.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		crand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	c.closeSent = opcode == wsClose
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// fail closes the connection with a status code after a protocol error.
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+	if *verbose {
+		log.Printf("❌ WebSocket with %s: %s", c.RemoteAddr(), reason)
+	}
+	return errors.New("websocket: " + reason)
+}
+
+// Close sends a normal close frame and closes the connection without
+// waiting for the peer's.
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	})
+	return c.Conn.Close()
+}
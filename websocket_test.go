@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wsTestFrame struct {
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+// parseWSFrames splits what a wsConn wrote into frames.
+func parseWSFrames(t *testing.T, data []byte) []wsTestFrame {
+	t.Helper()
+	var frames []wsTestFrame
+	for len(data) > 0 {
+		if len(data) < 2 {
+			t.Fatalf("truncated frame %x", data)
+		}
+		f := wsTestFrame{opcode: data[0] & 0x0F, masked: data[1]&0x80 != 0}
+		length := int(data[1] & 0x7F)
+		data = data[2:]
+		switch length {
+		case 126:
+			length, data = int(binary.BigEndian.Uint16(data)), data[2:]
+		case 127:
+			length, data = int(binary.BigEndian.Uint64(data)), data[8:]
+		}
+		var mask [4]byte
+		if f.masked {
+			copy(mask[:], data)
+			data = data[4:]
+		}
+		f.payload = append([]byte(nil), data[:length]...)
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+		frames = append(frames, f)
+		data = data[length:]
+	}
+	return frames
+}
+
+// wsPipe returns a wsConn whose peer sends raw, and a func that closes the
+// conn and returns the frames it wrote.
+func wsPipe(t *testing.T, client bool, raw []byte) (*wsConn, func() []wsTestFrame) {
+	a, b := net.Pipe()
+	c := newWSConn(a, bufio.NewReader(a), client, time.Hour)
+	go b.Write(raw)
+	written := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(b)
+		written <- data
+	}()
+	return c, func() []wsTestFrame {
+		c.Close()
+		return parseWSFrames(t, <-written)
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// RFC 6455, section 1.3
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept = %s", got)
+	}
+}
+
+func TestWebSocketRead(t *testing.T) {
+	// RFC 6455, section 5.7: a masked "Hello" from a client
+	c, done := wsPipe(t, false, mustHex(t, "818537fa213d7f9f4d5158"))
+	buf := make([]byte, 100)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "Hello" {
+		t.Errorf("masked Hello read as %q, %v", buf[:n], err)
+	}
+	done()
+
+	// A fragmented "Hello" with a ping between the fragments
+	c, done = wsPipe(t, true, mustHex(t, "010348656c"+"890548656c6c6f"+"80026c6f"))
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "Hello" {
+		t.Errorf("fragmented Hello read as %q, %v", buf[:n], err)
+	}
+	frames := done()
+	if len(frames) != 2 || frames[0].opcode != wsPong || string(frames[0].payload) != "Hello" || !frames[0].masked {
+		t.Fatalf("ping answered with %+v", frames)
+	}
+	if frames[1].opcode != wsClose || !bytes.Equal(frames[1].payload, []byte{0x03, 0xe8}) {
+		t.Errorf("closed with %+v", frames[1])
+	}
+
+	// A message longer than a Read keeps its boundary
+	message := bytes.Repeat([]byte("x"), 256)
+	raw := append(mustHex(t, "827e0100"), message...)
+	raw = append(raw, 0x82, 0x01, 'y')
+	c, done = wsPipe(t, true, raw)
+	for _, want := range []int{100, 100, 56, 1} {
+		if n, err := c.Read(buf[:100]); err != nil || n != want {
+			t.Fatalf("read %d bytes, %v; want %d", n, err, want)
+		}
+	}
+	done()
+}
+
+func TestWebSocketWrite(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		c, done := wsPipe(t, client, nil)
+		payloads := [][]byte{[]byte("hi"), bytes.Repeat([]byte("a"), 300), bytes.Repeat([]byte("b"), 70000)}
+		for _, p := range payloads {
+			if n, err := c.Write(p); err != nil || n != len(p) {
+				t.Fatalf("write of %d bytes: %d, %v", len(p), n, err)
+			}
+		}
+		frames := done()
+		if len(frames) != len(payloads)+1 {
+			t.Fatalf("client %v wrote %d frames", client, len(frames))
+		}
+		for i, p := range payloads {
+			if f := frames[i]; f.opcode != wsBinary || f.masked != client || !bytes.Equal(f.payload, p) {
+				t.Errorf("client %v frame %d: opcode %d, masked %v, %d bytes", client, i, f.opcode, f.masked, len(f.payload))
+			}
+		}
+		if _, err := c.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("write after close: %v", err)
+		}
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	c, done := wsPipe(t, true, mustHex(t, "880203e9"))
+	if _, err := c.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("read after close frame: %v", err)
+	}
+	if _, err := c.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close frame: %v", err)
+	}
+	frames := done()
+	if len(frames) != 1 || frames[0].opcode != wsClose || !bytes.Equal(frames[0].payload, []byte{0x03, 0xe9}) {
+		t.Errorf("close answered with %+v", frames)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		code uint16
+	}{
+		{"818537fa213d7f9f4d5158", "wrong masking", wsCloseProtocol},
+		{"c100", "reserved bits", wsCloseProtocol},
+		{"0900", "bad control frame", wsCloseProtocol},
+		{"897e007e", "bad control frame", wsCloseProtocol},
+		{"8000", "continuation without a message", wsCloseProtocol},
+		{"010161" + "810162", "new message inside", wsCloseProtocol},
+		{"8300", "unknown opcode", wsCloseProtocol},
+		{"827f0000000001000001", "too big", wsCloseTooBig},
+	}
+	for _, tt := range tests {
+		c, done := wsPipe(t, true, mustHex(t, tt.raw))
+		_, err := c.Read(make([]byte, 16))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.raw, err, tt.want)
+		}
+		frames := done()
+		if len(frames) != 1 || frames[0].opcode != wsClose || binary.BigEndian.Uint16(frames[0].payload) != tt.code {
+			t.Errorf("%s: closed with %+v, want code %d", tt.raw, frames, tt.code)
+		}
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	node := func(mode, path string) *TunnelNode {
+		return &TunnelNode{mode: mode, serverAddr: "tunnel.example:443", config: &Config{Tunnel: TunnelConfig{
+			WebSocket: &WebSocketConfig{Path: path, Headers: map[string]string{"Origin": "https://tunnel.example"}},
+		}}}
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := node("server", "/ws").acceptWebSocket(b)
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		accepted <- conn
+	}()
+	client, err := node("client", "/ws").dialWebSocket(a)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		return
+	}
+	defer func() {
+		// With the pipe closed first, the close frames don't wait for a reader
+		a.Close()
+		client.Close()
+		server.Close()
+	}()
+
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 16)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("server read %q, %v", buf[:n], err)
+	}
+	go server.Write([]byte("pong"))
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("client read %q, %v", buf[:n], err)
+	}
+
+	// Requests for another path get a 404
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go node("server", "/ws").acceptWebSocket(s)
+	if _, err := node("client", "/other").dialWebSocket(c); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("dial of another path: %v", err)
+	}
+}